@@ -0,0 +1,264 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package audit keeps a hash chained, append only log of the secret operations
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// Syslog is the destination that sends the audit log to the local syslog daemon
+const Syslog = "syslog"
+
+// Write is the operation recorded for a file written after an action, the other
+// operations are the actions of the sls package
+const Write = "write"
+
+// ErrTampered is returned when an entry of an audit log does not follow from the one before it
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// Entry is one record of the audit log, it never holds a plain text value
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	File      string    `json:"file,omitempty"`
+	// Path is the colon separated YAML path of the value
+	Path           string `json:"path,omitempty"`
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	User           string `json:"user"`
+	Host           string `json:"host"`
+	// CipherTextHash is the SHA-256 of the encrypted value, or of the file written
+	CipherTextHash string `json:"ciphertext_sha256,omitempty"`
+	// Prev is the hash of the entry before this one, empty for the first entry
+	Prev string `json:"prev"`
+	// Hash is the SHA-256 of the entry with Hash left empty, which covers Prev
+	Hash string `json:"hash"`
+}
+
+// Log appends entries to a JSONL file or to syslog. A Log is safe for concurrent use, and
+// entries written to a file by several processes at once are chained in the order written.
+type Log struct {
+	mu     sync.Mutex
+	file   *os.File
+	syslog syslogWriter
+	// prev chains the entries sent to syslog, which cannot be read back, so each
+	// process starts a new chain
+	prev string
+	user string
+	host string
+}
+
+// syslogWriter sends entries to the local syslog daemon
+type syslogWriter interface {
+	Notice(msg string) error
+	Close() error
+}
+
+// Open opens the audit log at the destination, the path of a JSONL file that is created
+// when missing or Syslog
+func Open(dest string) (*Log, error) {
+	l := &Log{user: currentUser(), host: hostname()}
+	if dest == Syslog {
+		w, err := openSyslog()
+		if err != nil {
+			return nil, fmt.Errorf("unable to open syslog for the audit log: %w", err)
+		}
+		l.syslog = w
+		return l, nil
+	}
+
+	file, err := homedir.Expand(dest)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create the audit log directory: %w", err)
+	}
+	l.file, err = os.OpenFile(filepath.Clean(file), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the audit log: %w", err)
+	}
+	return l, nil
+}
+
+// Record fills in the time, user, host and hashes of the entry and appends it to the log
+func (l *Log) Record(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Time = time.Now().UTC()
+	e.User = l.user
+	e.Host = l.host
+	if l.syslog != nil {
+		e.Prev = l.prev
+		e.Hash = e.sum()
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err = l.syslog.Notice(string(line)); err != nil {
+			return fmt.Errorf("unable to write the audit log: %w", err)
+		}
+		l.prev = e.Hash
+		return nil
+	}
+
+	// the lock keeps other processes from appending between reading the last hash
+	// and writing the entry that follows it
+	if err := lockFile(l.file); err != nil {
+		return fmt.Errorf("unable to lock the audit log: %w", err)
+	}
+	defer func() { _ = unlockFile(l.file) }()
+
+	var err error
+	if e.Prev, err = lastHash(l.file); err != nil {
+		return err
+	}
+	e.Hash = e.sum()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to write the audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file or the connection to syslog
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syslog != nil {
+		return l.syslog.Close()
+	}
+	return l.file.Close()
+}
+
+// Verify checks that every entry read follows from the one before it and returns the
+// number of entries. ErrTampered is returned for an entry changed in place, or inserted or
+// deleted before the last entry. The chain is not anchored, so entries cut from the end
+// of the log, or a log rewritten as a whole, are not detected.
+func Verify(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	count, number, prev := 0, 0, ""
+	for scanner.Scan() {
+		number++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return count, fmt.Errorf("%w: line %d cannot be read: %s", ErrTampered, number, err)
+		}
+		if e.Prev != prev {
+			return count, fmt.Errorf("%w: line %d does not follow the entry before it", ErrTampered, number)
+		}
+		if e.Hash != e.sum() {
+			return count, fmt.Errorf("%w: line %d does not match its hash", ErrTampered, number)
+		}
+		prev = e.Hash
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// HashCipherText returns the hex encoded SHA-256 of an encrypted value or file
+func HashCipherText(cipherText []byte) string {
+	sum := sha256.Sum256(cipherText)
+	return hex.EncodeToString(sum[:])
+}
+
+// sum is the hash of the entry with the hash itself left out
+func (e Entry) sum() string {
+	e.Hash = ""
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	return HashCipherText(buf)
+}
+
+// lastHash returns the hash of the last entry of the file, empty for an empty file
+func lastHash(file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	const chunkSize = 4096
+	var tail []byte
+	for end := info.Size(); end > 0; {
+		start := end - chunkSize
+		if start < 0 {
+			start = 0
+		}
+		chunk := make([]byte, end-start)
+		if _, err = file.ReadAt(chunk, start); err != nil {
+			return "", err
+		}
+		tail = append(chunk, tail...)
+		end = start
+
+		line := bytes.TrimRight(tail, "\n")
+		i := bytes.LastIndexByte(line, '\n')
+		if len(line) == 0 || (i < 0 && end > 0) {
+			continue
+		}
+		var e Entry
+		if err = json.Unmarshal(line[i+1:], &e); err != nil {
+			return "", fmt.Errorf("%w: the last entry cannot be read: %s", ErrTampered, err)
+		}
+		return e.Hash, nil
+	}
+	return "", nil
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
@@ -0,0 +1,138 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func record(t *testing.T, l *Log, entries ...Entry) {
+	t.Helper()
+	for _, e := range entries {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestChain tests that entries are chained across opening the log again and that
+// changing, removing or adding an entry breaks the chain
+func TestChain(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "logs", "audit.jsonl")
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l,
+		Entry{Operation: "encrypt", File: "prod.sls", Path: "db:password", CipherTextHash: HashCipherText([]byte("one"))},
+		Entry{Operation: "decrypt", File: "prod.sls", Path: "db:password", CipherTextHash: HashCipherText([]byte("one"))},
+	)
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, Entry{Operation: Write, File: "prod.sls"})
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the audit log to be private, got %v", info.Mode().Perm())
+	}
+	count, err := Verify(bytes.NewReader(buf))
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 chained entries, got %d: %v", count, err)
+	}
+	if !strings.Contains(string(buf), `"user":"`) || !strings.Contains(string(buf), `"host":"`) {
+		t.Errorf("expected the user and host to be recorded:\n%s", buf)
+	}
+
+	lines := strings.SplitAfter(string(buf), "\n")
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"changed entry", strings.Replace(string(buf), `"operation":"decrypt"`, `"operation":"encrypt"`, 1)},
+		{"removed entry", lines[0] + lines[2]},
+		{"reordered entries", lines[1] + lines[0] + lines[2]},
+		{"added entry", string(buf) + `{"operation":"decrypt","prev":"","hash":""}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(strings.NewReader(tt.contents)); !errors.Is(err, ErrTampered) {
+				t.Errorf("expected ErrTampered, got %v", err)
+			}
+		})
+	}
+}
+
+// TestConcurrentRecords tests that logs written to one file at once stay chained
+func TestConcurrentRecords(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		// each log stands in for a separate process appending to the file
+		l, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := l.Record(Entry{Operation: "rotate", Path: "key"}); err != nil {
+					t.Error(err)
+				}
+			}
+			_ = l.Close()
+		}()
+	}
+	wg.Wait()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	count, err := Verify(f)
+	if err != nil || count != 40 {
+		t.Errorf("expected 40 chained entries, got %d: %v", count, err)
+	}
+}
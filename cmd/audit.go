@@ -0,0 +1,89 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/audit checks the audit log of secret operations
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "check the audit log of secret operations",
+}
+
+// auditVerifyCmd represents the audit verify command
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify [file]",
+	Short: "check that no entry of the audit log was changed, inserted or deleted",
+	Long: `Check the hash chain of the audit log file given, or of the --audit-log option or profile.
+
+Entries changed in place, and entries inserted or deleted before the last one, break the
+chain. The chain is not anchored, so entries cut from the end of the log, or a log rewritten
+as a whole, are not detected; keep a copy of the last hash elsewhere to check for those.
+
+Exits with 0 when the chain is intact, 2 when it is broken and 1 on any other error.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: run(func(o *options, args []string) {
+		file := o.keys.auditLog
+		if len(args) > 0 {
+			file = args[0]
+		}
+		switch file {
+		case "":
+			o.logger.Fatal().Msg("audit verify: no audit log given and the profile has none")
+		case audit.Syslog:
+			o.logger.Fatal().Msg("audit verify: entries sent to syslog cannot be read back, check them where syslog keeps them")
+		}
+
+		fullPath, err := homedir.Expand(file)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("audit verify")
+		}
+		f, err := os.Open(filepath.Clean(fullPath))
+		if err != nil {
+			o.logger.Fatal().Err(err).Str("file", file).Msg("audit verify: cannot read the audit log")
+		}
+		count, err := audit.Verify(f)
+		_ = f.Close()
+		if errors.Is(err, audit.ErrTampered) {
+			fmt.Printf("%s: %s\n", file, err)
+			os.Exit(problemsFound)
+		}
+		if err != nil {
+			o.logger.Fatal().Err(err).Str("file", file).Msg("audit verify: cannot read the audit log")
+		}
+		fmt.Printf("%s: %d entries, the chain is intact\n", file, count)
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+}
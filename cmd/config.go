@@ -0,0 +1,179 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/config creates, checks and shows the config file
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Everbridge/generate-secure-pillar/config"
+	"github.com/spf13/cobra"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "create, check and show the config file",
+}
+
+// configTemplate is the config file config init writes, every setting is commented out
+const configTemplate = `# generate-secure-pillar config file
+#
+# Profiles name the keys values are encrypted to and the defaults of the global
+# options. A profile is selected with --profile, or the default profile is used.
+# Check this file with "generate-secure-pillar config validate".
+profiles:
+#  - name: dev
+#    default: true
+#    default_key: Dev Salt Master
+#    gnupg_home: ~/.gnupg
+#    element: secure
+#
+#  - name: prod
+#    default_key: Prod Salt Master
+#    key_fingerprint: 4CCC209C2087ECF97D1AD177E78ADB0AF03CE5DD
+#    default_pub_ring: /etc/salt/gpgkeys/pubring.gpg
+#    default_sec_ring: /etc/salt/gpgkeys/secring.gpg
+#    backend: keyring
+#    recipients:
+#      - Break Glass
+#    signing_key: Prod Release Signer
+#    signature_policy: require
+#    expiry_warning_days: 60
+#    audit_log: /var/log/generate-secure-pillar/audit.jsonl
+#    crypto:
+#      cipher: aes256
+#      hash: sha256
+#      compression: zlib
+#
+#  - name: prod-eu
+#    extends: prod
+#    default_key: Prod EU Salt Master
+`
+
+// configInitCmd represents the config init command
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "write a config file template",
+	Long: `Write a config file with commented out example profiles to the --config file, or to
+$HOME/.config/generate-secure-pillar/config.yaml. An existing file is only replaced with --force.`,
+	Args: cobra.NoArgs,
+	Run: run(func(o *options, args []string) {
+		file := o.configFile
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			o.logger.Fatal().Err(err).Msg("config init: cannot create the config directory")
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if o.on("force") {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		out, err := os.OpenFile(filepath.Clean(file), flags, 0600)
+		if errors.Is(err, os.ErrExist) {
+			o.logger.Fatal().Msgf("config init: %s already exists, use --force to replace it", file)
+		}
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("config init")
+		}
+		if _, err = out.WriteString(configTemplate); err != nil {
+			_ = out.Close()
+			o.logger.Fatal().Err(err).Msg("config init")
+		}
+		if err = out.Close(); err != nil {
+			o.logger.Fatal().Err(err).Msg("config init")
+		}
+		fmt.Printf("wrote %s\n", file)
+	}),
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "check the config file",
+	Long: `Check the config file: unknown keys, profiles without a name or a key, names used twice,
+more than one default profile and bad values are all reported.
+
+Exits with 0 when the config file is valid, 2 when problems are found and 1 on any other error.`,
+	Args: cobra.NoArgs,
+	Run: run(func(o *options, args []string) {
+		file := o.configFile
+		cfg, err := config.LoadConfig(file)
+		// a file that cannot be read is an error, not a problem with the config
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			o.logger.Fatal().Err(err).Msg("config validate")
+		}
+		if cfg != nil {
+			err = errors.Join(err, cfg.Validate())
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(problemsFound)
+		}
+		fmt.Printf("%s: %d profiles, no problems found\n", file, len(cfg.Profiles))
+	}),
+}
+
+// configShowCmd represents the config show command
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "show the profile selected with --profile, or the default profile",
+	Long: `Show the profile selected with --profile, or the default profile, as YAML with the key
+rings it uses filled in.`,
+	Args: cobra.NoArgs,
+	Run: run(func(o *options, args []string) {
+		if o.configErr != nil {
+			o.logger.Fatal().Err(o.configErr).Msg("config show")
+		}
+		prof, err := o.userConfig.Profile(o.str("profile"))
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("config show")
+		}
+		if prof == nil {
+			o.logger.Fatal().Msgf("config show: no --profile given and %s has no default profile", o.userConfig.File)
+		}
+
+		shown := *prof
+		shown.DefaultPubRing = prof.PubRing()
+		shown.DefaultSecRing = prof.SecRing()
+		enc := yamlv3.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err = enc.Encode(shown); err != nil {
+			o.logger.Fatal().Err(err).Msg("config show")
+		}
+		if err = enc.Close(); err != nil {
+			o.logger.Fatal().Err(err).Msg("config show")
+		}
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configInitCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configShowCmd)
+	configInitCmd.Flags().Bool("force", false, "replace an existing config file")
+}
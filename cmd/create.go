@@ -26,7 +26,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
 	"github.com/spf13/cobra"
 )
@@ -35,19 +34,21 @@ import (
 var createCmd = &cobra.Command{
 	Use:   "create",
 	Short: "create a new sls file",
-	Run: func(cmd *cobra.Command, args []string) {
+	Run: run(func(o *options, args []string) {
+		outputFilePath := o.str("outfile")
+
 		// Validate path for directory traversal attacks
 		if utils.ContainsDirectoryTraversal(outputFilePath) {
-			logger.Fatal().Msgf("create: invalid output file path - directory traversal detected in %s", outputFilePath)
+			o.logger.Fatal().Msgf("create: invalid output file path - directory traversal detected in %s", outputFilePath)
 		}
 
 		outputFilePath, err := filepath.Abs(outputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("create: failed to resolve output file path")
+			o.logger.Fatal().Err(err).Msg("create: failed to resolve output file path")
 		}
 		// Parse secret names and values with proper trimming
-		nameStr := strings.TrimSpace(cmd.Flag("name").Value.String())
-		valueStr := strings.TrimSpace(cmd.Flag("value").Value.String())
+		nameStr := strings.TrimSpace(o.cmd.Flag("name").Value.String())
+		valueStr := strings.TrimSpace(o.cmd.Flag("value").Value.String())
 
 		// Remove surrounding brackets if present
 		nameStr = strings.Trim(nameStr, "[]")
@@ -66,48 +67,43 @@ var createCmd = &cobra.Command{
 
 		// Validate input arrays
 		if len(secretNames) == 0 {
-			logger.Fatal().Msg("create: no secret names provided")
+			o.logger.Fatal().Msg("create: no secret names provided")
 		}
 		if len(secretValues) == 0 {
-			logger.Fatal().Msg("create: no secret values provided")
+			o.logger.Fatal().Msg("create: no secret values provided")
 		}
 		if len(secretNames) != len(secretValues) {
-			logger.Fatal().Msgf("create: mismatch between number of names (%d) and values (%d)", len(secretNames), len(secretValues))
+			o.logger.Fatal().Msgf("create: mismatch between number of names (%d) and values (%d)", len(secretNames), len(secretValues))
 		}
 
 		// Check for empty names or values
 		for i, name := range secretNames {
 			if strings.TrimSpace(name) == "" {
-				logger.Fatal().Msgf("create: secret name at position %d is empty", i+1)
+				o.logger.Fatal().Msgf("create: secret name at position %d is empty", i+1)
 			}
 		}
 
-		pk := getPki()
-		s := sls.New(outputFilePath, *pk, topLevelElement)
-
-		// Check if the file contains include statements (not supported)
-		if s.IsInclude {
-			logger.Fatal().Msgf("create: file %s contains include statements and cannot be processed", outputFilePath)
+		pk := o.pkiForFile(outputFilePath)
+		// a new file has nothing to read, it is only written once the values are added
+		slsPath := outputFilePath
+		if _, statErr := os.Stat(outputFilePath); os.IsNotExist(statErr) {
+			slsPath = ""
 		}
+		s := o.readSls("create", slsPath, pk)
+		s.FilePath = outputFilePath
 
 		err = s.ProcessYaml(secretNames, secretValues)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("create: failed to process YAML")
+			o.logger.Fatal().Err(err).Msg("create: failed to process YAML")
 		}
 		buffer, err := s.FormatBuffer("")
-		if err != nil {
-			logger.Fatal().Err(err).Msg("create: failed to format buffer")
-		}
-		_, err = sls.WriteSlsFile(buffer, outputFilePath)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("create: failed to write output file")
-		}
-	},
+		o.writeOutput(&s, buffer, outputFilePath, err)
+	}),
 }
 
 func init() {
 	rootCmd.AddCommand(createCmd)
-	createCmd.PersistentFlags().StringVarP(&outputFilePath, "outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
+	createCmd.PersistentFlags().StringP("outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
 	createCmd.PersistentFlags().StringArrayP("name", "n", nil, "secret name(s)")
 	createCmd.PersistentFlags().StringArrayP("value", "s", nil, "secret value(s)")
 }
@@ -27,8 +27,6 @@ import (
 
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -46,75 +44,79 @@ var decryptCmd = &cobra.Command{
 		}
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
+	Run: run(func(o *options, args []string) {
+		inputFilePath, outputFilePath, recurseDir := o.str("file"), o.str("outfile"), o.str("dir")
+
 		// Validate file paths for directory traversal attacks
 		if utils.ContainsDirectoryTraversal(outputFilePath) {
-			logger.Fatal().Msgf("decrypt: invalid output file path - directory traversal detected in %s", outputFilePath)
+			o.logger.Fatal().Msgf("decrypt: invalid output file path - directory traversal detected in %s", outputFilePath)
 		}
 		if utils.ContainsDirectoryTraversal(inputFilePath) {
-			logger.Fatal().Msgf("decrypt: invalid input file path - directory traversal detected in %s", inputFilePath)
+			o.logger.Fatal().Msgf("decrypt: invalid input file path - directory traversal detected in %s", inputFilePath)
 		}
 		if utils.ContainsDirectoryTraversal(recurseDir) {
-			logger.Fatal().Msgf("decrypt: invalid directory path - directory traversal detected in %s", recurseDir)
+			o.logger.Fatal().Msgf("decrypt: invalid directory path - directory traversal detected in %s", recurseDir)
 		}
 
-		pk := getPki()
 		outputFilePath, err := filepath.Abs(outputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("decrypt: failed to resolve absolute path for output file")
+			o.logger.Fatal().Err(err).Msg("decrypt: failed to resolve absolute path for output file")
 		}
-		inputFilePath, err := filepath.Abs(inputFilePath)
+		inputFilePath, err = filepath.Abs(inputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("decrypt: failed to resolve absolute path for input file")
+			o.logger.Fatal().Err(err).Msg("decrypt: failed to resolve absolute path for input file")
 		}
 
 		// process args
 		switch args[0] {
 		case all:
-			if inputFilePath == os.Stdin.Name() && !stdinIsPiped() {
-				logger.Info().Msgf("reading from %s", os.Stdin.Name())
-			}
-			s := sls.New(inputFilePath, *pk, topLevelElement)
-
-			// Check if the file contains include statements (not supported for decryption)
-			if s.IsInclude {
-				logger.Fatal().Msgf("decrypt: file %s contains include statements and cannot be processed", inputFilePath)
+			o.checkInputFile("decrypt", inputFilePath)
+			if inputFilePath == os.Stdin.Name() && !stdinIsPiped(&o.logger) {
+				o.logger.Info().Msgf("reading from %s", os.Stdin.Name())
 			}
+			s := o.readSls("decrypt", inputFilePath, o.pkiForFile(inputFilePath))
 
-			if inputFilePath != os.Stdin.Name() && updateInPlace {
+			if inputFilePath != os.Stdin.Name() && o.on("update") {
 				outputFilePath = inputFilePath
 			}
 			buffer, err := s.PerformAction("decrypt")
-			utils.SafeWrite(buffer, outputFilePath, err)
+			o.writeOutput(&s, buffer, outputFilePath, err)
 		case recurse:
-			err = utils.ProcessDir(recurseDir, ".sls", "decrypt", outputFilePath, topLevelElement, *pk)
+			opts := utils.DirOptions{
+				FileExt:         ".sls",
+				Action:          sls.Decrypt,
+				OutputFilePath:  outputFilePath,
+				TopLevelElement: o.element,
+				DryRun:          o.dryRun,
+				Jobs:            o.jobs,
+				Include:         o.include,
+				Exclude:         o.exclude,
+				Logger:          &o.logger,
+				AuditFor:        o.auditFor,
+			}
+			err = utils.ProcessDirWithKeys(recurseDir, opts, o.pkiForDir(recurseDir, ".sls"))
 			if err != nil {
-				logger.Warn().Err(err).Msg("decrypt")
+				o.logger.Warn().Err(err).Msg("decrypt")
 			}
 		case path:
-			s := sls.New(inputFilePath, *pk, topLevelElement)
+			o.checkInputFile("decrypt", inputFilePath)
+			s := o.readSls("decrypt", inputFilePath, o.pkiForFile(inputFilePath))
 
-			// Check if the file contains include statements (not supported for path operations)
-			if s.IsInclude {
-				logger.Fatal().Msgf("decrypt: file %s contains include statements and cannot be processed", inputFilePath)
-			}
-
-			utils.PathAction(&s, yamlPath, "decrypt")
+			o.pathAction("decrypt", &s, "decrypt")
 		default:
-			err = cmd.Help()
+			err = o.cmd.Help()
 			if err != nil {
-				logger.Fatal().Err(err).Msg("decrypt: failed to display help")
+				o.logger.Fatal().Err(err).Msg("decrypt: failed to display help")
 			}
 		}
-	},
+	}),
 }
 
 func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	rootCmd.AddCommand(decryptCmd)
-	decryptCmd.PersistentFlags().StringVarP(&yamlPath, "path", "p", "", "YAML path to decrypt")
-	decryptCmd.PersistentFlags().StringVarP(&recurseDir, "dir", "d", "", "recurse over all .sls files in the given directory")
-	decryptCmd.PersistentFlags().StringVarP(&inputFilePath, "file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
-	decryptCmd.PersistentFlags().StringVarP(&outputFilePath, "outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
-	decryptCmd.PersistentFlags().BoolVarP(&updateInPlace, "update", "u", false, "update the input file")
+	decryptCmd.PersistentFlags().StringP("path", "p", "", "YAML path to decrypt")
+	decryptCmd.PersistentFlags().StringP("dir", "d", "", "recurse over all .sls files in the given directory")
+	decryptCmd.PersistentFlags().StringP("file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
+	decryptCmd.PersistentFlags().StringP("outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
+	decryptCmd.PersistentFlags().BoolP("update", "u", false, "update the input file")
 }
@@ -27,8 +27,6 @@ import (
 
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -46,75 +44,85 @@ var encryptCmd = &cobra.Command{
 		}
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
+	Run: run(func(o *options, args []string) {
+		inputFilePath, outputFilePath, recurseDir := o.str("file"), o.str("outfile"), o.str("dir")
+
 		// Validate file paths for directory traversal attacks
 		if utils.ContainsDirectoryTraversal(outputFilePath) {
-			logger.Fatal().Msgf("encrypt: invalid output file path - directory traversal detected in %s", outputFilePath)
+			o.logger.Fatal().Msgf("encrypt: invalid output file path - directory traversal detected in %s", outputFilePath)
 		}
 		if utils.ContainsDirectoryTraversal(inputFilePath) {
-			logger.Fatal().Msgf("encrypt: invalid input file path - directory traversal detected in %s", inputFilePath)
+			o.logger.Fatal().Msgf("encrypt: invalid input file path - directory traversal detected in %s", inputFilePath)
 		}
 		if utils.ContainsDirectoryTraversal(recurseDir) {
-			logger.Fatal().Msgf("encrypt: invalid directory path - directory traversal detected in %s", recurseDir)
+			o.logger.Fatal().Msgf("encrypt: invalid directory path - directory traversal detected in %s", recurseDir)
 		}
 
-		pk := getPki()
 		outputFilePath, err := filepath.Abs(outputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("encrypt: failed to resolve absolute path for output file")
+			o.logger.Fatal().Err(err).Msg("encrypt: failed to resolve absolute path for output file")
 		}
-		inputFilePath, err := filepath.Abs(inputFilePath)
+		inputFilePath, err = filepath.Abs(inputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("encrypt: failed to resolve absolute path for input file")
+			o.logger.Fatal().Err(err).Msg("encrypt: failed to resolve absolute path for input file")
 		}
 
 		// process args
 		switch args[0] {
 		case all:
-			if inputFilePath == os.Stdin.Name() && !stdinIsPiped() {
-				logger.Info().Msgf("reading from %s", os.Stdin.Name())
+			o.checkInputFile("encrypt", inputFilePath)
+			if inputFilePath == os.Stdin.Name() && !stdinIsPiped(&o.logger) {
+				o.logger.Info().Msgf("reading from %s", os.Stdin.Name())
 			}
-			s := sls.New(inputFilePath, *pk, topLevelElement)
-
-			// Check if the file contains include statements (not supported for encryption)
-			if s.IsInclude {
-				logger.Fatal().Msgf("encrypt: file %s contains include statements and cannot be processed", inputFilePath)
+			if inputFilePath != os.Stdin.Name() && o.on("update") {
+				outputFilePath = inputFilePath
 			}
 
-			if inputFilePath != os.Stdin.Name() && updateInPlace {
-				outputFilePath = inputFilePath
+			// the keys follow the file being written, or the input file when writing to STDOUT
+			keysFile := outputFilePath
+			if keysFile == os.Stdout.Name() {
+				keysFile = inputFilePath
 			}
+			s := o.readSls("encrypt", inputFilePath, o.pkiForFile(keysFile))
+
 			buffer, err := s.PerformAction("encrypt")
-			utils.SafeWrite(buffer, outputFilePath, err)
+			o.writeOutput(&s, buffer, outputFilePath, err)
 		case recurse:
-			err := utils.ProcessDir(recurseDir, ".sls", "encrypt", outputFilePath, topLevelElement, *pk)
+			opts := utils.DirOptions{
+				FileExt:         ".sls",
+				Action:          sls.Encrypt,
+				OutputFilePath:  outputFilePath,
+				TopLevelElement: o.element,
+				DryRun:          o.dryRun,
+				Jobs:            o.jobs,
+				Include:         o.include,
+				Exclude:         o.exclude,
+				Logger:          &o.logger,
+				AuditFor:        o.auditFor,
+			}
+			err := utils.ProcessDirWithKeys(recurseDir, opts, o.pkiForDir(recurseDir, ".sls"))
 			if err != nil {
-				logger.Warn().Err(err).Msg("encrypt")
+				o.logger.Warn().Err(err).Msg("encrypt")
 			}
 		case path:
-			s := sls.New(inputFilePath, *pk, topLevelElement)
-
-			// Check if the file contains include statements (not supported for path operations)
-			if s.IsInclude {
-				logger.Fatal().Msgf("encrypt: file %s contains include statements and cannot be processed", inputFilePath)
-			}
+			o.checkInputFile("encrypt", inputFilePath)
+			s := o.readSls("encrypt", inputFilePath, o.pkiForFile(inputFilePath))
 
-			utils.PathAction(&s, yamlPath, "encrypt")
+			o.pathAction("encrypt", &s, "encrypt")
 		default:
-			err = cmd.Help()
+			err = o.cmd.Help()
 			if err != nil {
-				logger.Fatal().Err(err).Msg("encrypt: failed to display help")
+				o.logger.Fatal().Err(err).Msg("encrypt: failed to display help")
 			}
 		}
-	},
+	}),
 }
 
 func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	rootCmd.AddCommand(encryptCmd)
-	encryptCmd.PersistentFlags().StringVarP(&yamlPath, "path", "p", "", "YAML path to encrypt")
-	encryptCmd.PersistentFlags().StringVarP(&recurseDir, "dir", "d", "", "recurse over all .sls files in the given directory")
-	encryptCmd.PersistentFlags().StringVarP(&inputFilePath, "file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
-	encryptCmd.PersistentFlags().StringVarP(&outputFilePath, "outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
-	encryptCmd.PersistentFlags().BoolVarP(&updateInPlace, "update", "u", false, "update the input file")
+	encryptCmd.PersistentFlags().StringP("path", "p", "", "YAML path to encrypt")
+	encryptCmd.PersistentFlags().StringP("dir", "d", "", "recurse over all .sls files in the given directory")
+	encryptCmd.PersistentFlags().StringP("file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
+	encryptCmd.PersistentFlags().StringP("outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
+	encryptCmd.PersistentFlags().BoolP("update", "u", false, "update the input file")
 }
@@ -0,0 +1,174 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/keygen creates salt master keys
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Everbridge/generate-secure-pillar/config"
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+	"github.com/spf13/cobra"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// keysGenerateCmd represents the keys generate command
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "create a salt master key",
+	Long: `Create a key pair for a salt master, with no passphrase so the master can use it unattended.
+
+The key is written to --out-dir as pubring.gpg and secring.gpg, the layout the salt gpg
+renderer expects in /etc/salt/gpgkeys, along with an ASCII armored public key to hand
+out to developers. The RSA key size comes from the profile crypto section, 4096 bits by
+default. With --add-profile a profile using the key is added to the config file.`,
+	Run: run(func(o *options, args []string) {
+		keyGenName, keyGenOutDir, keyGenProfile := o.str("name"), o.str("out-dir"), o.str("add-profile")
+
+		if keyGenName == "" {
+			o.logger.Fatal().Msg("keys generate: a key name is required")
+		}
+		if utils.ContainsDirectoryTraversal(keyGenOutDir) {
+			o.logger.Fatal().Msgf("keys generate: invalid output directory - directory traversal detected in %s", keyGenOutDir)
+		}
+		outDir, err := filepath.Abs(keyGenOutDir)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys generate: failed to resolve absolute path for output directory")
+		}
+
+		packetConfig, err := o.keys.crypto.Config()
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys generate: invalid crypto settings")
+		}
+		entity, err := pki.GenerateKey(keyGenName, o.str("comment"), o.str("email"), packetConfig)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys generate")
+		}
+		files, err := pki.WriteKeyFiles(entity, outDir)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys generate")
+		}
+
+		fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+		fmt.Printf("fingerprint: %s\n", fingerprint)
+		fmt.Printf("public key ring: %s\n", files.PublicKeyRing)
+		fmt.Printf("secret key ring: %s\n", files.SecretKeyRing)
+		fmt.Printf("armored public key: %s\n", files.ArmoredPublicKey)
+
+		if keyGenProfile != "" {
+			configFile := o.configFile
+			err = addProfile(configFile, config.Profile{
+				Name:           keyGenProfile,
+				DefaultKey:     keyGenName,
+				KeyFingerprint: fingerprint,
+				GnupgHome:      outDir,
+			})
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("keys generate: failed to add profile")
+			}
+			fmt.Printf("profile '%s' added to %s\n", keyGenProfile, configFile)
+		}
+	}),
+}
+
+func init() {
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysGenerateCmd.Flags().String("name", "", "name of the key, such as \"Stage Salt Master\"")
+	keysGenerateCmd.Flags().String("email", "", "email address of the key")
+	keysGenerateCmd.Flags().String("comment", "", "comment of the key")
+	keysGenerateCmd.Flags().String("out-dir", "/etc/salt/gpgkeys", "directory to write the key rings and armored public key to")
+	keysGenerateCmd.Flags().String("add-profile", "", "add a profile with this name using the key to the config file")
+}
+
+// addProfile appends a profile to the config file, keeping the rest of the file as it is
+func addProfile(configFile string, profile config.Profile) error {
+	if configFile == "" {
+		return fmt.Errorf("no config file in use")
+	}
+	info, err := os.Stat(configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist, create it with config init", configFile)
+	}
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(filepath.Clean(configFile))
+	if err != nil {
+		return err
+	}
+
+	var doc yamlv3.Node
+	if err = yamlv3.Unmarshal(buf, &doc); err != nil {
+		return fmt.Errorf("cannot parse %s: %w", configFile, err)
+	}
+	if doc.Kind == 0 {
+		doc.Kind = yamlv3.DocumentNode
+		doc.Content = []*yamlv3.Node{{Kind: yamlv3.MappingNode}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yamlv3.MappingNode {
+		return fmt.Errorf("%s is not a YAML mapping", configFile)
+	}
+
+	var profiles *yamlv3.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "profiles" {
+			continue
+		}
+		// an empty profiles key is replaced by a list
+		if root.Content[i+1].Kind != yamlv3.SequenceNode {
+			root.Content[i+1] = &yamlv3.Node{Kind: yamlv3.SequenceNode}
+		}
+		profiles = root.Content[i+1]
+	}
+	if profiles == nil {
+		profiles = &yamlv3.Node{Kind: yamlv3.SequenceNode}
+		root.Content = append(root.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Value: "profiles"}, profiles)
+	}
+	for _, existing := range profiles.Content {
+		var entry config.Profile
+		if existing.Decode(&entry) == nil && entry.Name == profile.Name {
+			return fmt.Errorf("profile '%s' already exists", profile.Name)
+		}
+	}
+
+	var entry yamlv3.Node
+	if err = entry.Encode(profile); err != nil {
+		return err
+	}
+	profiles.Content = append(profiles.Content, &entry)
+
+	var out bytes.Buffer
+	enc := yamlv3.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err = enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err = enc.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(configFile, out.Bytes(), info.Mode().Perm())
+}
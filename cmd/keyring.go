@@ -0,0 +1,220 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/keyring manages the keys in the key rings
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// keysListCmd represents the keys list command
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the keys in the key rings",
+	Args:  cobra.NoArgs,
+	Run: run(func(o *options, args []string) {
+		pubRing, secRing := o.openKeyRings()
+		keys := pki.ListKeys(pubRing, secRing)
+
+		var err error
+		switch o.output {
+		case "text":
+			for _, key := range keys {
+				kind := "pub"
+				if key.Secret {
+					kind = "sec"
+				}
+				line := fmt.Sprintf("%s  %s  %s  %s  %s", kind, key.Fingerprint, key.Algorithm, key.Created[:10], strings.Join(key.UserIDs, ", "))
+				if key.Problem != "" {
+					line += fmt.Sprintf("  [%s]", key.Problem)
+				}
+				fmt.Println(line)
+			}
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(keys)
+		case "yaml":
+			enc := yamlv3.NewEncoder(os.Stdout)
+			enc.SetIndent(2)
+			if err = enc.Encode(keys); err == nil {
+				err = enc.Close()
+			}
+		default:
+			o.logger.Fatal().Msgf("keys list: unknown output format '%s', use text, json or yaml", o.output)
+		}
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys list: failed to write keys")
+		}
+	}),
+}
+
+// keysImportCmd represents the keys import command
+var keysImportCmd = &cobra.Command{
+	Use:   "import FILE...",
+	Short: "import binary or ASCII armored keys into the key rings",
+	Long: `Import binary or ASCII armored keys into the key rings, use - to read from STDIN.
+
+Public keys go to the public key ring, secret keys to both rings. A key already in a
+ring is replaced by the imported copy.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: run(func(o *options, args []string) {
+		pubRing, secRing := o.openKeyRings()
+
+		for _, file := range args {
+			var data []byte
+			var err error
+			if file == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(filepath.Clean(file))
+			}
+			if err != nil {
+				o.logger.Fatal().Err(err).Msgf("keys import: cannot read %s", file)
+			}
+
+			imported, err := pki.ImportKeys(data, pubRing, secRing)
+			if err != nil {
+				o.logger.Fatal().Err(err).Msgf("keys import: cannot import %s", file)
+			}
+			for _, entity := range imported {
+				kind := "public"
+				if entity.PrivateKey != nil {
+					kind = "secret"
+				}
+				fmt.Printf("imported %s key %X\n", kind, entity.PrimaryKey.Fingerprint)
+			}
+		}
+
+		o.saveKeyRings(pubRing, secRing)
+	}),
+}
+
+// keysExportCmd represents the keys export command
+var keysExportCmd = &cobra.Command{
+	Use:   "export KEY",
+	Short: "print a key ASCII armored",
+	Long: `Print the public key matching a key name, email, fingerprint or key ID ASCII armored,
+or with --secret the secret key from the secret key ring.`,
+	Args: cobra.ExactArgs(1),
+	Run: run(func(o *options, args []string) {
+		pubRing, secRing := o.openKeyRings()
+
+		ring := pubRing
+		if o.on("secret") {
+			ring = secRing
+		}
+		entity, err := ring.Find(args[0])
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys export")
+		}
+		if entity == nil {
+			o.logger.Fatal().Msgf("keys export: key '%s' is not in '%s'", args[0], ring.Path)
+		}
+
+		armored, err := ring.Export(entity.PrimaryKey.Fingerprint, o.on("secret"))
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys export")
+		}
+		fmt.Print(string(armored))
+	}),
+}
+
+// keysRemoveCmd represents the keys remove command
+var keysRemoveCmd = &cobra.Command{
+	Use:   "remove KEY",
+	Short: "remove a key from the key rings",
+	Long: `Remove the key matching a key name, email, fingerprint or key ID from the public key ring.
+
+A key whose secret key is in the secret key ring is only removed with --secret, which
+removes the secret key as well.`,
+	Args: cobra.ExactArgs(1),
+	Run: run(func(o *options, args []string) {
+		pubRing, secRing := o.openKeyRings()
+
+		entity, err := pubRing.Find(args[0])
+		if err == nil && entity == nil {
+			entity, err = secRing.Find(args[0])
+		}
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys remove")
+		}
+		if entity == nil {
+			o.logger.Fatal().Msgf("keys remove: key '%s' is not in the key rings", args[0])
+		}
+
+		fingerprint := entity.PrimaryKey.Fingerprint
+		if secret, _ := secRing.Find(fmt.Sprintf("%X", fingerprint)); secret != nil {
+			if !o.on("secret") {
+				o.logger.Fatal().Msgf("keys remove: key %X has a secret key, use --secret to remove it too", fingerprint)
+			}
+			secRing.Remove(fingerprint)
+		}
+		pubRing.Remove(fingerprint)
+
+		o.saveKeyRings(pubRing, secRing)
+		fmt.Printf("removed key %X\n", fingerprint)
+	}),
+}
+
+func init() {
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysImportCmd)
+	keysCmd.AddCommand(keysExportCmd)
+	keysCmd.AddCommand(keysRemoveCmd)
+	keysExportCmd.Flags().Bool("secret", false, "export the secret key")
+	keysRemoveCmd.Flags().Bool("secret", false, "remove the secret key as well")
+}
+
+// openKeyRings opens the public and secret key rings of the current profile for management
+func (o *options) openKeyRings() (*pki.KeyRing, *pki.KeyRing) {
+	var rings []*pki.KeyRing
+	for _, path := range []string{o.keys.publicKeyRing, o.keys.privateKeyRing} {
+		expanded, err := homedir.Expand(path)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msgf("keys: cannot expand key ring path %s", path)
+		}
+		ring, err := pki.OpenKeyRing(expanded)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("keys")
+		}
+		rings = append(rings, ring)
+	}
+	return rings[0], rings[1]
+}
+
+func (o *options) saveKeyRings(rings ...*pki.KeyRing) {
+	for _, ring := range rings {
+		if err := ring.Save(); err != nil {
+			o.logger.Fatal().Err(err).Msg("keys")
+		}
+	}
+}
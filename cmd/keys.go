@@ -22,25 +22,28 @@
 package cmd
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/Everbridge/generate-secure-pillar/pki"
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 const count = "count"
 
-var verbose bool
-
 // keysCmd represents the keys command
 var keysCmd = &cobra.Command{
 	Use:   "keys",
-	Short: "show PGP key IDs used",
+	Short: "show PGP key IDs used and manage the key rings",
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			err := cmd.Help()
@@ -51,83 +54,204 @@ var keysCmd = &cobra.Command{
 		}
 		return nil
 	},
-	Run: func(cmd *cobra.Command, args []string) {
+	Run: run(func(o *options, args []string) {
+		inputFilePath, recurseDir := o.str("file"), o.str("dir")
+
 		// Validate file paths for directory traversal attacks
 		if utils.ContainsDirectoryTraversal(inputFilePath) {
-			logger.Fatal().Msgf("keys: invalid input file path - directory traversal detected in %s", inputFilePath)
+			o.logger.Fatal().Msgf("keys: invalid input file path - directory traversal detected in %s", inputFilePath)
 		}
 		if utils.ContainsDirectoryTraversal(recurseDir) {
-			logger.Fatal().Msgf("keys: invalid directory path - directory traversal detected in %s", recurseDir)
+			o.logger.Fatal().Msgf("keys: invalid directory path - directory traversal detected in %s", recurseDir)
 		}
 
-		pk := getPki()
-		outputFilePath = os.Stdout.Name()
+		// only the key rings are needed to name the keys values were encrypted to
+		k := o.keys
+		k.keyOptional = true
+		pk := o.newPki(k)
 		inputFilePath, err := filepath.Abs(inputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("keys: failed to resolve absolute path for input file")
+			o.logger.Fatal().Err(err).Msg("keys: failed to resolve absolute path for input file")
+		}
+
+		if o.output != "text" {
+			o.writeKeyReports(args[0], inputFilePath, recurseDir, pk)
+			return
 		}
 
 		// process args
 		switch args[0] {
 		case all:
-			if inputFilePath == os.Stdin.Name() && !stdinIsPiped() {
-				logger.Info().Msgf("reading from %s", os.Stdin.Name())
-			}
-			s := sls.New(inputFilePath, *pk, topLevelElement)
-
-			// Check if the file contains include statements (not supported for key operations)
-			if s.IsInclude {
-				logger.Fatal().Msgf("keys: file %s contains include statements and cannot be processed", inputFilePath)
+			o.checkInputFile("keys", inputFilePath)
+			if inputFilePath == os.Stdin.Name() && !stdinIsPiped(&o.logger) {
+				o.logger.Info().Msgf("reading from %s", os.Stdin.Name())
 			}
+			s := o.readSls("keys", inputFilePath, pk)
 
 			buffer, err := s.PerformAction("validate")
 			if err != nil {
-				logger.Fatal().Err(err).Msg("keys: failed to validate PGP keys")
+				o.logger.Fatal().Err(err).Msg("keys: failed to validate PGP keys")
+			}
+			if o.on("by-path") {
+				for _, row := range s.KeysByPath() {
+					fmt.Println(row)
+				}
+				return
 			}
 			fmt.Printf("%s\n", buffer.String())
 		case recurse:
-			err := utils.ProcessDir(recurseDir, ".sls", "validate", outputFilePath, topLevelElement, *pk)
+			opts := utils.DirOptions{
+				FileExt:         ".sls",
+				Action:          sls.Validate,
+				OutputFilePath:  os.Stdout.Name(),
+				TopLevelElement: o.element,
+				Jobs:            o.jobs,
+				Include:         o.include,
+				Exclude:         o.exclude,
+				Logger:          &o.logger,
+			}
+			err := utils.ProcessDirWithOptions(recurseDir, opts, *pk)
 			if err != nil {
-				logger.Warn().Err(err).Msg("keys")
+				o.logger.Warn().Err(err).Msg("keys")
 			}
 		case path:
-			s := sls.New(inputFilePath, *pk, topLevelElement)
-
-			// Check if the file contains include statements (not supported for path operations)
-			if s.IsInclude {
-				logger.Fatal().Msgf("keys: file %s contains include statements and cannot be processed", inputFilePath)
-			}
+			o.checkInputFile("keys", inputFilePath)
+			s := o.readSls("keys", inputFilePath, pk)
 
-			utils.PathAction(&s, yamlPath, "validate")
+			o.pathAction("keys", &s, sls.Validate)
 		case count:
-			s := sls.New(inputFilePath, *pk, topLevelElement)
-
-			// Check if the file contains include statements (not supported for count operations)
-			if s.IsInclude {
-				logger.Fatal().Msgf("keys: file %s contains include statements and cannot be processed", inputFilePath)
-			}
+			o.checkInputFile("keys", inputFilePath)
+			s := o.readSls("keys", inputFilePath, pk)
 
 			_, err = s.PerformAction("validate")
 			if err != nil {
-				logger.Fatal().Err(err).Msg("keys: failed to validate PGP keys for count")
+				o.logger.Fatal().Err(err).Msg("keys: failed to validate PGP keys for count")
 			}
-			if verbose {
+			if o.on("verbose") {
 				fmt.Println(s.KeyMeta)
 			}
 			if s.KeyCount > 1 {
 				os.Exit(s.KeyCount)
 			}
 		default:
-			logger.Fatal().Msgf("unknown argument: '%s'", args[0])
+			o.logger.Fatal().Msgf("unknown argument: '%s'", args[0])
 		}
-	},
+	}),
 }
 
 func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	rootCmd.AddCommand(keysCmd)
-	keysCmd.PersistentFlags().StringVarP(&yamlPath, "path", "p", "", "YAML path to examine")
-	keysCmd.PersistentFlags().StringVarP(&recurseDir, "dir", "d", "", "recurse over all .sls files in the given directory")
-	keysCmd.PersistentFlags().StringVarP(&inputFilePath, "file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
-	keysCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	keysCmd.PersistentFlags().StringP("path", "p", "", "YAML path to examine")
+	keysCmd.PersistentFlags().StringP("dir", "d", "", "recurse over all .sls files in the given directory")
+	keysCmd.PersistentFlags().StringP("file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
+	keysCmd.PersistentFlags().BoolP("verbose", "v", false, "verbose output")
+	keysCmd.PersistentFlags().Bool("by-path", false, "list one row per encrypted value with its YAML path and key")
+	keysCmd.PersistentFlags().String("output", "text", "output format: text, json, yaml or csv")
+}
+
+// writeKeyReports prints the keys used per file and per path in a machine readable format
+func (o *options) writeKeyReports(mode string, inputFilePath string, recurseDir string, pk *pki.Pki) {
+	var files []string
+	switch mode {
+	case all, path, count:
+		o.checkInputFile("keys", inputFilePath)
+		files = append(files, inputFilePath)
+	case recurse:
+		files = o.findFiles(recurseDir)
+	default:
+		o.logger.Fatal().Msgf("unknown argument: '%s'", mode)
+	}
+
+	reports := []sls.KeyReport{}
+	keyCount := 0
+	for _, file := range files {
+		s, err := o.newSls(file, pk)
+		if errors.Is(err, sls.ErrIncludeDirective) {
+			if mode == recurse {
+				o.logger.Warn().Msgf("keys: skipping %s, it contains include directives", file)
+				continue
+			}
+			o.logger.Fatal().Msgf("keys: file %s contains include statements and cannot be processed", file)
+		}
+		if err != nil {
+			o.logger.Fatal().Err(err).Msgf("keys: cannot read %s", file)
+		}
+
+		report := s.KeyReport()
+		if mode == path {
+			report = filterKeyReport(report, o.str("path"))
+		}
+		keyCount = len(report.Keys)
+		reports = append(reports, report)
+	}
+
+	if err := writeKeyReportFormat(os.Stdout, reports, o.output); err != nil {
+		o.logger.Fatal().Err(err).Msg("keys: failed to write key report")
+	}
+
+	if mode == count && keyCount > 1 {
+		os.Exit(keyCount)
+	}
+}
+
+// filterKeyReport keeps only the values at or below the given YAML path
+func filterKeyReport(report sls.KeyReport, yamlPath string) sls.KeyReport {
+	filtered := sls.KeyReport{File: report.File, Keys: []pki.KeyInfo{}, Paths: []sls.PathKeys{}}
+	seen := map[string]bool{}
+	for _, pathKeys := range report.Paths {
+		if pathKeys.Path != yamlPath && !strings.HasPrefix(pathKeys.Path, yamlPath+":") {
+			continue
+		}
+		filtered.Paths = append(filtered.Paths, pathKeys)
+		for _, key := range pathKeys.Keys {
+			if !seen[key.KeyID] {
+				seen[key.KeyID] = true
+				filtered.Keys = append(filtered.Keys, key)
+			}
+		}
+	}
+	return filtered
+}
+
+func writeKeyReportFormat(w io.Writer, reports []sls.KeyReport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	case "yaml":
+		enc := yamlv3.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(reports); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "csv":
+		out := csv.NewWriter(w)
+		err := out.Write([]string{"file", "path", "key_id", "primary_key_id", "fingerprint", "user_ids", "algorithm", "created", "error"})
+		if err != nil {
+			return err
+		}
+		for _, report := range reports {
+			for _, pathKeys := range report.Paths {
+				if len(pathKeys.Keys) == 0 {
+					err = out.Write([]string{report.File, pathKeys.Path, "", "", "", "", "", "", pathKeys.Error})
+				}
+				for _, key := range pathKeys.Keys {
+					err = out.Write([]string{report.File, pathKeys.Path, key.KeyID, key.PrimaryKeyID, key.Fingerprint,
+						strings.Join(key.UserIDs, ";"), key.Algorithm, key.Created, pathKeys.Error})
+					if err != nil {
+						break
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		out.Flush()
+		return out.Error()
+	default:
+		return fmt.Errorf("unknown output format '%s', use text, json, yaml or csv", format)
+	}
 }
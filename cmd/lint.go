@@ -0,0 +1,113 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/lint finds plain text secrets left in pillar files
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/lint"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+	"github.com/spf13/cobra"
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "find plain text secrets left in pillar files",
+	Long: `Find values that look like secrets but are not encrypted, and files that
+contain encrypted values but lack the #!yaml|gpg renderer line.
+
+Output is text, json or sarif. Exits with 0 when nothing is found, 2 when
+findings are reported and 1 on any other error.`,
+	Run: run(func(o *options, args []string) {
+		lintFile, recurseDir, lintFormat := o.str("file"), o.str("dir"), o.str("format")
+
+		// Validate file paths for directory traversal attacks
+		if utils.ContainsDirectoryTraversal(lintFile) {
+			o.logger.Fatal().Msgf("lint: invalid input file path - directory traversal detected in %s", lintFile)
+		}
+		if utils.ContainsDirectoryTraversal(recurseDir) {
+			o.logger.Fatal().Msgf("lint: invalid directory path - directory traversal detected in %s", recurseDir)
+		}
+
+		var findings []lint.Finding
+		var err, readErr error
+		if recurseDir != "" {
+			findings, readErr = lint.Files(o.findFiles(recurseDir))
+			if readErr != nil {
+				o.logger.Error().Err(readErr).Msg("lint: some files could not be checked")
+			}
+		} else if lintFile != "" {
+			findings, err = lint.File(lintFile)
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("lint: cannot check input file")
+			}
+		} else {
+			err = o.cmd.Help()
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("lint: failed to display help")
+			}
+			return
+		}
+
+		// report paths relative to the working directory so results line up with the repository
+		if cwd, err := os.Getwd(); err == nil {
+			for i := range findings {
+				rel, err := filepath.Rel(cwd, findings[i].File)
+				if err == nil && !strings.HasPrefix(rel, "..") {
+					findings[i].File = rel
+				}
+			}
+		}
+
+		switch lintFormat {
+		case "text":
+			err = lint.WriteText(os.Stdout, findings)
+		case "json":
+			err = lint.WriteJSON(os.Stdout, findings)
+		case "sarif":
+			err = lint.WriteSARIF(os.Stdout, findings, rootCmd.Version)
+		default:
+			o.logger.Fatal().Msgf("lint: unknown format %s, use text, json or sarif", lintFormat)
+		}
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("lint: failed to write findings")
+		}
+
+		// a clean result is not trusted when some files were never checked
+		if readErr != nil {
+			os.Exit(1)
+		}
+		if len(findings) > 0 {
+			os.Exit(problemsFound)
+		}
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+	lintCmd.PersistentFlags().StringP("dir", "d", "", "recurse over all .sls files in the given directory")
+	lintCmd.PersistentFlags().StringP("file", "f", "", "input file")
+	lintCmd.PersistentFlags().String("format", "text", "output format: text, json or sarif")
+}
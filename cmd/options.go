@@ -0,0 +1,234 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/options builds the options of each run of a command
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/config"
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// options are the settings of one run of a command, from its flags, their environment
+// variables, the selected profile and the repository config file in that order. They are
+// built when the command runs and passed to everything it calls.
+type options struct {
+	cmd     *cobra.Command
+	logger  zerolog.Logger
+	started time.Time
+
+	// the user config file, a missing or bad config file only stops the commands that need keys
+	configFile   string
+	userConfig   *config.Config
+	configErr    error
+	repoDefaults config.Defaults
+
+	// keys are the key options from the flags and the profile, flagKeys from the flags alone
+	keys     keyOptions
+	flagKeys keyOptions
+	// encrypting commands refuse an invalid key without --allow-invalid-key, the others only
+	// warn so that an expired key can still read what it encrypted
+	encrypting bool
+
+	element   string
+	jobs      int
+	include   []string
+	exclude   []string
+	dryRun    bool
+	logFormat string
+	logLevel  string
+	output    string
+
+	// the audit logs opened and the one used with each set of keys
+	auditLogs map[string]*audit.Log
+	keyAudit  map[*pki.Pki]*audit.Log
+}
+
+// keyOptions select and check the keys values are encrypted to and decrypted with
+type keyOptions struct {
+	pgpKeyName        string
+	keyFingerprint    string
+	recipientFile     string
+	publicKeyRing     string
+	privateKeyRing    string
+	recipients        []string
+	backend           string
+	crypto            pki.CryptoOptions
+	expiryWarningDays int
+	allowInvalidKey   bool
+	signingKey        string
+	signaturePolicy   string
+	trustedSigners    []string
+	auditLog          string
+	// keyOptional commands only read which keys values were encrypted to, so they need no key
+	keyOptional bool
+}
+
+// encryptingCommands write encrypted values, they refuse an invalid key without --allow-invalid-key
+var encryptingCommands = map[string]bool{"encrypt": true, "rotate": true, "update": true, "create": true}
+
+// run builds the options of a command and passes them to it, closing the audit logs once it is done
+func run(fn func(o *options, args []string)) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		o := newOptions(cmd)
+		fn(o, args)
+		o.close()
+	}
+}
+
+// newOptions reads the flags and environment variables of a command, the config file and
+// the repository config file above the working directory, then applies the profile
+func newOptions(cmd *cobra.Command) *options {
+	o := &options{
+		cmd:        cmd,
+		logger:     initLogger(),
+		started:    time.Now(),
+		encrypting: encryptingCommands[cmd.Name()],
+		auditLogs:  map[string]*audit.Log{},
+		keyAudit:   map[*pki.Pki]*audit.Log{},
+	}
+	if err := readEnv(cmd.Root().PersistentFlags()); err != nil {
+		o.logger.Fatal().Err(err).Msg("invalid environment variable")
+	}
+	o.readFlags()
+	o.setLogger()
+
+	if cfgFile := o.str("config"); cfgFile != "" {
+		// Validate config file path for directory traversal
+		if utils.ContainsDirectoryTraversal(cfgFile) {
+			o.logger.Fatal().Msgf("Invalid config file path: directory traversal detected in %s", cfgFile)
+		}
+		o.configFile = cfgFile
+	} else {
+		// Find home directory.
+		home, err := homedir.Dir()
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("Failed to determine home directory")
+		}
+
+		// use "~/.config/generate-secure-pillar/config.yaml", config init creates it
+		o.configFile = filepath.Join(home, ".config", "generate-secure-pillar", "config.yaml")
+	}
+
+	// reading never creates the config file, a missing default config file has no profiles.
+	// A missing or bad config file only stops the commands that need keys, so config init
+	// and config validate can deal with it.
+	if _, err := os.Stat(o.configFile); o.str("config") == "" && errors.Is(err, os.ErrNotExist) {
+		o.userConfig = &config.Config{File: o.configFile}
+	} else {
+		o.userConfig, o.configErr = config.LoadConfig(o.configFile)
+	}
+	if o.userConfig != nil {
+		o.configErr = errors.Join(o.configErr, o.userConfig.Validate())
+	}
+	if wd, err := os.Getwd(); err == nil {
+		repo, err := config.FindRepo(wd)
+		if err != nil {
+			o.configErr = errors.Join(o.configErr, err)
+		} else if repo != nil {
+			o.repoDefaults = repo.Defaults
+		}
+	}
+	if o.configErr == nil {
+		o.configErr = o.readProfile()
+	}
+	// the profile may set the logging options
+	o.setLogger()
+	return o
+}
+
+// readFlags sets the options from the flags of the command
+func (o *options) readFlags() {
+	o.keys = keyOptions{
+		pgpKeyName:        o.str("pgp_key"),
+		keyFingerprint:    o.str("key-fingerprint"),
+		recipientFile:     o.str("recipient-file"),
+		publicKeyRing:     o.str("pubring"),
+		privateKeyRing:    o.str("secring"),
+		recipients:        o.list("recipient"),
+		backend:           o.str("backend"),
+		expiryWarningDays: pki.DefaultExpiryWarningDays,
+		allowInvalidKey:   o.on("allow-invalid-key"),
+		signingKey:        o.str("sign-with"),
+		signaturePolicy:   o.str("signatures"),
+		trustedSigners:    o.list("trusted-signer"),
+		auditLog:          o.str("audit-log"),
+	}
+	o.flagKeys = o.keys
+	o.element = o.str("element")
+	o.jobs, _ = o.cmd.Flags().GetInt("jobs")
+	o.include = o.list("include")
+	o.exclude = o.list("exclude")
+	o.dryRun = o.on("dry-run")
+	o.logFormat = o.str("log-format")
+	o.logLevel = o.str("log-level")
+	o.output = o.str("output")
+}
+
+// setLogger builds the logger from the logging options
+func (o *options) setLogger() {
+	var err error
+	if o.logger, err = newLogger(o.logFormat, o.logLevel); err != nil {
+		o.logger.Fatal().Err(err).Msg("invalid logging options")
+	}
+}
+
+// close closes the audit logs opened by the command
+func (o *options) close() {
+	for _, l := range o.auditLogs {
+		if err := l.Close(); err != nil {
+			o.logger.Warn().Err(err).Msg("failed to close the audit log")
+		}
+	}
+	o.logger.Debug().Str("action", o.cmd.Name()).Dur("duration", time.Since(o.started)).Msg("done")
+}
+
+// str returns the value of a flag of the command, empty when the command has no such flag
+func (o *options) str(name string) string {
+	value, _ := o.cmd.Flags().GetString(name)
+	return value
+}
+
+// on returns the value of a boolean flag of the command, false when the command has no such flag
+func (o *options) on(name string) bool {
+	value, _ := o.cmd.Flags().GetBool(name)
+	return value
+}
+
+// list returns the values of a list flag of the command, nil when the command has no such flag
+func (o *options) list(name string) []string {
+	value, _ := o.cmd.Flags().GetStringSlice(name)
+	return value
+}
+
+// changed reports whether an option was given as a flag or environment variable
+func (o *options) changed(name string) bool {
+	return o.cmd.Flags().Changed(name)
+}
@@ -0,0 +1,182 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/repo picks the keys for pillar files from repository config files
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Everbridge/generate-secure-pillar/config"
+	"github.com/Everbridge/generate-secure-pillar/glob"
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+)
+
+// repoKeys picks the keys for pillar files. A file matching a rule of the repository
+// config file above it must use the keys of the rule's profile, other files use the
+// keys from the command line and the selected profile.
+type repoKeys struct {
+	repos    map[string]*config.Repo
+	profiles map[string]*pki.Pki
+	files    map[string]*pki.Pki
+	fallback *pki.Pki
+	o        *options
+}
+
+func (o *options) newRepoKeys() *repoKeys {
+	return &repoKeys{
+		o:        o,
+		repos:    map[string]*config.Repo{},
+		profiles: map[string]*pki.Pki{},
+		files:    map[string]*pki.Pki{},
+	}
+}
+
+// pkiForFile returns the keys for a file, STDIN and STDOUT use the keys from the command line
+func (o *options) pkiForFile(file string) *pki.Pki {
+	p, err := o.newRepoKeys().forFile(file)
+	if err != nil {
+		o.logger.Fatal().Err(err).Msg("failed to select keys")
+	}
+	return p
+}
+
+// pkiForDir picks the keys for every file in a directory up front, so a file whose rule
+// cannot be followed stops the command before anything is written
+func (o *options) pkiForDir(dir string, fileExt string) func(file string) (*pki.Pki, error) {
+	keys := o.newRepoKeys()
+	// a directory that cannot be listed is reported when the action is applied to it
+	files, _, _ := utils.FindFilesByExt(dir, fileExt)
+	files = glob.Filter(dir, files, o.include, o.exclude)
+	for _, file := range files {
+		if _, err := keys.forFile(file); err != nil {
+			o.logger.Fatal().Err(err).Msg("failed to select keys")
+		}
+	}
+
+	return func(file string) (*pki.Pki, error) {
+		if p, ok := keys.files[file]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf("no keys selected for %s", file)
+	}
+}
+
+func (r *repoKeys) forFile(file string) (*pki.Pki, error) {
+	if p, ok := r.files[file]; ok {
+		return p, nil
+	}
+
+	var repo *config.Repo
+	profile := ""
+	if file != "" && file != os.Stdin.Name() && file != os.Stdout.Name() {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Dir(abs)
+		var ok bool
+		if repo, ok = r.repos[dir]; !ok {
+			if repo, err = config.FindRepo(dir); err != nil {
+				return nil, err
+			}
+			r.repos[dir] = repo
+		}
+		if repo != nil {
+			profile, _ = repo.ProfileFor(abs)
+		}
+	}
+
+	if profile == "" {
+		if r.fallback == nil {
+			r.fallback = r.o.newPki(r.o.keys)
+		}
+		r.files[file] = r.fallback
+		return r.fallback, nil
+	}
+
+	if name := r.o.str("profile"); r.o.changed("profile") && name != profile {
+		return nil, fmt.Errorf("%s must use profile '%s' from %s, not '%s'", file, profile, repo.File, name)
+	}
+	if r.o.changed("recipient-file") {
+		return nil, fmt.Errorf("%s must use the keys of profile '%s' from %s, not a recipient file", file, profile, repo.File)
+	}
+	if r.o.changed("recipient") {
+		return nil, fmt.Errorf("%s must use the recipients of profile '%s' from %s, not --recipient", file, profile, repo.File)
+	}
+	p, ok := r.profiles[profile]
+	if !ok {
+		var err error
+		if p, err = r.o.profilePki(profile); err != nil {
+			return nil, fmt.Errorf("%s: %w", repo.File, err)
+		}
+		r.profiles[profile] = p
+	}
+
+	// a key named on the command line must be the profile's key
+	for _, name := range r.o.explicitKeys() {
+		entity, err := p.FindKey(p.PubRing, name)
+		if err != nil || entity == nil || entity.PrimaryKey.Fingerprint != p.PublicKey.PrimaryKey.Fingerprint {
+			return nil, fmt.Errorf("%s must use the key of profile '%s' from %s, not '%s'", file, profile, repo.File, name)
+		}
+	}
+
+	r.files[file] = p
+	return p, nil
+}
+
+// profilePki loads the keys of a profile over the flags, ignoring the key selection and recipient flags
+func (o *options) profilePki(name string) (*pki.Pki, error) {
+	if o.configErr != nil {
+		return nil, o.configErr
+	}
+	prof, err := o.userConfig.Profile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	k := o.flagKeys
+	o.applyProfile(&k, prof)
+	k.pgpKeyName, k.keyFingerprint, k.recipientFile = prof.DefaultKey, prof.KeyFingerprint, prof.RecipientFile
+	defaults := o.repoDefaults.Over(prof.Defaults)
+	if defaults.Backend != "" && !o.changed("backend") {
+		k.backend = defaults.Backend
+	}
+	k.recipients = defaults.Recipients
+
+	return o.newPki(k), nil
+}
+
+// explicitKeys are the keys named on the command line
+func (o *options) explicitKeys() []string {
+	var names []string
+	for _, name := range []string{"pgp_key", "key-fingerprint"} {
+		if o.changed(name) {
+			names = append(names, o.str(name))
+		}
+	}
+	if toKey := o.str("to-key"); toKey != "" {
+		names = append(names, toKey)
+	}
+	return names
+}
@@ -22,48 +22,56 @@ package cmd
 // THE SOFTWARE.
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/config"
+	"github.com/Everbridge/generate-secure-pillar/glob"
 	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-	tilde "gopkg.in/mattes/go-expand-tilde.v1"
+	"github.com/spf13/pflag"
 )
 
-// initLogger initializes a logger instance for the cmd package
+// initLogger initializes a logger instance for the cmd package, diagnostics always go to
+// STDERR so they never mix with the output of a command
 func initLogger() zerolog.Logger {
-	return zerolog.New(os.Stdout)
+	return zerolog.New(os.Stderr)
 }
 
-// Package-level variables for CLI configuration
-// These are initialized by cobra flags and used across commands
-var (
-	logger = initLogger()
-
-	// File path configuration
-	inputFilePath  string
-	outputFilePath = os.Stdout.Name()
-	cfgFile        string
-	recurseDir     string
-	yamlPath       string
-
-	// Profile and encryption configuration
-	profile         string
-	pgpKeyName      string
-	publicKeyRing   = "~/.gnupg/pubring.gpg"
-	privateKeyRing  = "~/.gnupg/secring.gpg"
-	topLevelElement string
-
-	// Operation flags
-	updateInPlace bool
-)
+// newLogger returns a logger writing JSON or text to STDERR at the given level
+func newLogger(format string, level string) (zerolog.Logger, error) {
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil || lvl == zerolog.NoLevel {
+		return initLogger(), fmt.Errorf("unknown log level '%s', use debug, info, warn or error", level)
+	}
+
+	switch format {
+	case "json":
+		return zerolog.New(os.Stderr).Level(lvl), nil
+	case "text":
+		fi, err := os.Stderr.Stat()
+		noColor := err != nil || fi.Mode()&os.ModeCharDevice == 0
+		return zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: noColor}).Level(lvl), nil
+	default:
+		return initLogger(), fmt.Errorf("unknown log format '%s', use text or json", format)
+	}
+}
+
+// envPrefix prefixes the environment variables that set global options, such as GSP_ELEMENT for --element
+const envPrefix = "GSP_"
+
+// exit code used by checking commands when they find problems, errors running a command exit with 1
+const problemsFound = 2
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -93,6 +101,12 @@ $ generate-secure-pillar -k "Salt Master" --element secret_stuff encrypt all --f
 # recurse through all sls files, encrypting all values
 $ generate-secure-pillar -k "Salt Master" encrypt recurse -d /path/to/pillar/secure/stuff
 
+# recurse through a repository with a .gsp.yaml, encrypting each file with the key of its profile
+$ generate-secure-pillar encrypt recurse -d /path/to/repo/pillar
+
+# encrypt a directory four files at a time, skipping vendored pillar and also encrypting to a break glass key
+$ generate-secure-pillar -k "Salt Master" --recipient "Break Glass" --jobs 4 --exclude "**/vendor/**" encrypt recurse -d /path/to/pillar/secure/stuff
+
 # recurse through all sls files, decrypting all values (requires imported private key)
 $ generate-secure-pillar decrypt recurse -d /path/to/pillar/secure/stuff
 
@@ -102,6 +116,46 @@ $ generate-secure-pillar decrypt path --path "some:yaml:path" --file new.sls
 # decrypt all files and re-encrypt with given key (requires imported private key)
 $ generate-secure-pillar -k "New Salt Master Key" rotate -d /path/to/pillar/secure/stuff
 
+# re-encrypt a single file in place
+$ generate-secure-pillar -k "New Salt Master Key" rotate all -f us1.sls --update
+
+# list what a rotation would change without writing anything
+$ generate-secure-pillar -k "New Salt Master Key" rotate recurse --dry-run -d /path/to/pillar/secure/stuff
+
+# re-encrypt only the values encrypted to an old key, leaving everything else untouched
+$ generate-secure-pillar rotate --from-key "Old Salt Master Key" --to-key "New Salt Master Key" -d /path/to/pillar/secure/stuff
+
+# encrypt to an ASCII armored public key without a GnuPG home
+$ generate-secure-pillar --recipient-file ebos.pub encrypt recurse -d /path/to/pillar/secure/stuff
+
+# show what encrypting a directory would change without writing anything
+$ generate-secure-pillar -k "Salt Master" --dry-run encrypt recurse -d /path/to/pillar/secure/stuff
+
+# sign values when encrypting, and refuse values not signed by a trusted key when decrypting
+$ generate-secure-pillar -k "Salt Master" --sign-with "Release Signer" encrypt recurse -d /path/to/pillar/secure/stuff
+$ generate-secure-pillar -k "Salt Master" --trusted-signer "Release Signer" --signatures require decrypt all -f us1.sls
+
+# decrypt with a key held by gpg-agent, such as a smartcard or a key with a passphrase
+$ generate-secure-pillar --backend agent decrypt all -f us1.sls
+
+# write a config file template, then check it and show the profile a command would use
+$ generate-secure-pillar config init
+$ generate-secure-pillar config validate
+$ generate-secure-pillar --profile prod config show
+
+# check that every encrypted value in a directory is well formed and decryptable
+$ generate-secure-pillar verify --decrypt -d /path/to/pillar/secure/stuff
+
+# find plain text secrets left in a pillar tree, as SARIF for code scanning
+$ generate-secure-pillar lint --format sarif -d /path/to/pillar
+
+# create a salt master key and a config profile using it
+$ generate-secure-pillar keys generate --name "Stage Salt Master" --out-dir /srv/salt/gpgkeys --add-profile stage
+
+# import a public key into the profile key rings and list them
+$ generate-secure-pillar --profile stage keys import ebos.asc
+$ generate-secure-pillar --profile stage keys list
+
 # show all PGP key IDs used in a file
 $ generate-secure-pillar keys all --file us1.sls
 
@@ -110,6 +164,12 @@ $ generate-secure-pillar keys recurse -d /path/to/pillar/secure/stuff
 
 # show the PGP Key ID used for an element at a path in a file
 $ generate-secure-pillar keys path --path "some:yaml:path" --file new.sls
+
+# show the key used for every encrypted value in a file, including list items
+$ generate-secure-pillar keys all --by-path --file us1.sls
+
+# report the keys used per file and per path as JSON, YAML or CSV
+$ generate-secure-pillar keys recurse --output json -d /path/to/pillar/secure/stuff
 `,
 	Version: "1.0.640",
 }
@@ -122,143 +182,316 @@ const path = "path"
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		logger := initLogger()
 		logger.Error().Err(err).Msg("Command execution failed")
 		os.Exit(1)
 	}
 }
 
 func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
-	cobra.OnInitialize(initConfig)
-
 	// respect the env var if set
-	gpgHome := os.Getenv("GNUPGHOME")
-	if gpgHome != "" {
+	publicKeyRing, privateKeyRing := "~/.gnupg/pubring.gpg", "~/.gnupg/secring.gpg"
+	if gpgHome := os.Getenv("GNUPGHOME"); gpgHome != "" {
 		publicKeyRing = fmt.Sprintf("%s/pubring.gpg", gpgHome)
 		privateKeyRing = fmt.Sprintf("%s/secring.gpg", gpgHome)
 	}
 
-	// check for GNUPG1 pubring file
-	filePath, err := tilde.Expand(publicKeyRing)
+	rootCmd.PersistentFlags().Bool("version", false, "print the version")
+	rootCmd.PersistentFlags().String("config", "", "config file (default is $HOME/.config/generate-secure-pillar/config.yaml)")
+	rootCmd.PersistentFlags().String("profile", "", "profile name from profile specified in the config file")
+	rootCmd.PersistentFlags().StringP("pgp_key", "k", "", "PGP key name, email, or ID to use for encryption")
+	rootCmd.PersistentFlags().String("key-fingerprint", "", "full fingerprint of the PGP key to use, pins the key when several match the key name")
+	rootCmd.PersistentFlags().String("recipient-file", "", "binary or ASCII armored public key file to encrypt to instead of the pubring")
+	rootCmd.PersistentFlags().String("pubring", publicKeyRing, "PGP public keyring, binary or ASCII armored (default is $HOME/.gnupg/pubring.gpg)")
+	rootCmd.PersistentFlags().String("secring", privateKeyRing, "PGP private keyring, binary or ASCII armored (default is $HOME/.gnupg/secring.gpg)")
+	rootCmd.PersistentFlags().StringP("element", "e", "", "Name of the top level element under which encrypted key/value pairs are kept")
+	rootCmd.PersistentFlags().String("backend", "", "decrypt with the secret keyring or with gpg-agent: keyring or agent (default keyring)")
+	rootCmd.PersistentFlags().String("sign-with", "", "secret key name, email, or ID used to sign encrypted values")
+	rootCmd.PersistentFlags().StringSlice("trusted-signer", nil, "key name, email, or ID trusted to sign values (default is any key in the key rings)")
+	rootCmd.PersistentFlags().String("signatures", "", "how unsigned or untrusted values are handled when decrypting: ignore, warn or require (default ignore)")
+	rootCmd.PersistentFlags().Bool("allow-invalid-key", false, "use the PGP key even if it is revoked, expired or cannot encrypt")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "run the command and print a plan of the changes without writing anything")
+	rootCmd.PersistentFlags().StringSlice("recipient", nil, "more PGP key names, emails, or IDs to encrypt to along with the key")
+	rootCmd.PersistentFlags().Int("jobs", 0, "number of files processed at once in a directory (default is all of them)")
+	rootCmd.PersistentFlags().StringSlice("include", nil, "only process the files of a directory matching these globs, ** matches any number of directories")
+	rootCmd.PersistentFlags().StringSlice("exclude", nil, "skip the files of a directory matching these globs, ** matches any number of directories")
+	rootCmd.PersistentFlags().String("audit-log", "", "record the values encrypted, decrypted or rotated and the files written in this JSONL file, or in syslog")
+	rootCmd.PersistentFlags().String("log-format", "json", "format of the log written to STDERR: text or json")
+	rootCmd.PersistentFlags().String("log-level", "info", "lowest level logged: debug, info, warn or error")
+}
+
+// readEnv sets the global options not given as flags from their environment variables
+func readEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" || flag.Name == "version" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(flag.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err = flag.Value.Set(value); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+				return
+			}
+			flag.Changed = true
+		}
+	})
+	return err
+}
+
+// writeOutput writes the buffer to the output file, or for a dry run prints a plan of what would change
+func (o *options) writeOutput(s *sls.Sls, buffer bytes.Buffer, outputFilePath string, err error) {
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Error with GNUPG pubring path")
+		o.logger.Fatal().Err(err).Str("file", s.FilePath).Msgf("failed to process %s", s.FilePath)
 	}
-	if utils.ContainsDirectoryTraversal(filePath) {
-		logger.Fatal().Msgf("Invalid pubring path: directory traversal detected in %s", filePath)
-	}
-	if _, err = os.Stat(filepath.Clean(filePath)); os.IsNotExist(err) {
-		if err != nil {
-			logger.Fatal().Err(err).Msg("Error finding GNUPG pubring file")
+	if !o.dryRun {
+		if _, err := s.WriteFile(buffer, outputFilePath); err != nil {
+			o.logger.Fatal().Err(err).Str("file", outputFilePath).Msgf("failed to write %s", outputFilePath)
 		}
+		return
+	}
+	err = utils.PrintPlan(os.Stdout, s, outputFilePath, buffer)
+	if err != nil {
+		o.logger.Fatal().Err(err).Msg("failed to print plan")
 	}
-
-	rootCmd.PersistentFlags().Bool("version", false, "print the version")
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.config/generate-secure-pillar/config.yaml)")
-	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "profile name from profile specified in the config file")
-	rootCmd.PersistentFlags().StringVarP(&pgpKeyName, "pgp_key", "k", pgpKeyName, "PGP key name, email, or ID to use for encryption")
-	rootCmd.PersistentFlags().StringVar(&publicKeyRing, "pubring", publicKeyRing, "PGP public keyring (default is $HOME/.gnupg/pubring.gpg)")
-	rootCmd.PersistentFlags().StringVar(&privateKeyRing, "secring", privateKeyRing, "PGP private keyring (default is $HOME/.gnupg/secring.gpg)")
-	rootCmd.PersistentFlags().StringVarP(&topLevelElement, "element", "e", "", "Name of the top level element under which encrypted key/value pairs are kept")
 }
 
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if cfgFile != "" {
-		// Validate config file path for directory traversal
-		if utils.ContainsDirectoryTraversal(cfgFile) {
-			logger.Fatal().Msgf("Invalid config file path: directory traversal detected in %s", cfgFile)
+// newPki loads the keys selected by the key options
+func (o *options) newPki(k keyOptions) *pki.Pki {
+	if o.configErr != nil {
+		o.logger.Fatal().Err(o.configErr).Msg("invalid config file")
+	}
+
+	// the agent socket lives in the GnuPG home holding the key rings
+	gnupgHome, err := homedir.Expand(filepath.Dir(k.privateKeyRing))
+	if err != nil {
+		o.logger.Fatal().Err(err).Msg("failed to find the GnuPG home directory")
+	}
+
+	p, err := pki.NewWithOptions(pki.Options{
+		PgpKeyName:        k.pgpKeyName,
+		KeyFingerprint:    k.keyFingerprint,
+		Recipients:        k.recipients,
+		PublicKeyRing:     k.publicKeyRing,
+		SecretKeyRing:     k.privateKeyRing,
+		RecipientFile:     k.recipientFile,
+		PublicKeyData:     os.Getenv(pki.PublicKeyEnv),
+		SecretKeyData:     os.Getenv(pki.SecretKeyEnv),
+		Backend:           k.backend,
+		Crypto:            k.crypto,
+		AgentSocket:       pki.AgentSocket(gnupgHome),
+		AllowInvalidKey:   k.allowInvalidKey || !o.encrypting,
+		KeyOptional:       k.keyOptional,
+		ExpiryWarningDays: k.expiryWarningDays,
+		Logger:            &o.logger,
+	})
+	if err != nil {
+		o.logger.Fatal().Err(err).Msg("failed to initialize PKI")
+	}
+
+	switch k.signaturePolicy {
+	case "", pki.SignaturesIgnore, pki.SignaturesWarn, pki.SignaturesRequire:
+		p.SignaturePolicy = k.signaturePolicy
+	default:
+		o.logger.Fatal().Msgf("unknown signature policy '%s', use ignore, warn or require", k.signaturePolicy)
+	}
+	if k.signingKey != "" {
+		if err = p.SetSigner(k.signingKey); err != nil {
+			o.logger.Fatal().Err(err).Msg("failed to load signing key")
 		}
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := homedir.Dir()
-		if err != nil {
-			logger.Fatal().Err(err).Msg("Failed to determine home directory")
+	}
+	if len(k.trustedSigners) > 0 {
+		if err = p.SetTrustedSigners(k.trustedSigners); err != nil {
+			o.logger.Fatal().Err(err).Msg("failed to load trusted signers")
 		}
+	}
+	o.keyAudit[p] = o.openAuditLog(k.auditLog)
+
+	return p
+}
 
-		configPath := fmt.Sprintf("%s/.config/generate-secure-pillar/", home)
-		dir := filepath.Clean(configPath)
-		err = os.MkdirAll(dir, 0700)
+// openAuditLog opens the audit log at a destination once, however many sets of keys use it
+func (o *options) openAuditLog(dest string) *audit.Log {
+	if dest == "" {
+		return nil
+	}
+	if l, ok := o.auditLogs[dest]; ok {
+		return l
+	}
+	l, err := audit.Open(dest)
+	if err != nil {
+		o.logger.Fatal().Err(err).Str("file", dest).Msg("failed to open the audit log")
+	}
+	o.auditLogs[dest] = l
+	return l
+}
+
+// auditFor returns the audit log of the operations done with a set of keys, nil for none
+func (o *options) auditFor(p *pki.Pki) *audit.Log {
+	return o.keyAudit[p]
+}
+
+// readProfile applies the profile named with --profile, or the default profile when no key
+// is given, then the repository defaults over it
+func (o *options) readProfile() error {
+	name := o.str("profile")
+
+	var defaults config.Defaults
+	if name != "" || o.keys.pgpKeyName == "" {
+		prof, err := o.userConfig.Profile(name)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("error creating config file path")
+			return err
 		}
-		configFile, err := os.OpenFile(dir+"/config.yaml", os.O_RDONLY|os.O_CREATE, 0660)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("Error creating config file")
+		if prof != nil {
+			o.applyProfile(&o.keys, prof)
+			defaults = prof.Defaults
 		}
-		defer configFile.Close()
+	}
+	o.applyDefaults(o.repoDefaults.Over(defaults))
+	return nil
+}
 
-		// set config in "~/.config/generate-secure-pillar/config.yaml".
-		viper.AddConfigPath(configPath)
-		viper.SetConfigName("config")
-		viper.SetConfigType("yaml")
+// applyProfile sets the key rings, the key and the other key options from a profile unless they were given as flags
+func (o *options) applyProfile(k *keyOptions, prof *config.Profile) {
+	if ring := prof.PubRing(); ring != "" && !o.changed("pubring") {
+		k.publicKeyRing = ring
+	}
+	if ring := prof.SecRing(); ring != "" && !o.changed("secring") {
+		k.privateKeyRing = ring
 	}
+	if prof.DefaultKey != "" && !o.changed("pgp_key") {
+		k.pgpKeyName = prof.DefaultKey
+	}
+	o.readProfileOptions(k, prof)
+}
 
-	viper.AutomaticEnv() // read in environment variables that match
+// applyDefaults sets the global options a profile or the repository config file gives unless they were given as flags
+func (o *options) applyDefaults(defaults config.Defaults) {
+	if defaults.Element != "" && !o.changed("element") {
+		o.element = defaults.Element
+	}
+	if defaults.Jobs != 0 && !o.changed("jobs") {
+		o.jobs = defaults.Jobs
+	}
+	if len(defaults.Recipients) > 0 && !o.changed("recipient") {
+		o.keys.recipients = defaults.Recipients
+	}
+	if defaults.Backend != "" && !o.changed("backend") {
+		o.keys.backend = defaults.Backend
+	}
+	if len(defaults.Include) > 0 && !o.changed("include") {
+		o.include = defaults.Include
+	}
+	if len(defaults.Exclude) > 0 && !o.changed("exclude") {
+		o.exclude = defaults.Exclude
+	}
+	if defaults.DryRun && !o.changed("dry-run") {
+		o.dryRun = defaults.DryRun
+	}
+	if defaults.LogFormat != "" && !o.changed("log-format") {
+		o.logFormat = defaults.LogFormat
+	}
+	if defaults.LogLevel != "" && !o.changed("log-level") {
+		o.logLevel = defaults.LogLevel
+	}
+	if defaults.Output != "" && !o.changed("output") {
+		o.output = defaults.Output
+	}
+}
 
-	// If a config file is found, read it in.
-	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
-		logger.Fatal().Err(err).Msg("Fatal error config file")
+// checkInputFile stops a command when the file it reads does not exist, rather than
+// reporting an empty file
+func (o *options) checkInputFile(command string, file string) {
+	if file == os.Stdin.Name() {
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		o.logger.Fatal().Err(err).Str("action", command).Str("file", file).Msgf("%s: cannot read input file", command)
 	}
-	readProfile()
 }
 
-func getPki() *pki.Pki {
-	p, err := pki.New(pgpKeyName, publicKeyRing, privateKeyRing)
+// newSls reads a pillar file with the keys shared and the command's logger
+func (o *options) newSls(file string, pk *pki.Pki) (sls.Sls, error) {
+	return sls.NewWithOptions(sls.Options{
+		FilePath:       file,
+		Pki:            pk,
+		EncryptionPath: o.element,
+		Logger:         &o.logger,
+		Audit:          o.auditFor(pk),
+		DryRun:         o.dryRun,
+	})
+}
+
+// readSls reads a pillar file for a command, stopping it when the file cannot be read
+// or has include directives
+func (o *options) readSls(command string, file string, pk *pki.Pki) sls.Sls {
+	s, err := o.newSls(file, pk)
+	if errors.Is(err, sls.ErrIncludeDirective) {
+		o.logger.Fatal().Str("action", command).Str("file", file).Msgf("%s: file %s contains include statements and cannot be processed", command, file)
+	}
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to initialize PKI")
+		o.logger.Fatal().Err(err).Str("action", command).Str("file", file).Msgf("%s: cannot read %s", command, file)
 	}
-	return p
+	return s
 }
 
-func readProfile() {
-	if viper.IsSet("profiles") {
-		profiles := viper.Get("profiles")
-		profName := ""
-		if rootCmd.Flag("profile") != nil && rootCmd.Flag("profile").Value != nil {
-			profName = rootCmd.Flag("profile").Value.String()
-		}
+// pathAction prints the result of an action on the value at --path, a path that is not
+// in the file is only a warning
+func (o *options) pathAction(command string, s *sls.Sls, action string) {
+	yamlPath := o.str("path")
+	vals, err := utils.PathAction(s, yamlPath, action)
+	if errors.Is(err, sls.ErrPathNotFound) {
+		o.logger.Warn().Str("action", command).Str("file", s.FilePath).Str("path", yamlPath).Msgf("%s: %s", command, err)
+		return
+	} else if err != nil {
+		o.logger.Fatal().Err(err).Str("action", command).Str("file", s.FilePath).Str("path", yamlPath).Msgf("%s: path action failed", command)
+	}
+	fmt.Printf("%s: %s\n", yamlPath, vals)
+}
 
-		if profName != "" || pgpKeyName == "" {
-			profileList, ok := profiles.([]interface{})
-			if !ok {
-				logger.Warn().Msg("profiles configuration is not a valid array")
-				return
-			}
-			for _, prof := range profileList {
-				profileMap, ok := prof.(map[string]interface{})
-				if !ok {
-					logger.Warn().Msg("profile entry is not a valid map")
-					continue
-				}
-				if profileMap["default"] == true || profName == profileMap["name"] {
-					if gnupgHomeVal, exists := profileMap["gnupg_home"]; exists {
-						if gpgHome, ok := gnupgHomeVal.(string); ok && gpgHome != "" {
-							// Validate path for directory traversal
-							if utils.ContainsDirectoryTraversal(gpgHome) {
-								logger.Warn().Msgf("Invalid gnupg_home path: directory traversal detected in %s", gpgHome)
-								continue
-							}
-							publicKeyRing = fmt.Sprintf("%s/pubring.gpg", gpgHome)
-							privateKeyRing = fmt.Sprintf("%s/secring.gpg", gpgHome)
-						}
-					}
-					if defaultKeyVal, exists := profileMap["default_key"]; exists && defaultKeyVal != nil {
-						if defaultKey, ok := defaultKeyVal.(string); ok {
-							pgpKeyName = defaultKey
-						}
-					}
-				}
-			}
-		}
+// findFiles lists the .sls files of a directory selected by --include and --exclude
+func (o *options) findFiles(dir string) []string {
+	files, _, err := utils.FindFilesByExt(dir, ".sls")
+	if err != nil {
+		o.logger.Fatal().Err(err).Msg("cannot list files")
+	}
+	return glob.Filter(dir, files, o.include, o.exclude)
+}
+
+// readProfileOptions sets the key selection, crypto, signing and key validity options from a profile unless they were given as flags
+func (o *options) readProfileOptions(k *keyOptions, prof *config.Profile) {
+	if prof.KeyFingerprint != "" && !o.changed("key-fingerprint") {
+		k.keyFingerprint = prof.KeyFingerprint
+	}
+	if prof.RecipientFile != "" && !o.changed("recipient-file") {
+		k.recipientFile = prof.RecipientFile
+	}
+	if prof.Crypto != (pki.CryptoOptions{}) {
+		k.crypto = prof.Crypto
+	}
+	if prof.ExpiryWarningDays != nil {
+		k.expiryWarningDays = *prof.ExpiryWarningDays
+	}
+	if prof.AllowInvalidKey && !o.changed("allow-invalid-key") {
+		k.allowInvalidKey = prof.AllowInvalidKey
+	}
+	if prof.SigningKey != "" && !o.changed("sign-with") {
+		k.signingKey = prof.SigningKey
+	}
+	if prof.SignaturePolicy != "" && !o.changed("signatures") {
+		k.signaturePolicy = prof.SignaturePolicy
+	}
+	if len(prof.TrustedSigners) > 0 && !o.changed("trusted-signer") {
+		k.trustedSigners = append([]string{}, prof.TrustedSigners...)
+	}
+	if prof.AuditLog != "" && !o.changed("audit-log") {
+		k.auditLog = prof.AuditLog
 	}
 }
 
 // if we are getting stdin from a pipe we don't want
 // to output log info about it that could mess up parsing
-func stdinIsPiped() bool {
+func stdinIsPiped(logger *zerolog.Logger) bool {
 	fi, err := os.Stdin.Stat()
 	if err != nil {
 		// Log error but don't use Fatal as this could be recoverable
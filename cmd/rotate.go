@@ -22,12 +22,14 @@
 package cmd
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -35,47 +37,130 @@ import (
 var rotateCmd = &cobra.Command{
 	Use:   "rotate",
 	Short: "decrypt existing files and re-encrypt with a new key",
-	Run: func(cmd *cobra.Command, args []string) {
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		logger := initLogger()
+		// a file piped to STDIN is rotated to STDOUT
+		if len(args) == 0 && !cmd.Flags().Changed("dir") && !cmd.Flags().Changed("file") && !stdinIsPiped(&logger) {
+			return fmt.Errorf("rotate: give all, recurse or path with --file or --dir, or pipe a file to STDIN")
+		}
+		return nil
+	},
+	Run: run(func(o *options, args []string) {
+		inputFilePath, outputFilePath, recurseDir := o.str("file"), o.str("outfile"), o.str("dir")
+		fromKey, yamlPath := o.str("from-key"), o.str("path")
+
 		// Validate file paths for directory traversal attacks
 		if utils.ContainsDirectoryTraversal(inputFilePath) {
-			logger.Fatal().Msgf("rotate: invalid input file path - directory traversal detected in %s", inputFilePath)
+			o.logger.Fatal().Msgf("rotate: invalid input file path - directory traversal detected in %s", inputFilePath)
 		}
 		if utils.ContainsDirectoryTraversal(recurseDir) {
-			logger.Fatal().Msgf("rotate: invalid directory path - directory traversal detected in %s", recurseDir)
+			o.logger.Fatal().Msgf("rotate: invalid directory path - directory traversal detected in %s", recurseDir)
 		}
 		if utils.ContainsDirectoryTraversal(outputFilePath) {
-			logger.Fatal().Msgf("rotate: invalid output file path - directory traversal detected in %s", outputFilePath)
+			o.logger.Fatal().Msgf("rotate: invalid output file path - directory traversal detected in %s", outputFilePath)
+		}
+
+		if toKey := o.str("to-key"); toKey != "" {
+			o.keys.pgpKeyName = toKey
+		}
+		outputFilePath, err := filepath.Abs(outputFilePath)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("rotate: failed to resolve absolute path for output file")
+		}
+		inputFilePath, err = filepath.Abs(inputFilePath)
+		if err != nil {
+			o.logger.Fatal().Err(err).Msg("rotate: failed to resolve absolute path for input file")
 		}
 
-		pk := getPki()
+		// older versions took no sub-command, so infer one from the flags given
+		mode := all
+		if len(args) > 0 {
+			mode = args[0]
+		} else if recurseDir != "" {
+			mode = recurse
+		}
 
-		if recurseDir != "" {
-			err := utils.ProcessDir(recurseDir, ".sls", "rotate", outputFilePath, topLevelElement, *pk)
-			if err != nil {
-				logger.Warn().Err(err).Msg("rotate: failed to process directory")
+		// process args
+		switch mode {
+		case all, path:
+			o.checkInputFile("rotate", inputFilePath)
+			if inputFilePath == os.Stdin.Name() && !stdinIsPiped(&o.logger) {
+				o.logger.Info().Msgf("reading from %s", os.Stdin.Name())
 			}
-		} else if inputFilePath != "" {
-			s := sls.New(inputFilePath, *pk, topLevelElement)
+			pk := o.pkiForFile(inputFilePath)
+			s := o.readSls("rotate", inputFilePath, pk)
 
-			// Check if the file contains include statements (not supported for rotation)
-			if s.IsInclude {
-				logger.Fatal().Msgf("rotate: file %s contains include statements and cannot be processed", inputFilePath)
+			if inputFilePath != os.Stdin.Name() && o.on("update") {
+				outputFilePath = inputFilePath
 			}
-
-			buf, err := s.PerformAction("rotate")
-			utils.SafeWrite(buf, outputFilePath, err)
-		} else {
-			err := cmd.Help()
+			if fromKey != "" {
+				s.RotateFrom, err = pk.KeyIDs(fromKey)
+				if err != nil {
+					o.logger.Fatal().Err(err).Msg("rotate: invalid --from-key")
+				}
+			}
+			var buffer bytes.Buffer
+			if mode == path {
+				// only the values at the path are rotated, the whole file is written
+				buffer, err = s.PerformActionAt(sls.Rotate, yamlPath)
+				if errors.Is(err, sls.ErrPathNotFound) {
+					o.logger.Warn().Str("action", "rotate").Str("file", s.FilePath).Str("path", yamlPath).Msgf("rotate: %s", err)
+					return
+				}
+			} else {
+				buffer, err = s.PerformAction(sls.Rotate)
+			}
+			if err == nil && fromKey != "" && !o.dryRun {
+				// the rotated file may be going to STDOUT, so report on STDERR
+				fmt.Fprintf(os.Stderr, "%s: %d rotated, %d skipped\n", inputFilePath, s.Rotated, s.Skipped)
+				if s.Rotated == 0 && outputFilePath != os.Stdout.Name() {
+					// nothing was encrypted to the old key, leave the file alone
+					return
+				}
+			}
+			o.writeOutput(&s, buffer, outputFilePath, err)
+		case recurse:
+			opts := utils.DirOptions{
+				FileExt:         ".sls",
+				Action:          sls.Rotate,
+				OutputFilePath:  outputFilePath,
+				TopLevelElement: o.element,
+				RotateFromKeys:  fromKeys(fromKey),
+				DryRun:          o.dryRun,
+				Jobs:            o.jobs,
+				Include:         o.include,
+				Exclude:         o.exclude,
+				Logger:          &o.logger,
+				AuditFor:        o.auditFor,
+			}
+			err = utils.ProcessDirWithKeys(recurseDir, opts, o.pkiForDir(recurseDir, ".sls"))
 			if err != nil {
-				logger.Fatal().Err(err).Msg("rotate: failed to display help")
+				o.logger.Warn().Err(err).Msg("rotate: failed to process directory")
+			}
+		default:
+			err = o.cmd.Help()
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("rotate: failed to display help")
 			}
 		}
-	},
+	}),
+}
+
+// fromKeys is --from-key as a list, the keys are looked up for each file of a directory
+func fromKeys(fromKey string) []string {
+	if fromKey == "" {
+		return nil
+	}
+	return []string{fromKey}
 }
 
 func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	rootCmd.AddCommand(rotateCmd)
-	rotateCmd.PersistentFlags().StringVarP(&recurseDir, "dir", "d", "", "recurse over all .sls files in the given directory")
-	rotateCmd.PersistentFlags().StringVarP(&inputFilePath, "file", "f", "", "input file (defaults to STDIN)")
+	rotateCmd.PersistentFlags().StringP("path", "p", "", "YAML path to rotate")
+	rotateCmd.PersistentFlags().StringP("dir", "d", "", "recurse over all .sls files in the given directory")
+	rotateCmd.PersistentFlags().StringP("file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
+	rotateCmd.PersistentFlags().StringP("outfile", "o", os.Stdout.Name(), "output file (defaults to STDOUT)")
+	rotateCmd.PersistentFlags().BoolP("update", "u", false, "update the input file")
+	rotateCmd.PersistentFlags().String("from-key", "", "only rotate values encrypted to this PGP key name, email, or ID")
+	rotateCmd.PersistentFlags().String("to-key", "", "PGP key name, email, or ID to re-encrypt with (defaults to --pgp_key)")
 }
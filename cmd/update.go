@@ -26,7 +26,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
 	"github.com/spf13/cobra"
 )
@@ -35,23 +34,25 @@ import (
 var updateCmd = &cobra.Command{
 	Use:   "update",
 	Short: "update the value of the given key in the given file",
-	Run: func(cmd *cobra.Command, args []string) {
+	Run: run(func(o *options, args []string) {
+		inputFilePath, outputFilePath := o.str("file"), os.Stdout.Name()
+
 		// Validate path for directory traversal attacks
 		if utils.ContainsDirectoryTraversal(inputFilePath) {
-			logger.Fatal().Msgf("update: invalid file path - directory traversal detected in %s", inputFilePath)
+			o.logger.Fatal().Msgf("update: invalid file path - directory traversal detected in %s", inputFilePath)
 		}
 
 		inputFilePath, err := filepath.Abs(inputFilePath)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("update: failed to resolve input file path")
+			o.logger.Fatal().Err(err).Msg("update: failed to resolve input file path")
 		}
 		if inputFilePath != os.Stdin.Name() {
 			outputFilePath = inputFilePath
 		}
 
 		// Parse secret names and values with proper trimming
-		nameStr := strings.TrimSpace(cmd.Flag("name").Value.String())
-		valueStr := strings.TrimSpace(cmd.Flag("value").Value.String())
+		nameStr := strings.TrimSpace(o.cmd.Flag("name").Value.String())
+		valueStr := strings.TrimSpace(o.cmd.Flag("value").Value.String())
 
 		// Remove surrounding brackets if present
 		nameStr = strings.Trim(nameStr, "[]")
@@ -70,48 +71,38 @@ var updateCmd = &cobra.Command{
 
 		// Validate input arrays
 		if len(secretNames) == 0 {
-			logger.Fatal().Msg("update: no secret names provided")
+			o.logger.Fatal().Msg("update: no secret names provided")
 		}
 		if len(secretValues) == 0 {
-			logger.Fatal().Msg("update: no secret values provided")
+			o.logger.Fatal().Msg("update: no secret values provided")
 		}
 		if len(secretNames) != len(secretValues) {
-			logger.Fatal().Msgf("update: mismatch between number of names (%d) and values (%d)", len(secretNames), len(secretValues))
+			o.logger.Fatal().Msgf("update: mismatch between number of names (%d) and values (%d)", len(secretNames), len(secretValues))
 		}
 
 		// Check for empty names or values
 		for i, name := range secretNames {
 			if strings.TrimSpace(name) == "" {
-				logger.Fatal().Msgf("update: secret name at position %d is empty", i+1)
+				o.logger.Fatal().Msgf("update: secret name at position %d is empty", i+1)
 			}
 		}
 
-		pk := getPki()
-		s := sls.New(inputFilePath, *pk, topLevelElement)
-
-		// Check if the file contains include statements (not supported)
-		if s.IsInclude {
-			logger.Fatal().Msgf("update: file %s contains include statements and cannot be processed", inputFilePath)
-		}
+		o.checkInputFile("update", inputFilePath)
+		pk := o.pkiForFile(inputFilePath)
+		s := o.readSls("update", inputFilePath, pk)
 
 		err = s.ProcessYaml(secretNames, secretValues)
 		if err != nil {
-			logger.Fatal().Err(err).Msg("update: failed to process YAML")
+			o.logger.Fatal().Err(err).Msg("update: failed to process YAML")
 		}
 		buffer, err := s.FormatBuffer("")
-		if err != nil {
-			logger.Fatal().Err(err).Msg("update: failed to format buffer")
-		}
-		_, err = sls.WriteSlsFile(buffer, outputFilePath)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("update: failed to write output file")
-		}
-	},
+		o.writeOutput(&s, buffer, outputFilePath, err)
+	}),
 }
 
 func init() {
 	rootCmd.AddCommand(updateCmd)
-	updateCmd.PersistentFlags().StringVarP(&inputFilePath, "file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
+	updateCmd.PersistentFlags().StringP("file", "f", os.Stdin.Name(), "input file (defaults to STDIN)")
 	updateCmd.PersistentFlags().StringArrayP("name", "n", nil, "secret name(s)")
 	updateCmd.PersistentFlags().StringArrayP("value", "s", nil, "secret value(s)")
 }
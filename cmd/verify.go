@@ -0,0 +1,118 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cmd/verify checks that the encrypted values in secure pillar files are healthy
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Everbridge/generate-secure-pillar/sls"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "check that all encrypted values are well formed and decryptable",
+	Long: `Check that every encrypted value is well formed and encrypted to a key in the key rings.
+With --decrypt values are decrypted too, and checked against the profile crypto settings.
+
+Exits with 0 when all values are healthy, 2 when problems are found and 1 on any other error.`,
+	Run: run(func(o *options, args []string) {
+		verifyFile, recurseDir := o.str("file"), o.str("dir")
+
+		// Validate file paths for directory traversal attacks
+		if utils.ContainsDirectoryTraversal(verifyFile) {
+			o.logger.Fatal().Msgf("verify: invalid input file path - directory traversal detected in %s", verifyFile)
+		}
+		if utils.ContainsDirectoryTraversal(recurseDir) {
+			o.logger.Fatal().Msgf("verify: invalid directory path - directory traversal detected in %s", recurseDir)
+		}
+
+		var files []string
+		if recurseDir != "" {
+			files = o.findFiles(recurseDir)
+		} else if verifyFile != "" {
+			file, err := filepath.Abs(verifyFile)
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("verify: failed to resolve absolute path for input file")
+			}
+			if _, err = os.Stat(file); err != nil {
+				o.logger.Fatal().Err(err).Msg("verify: cannot read input file")
+			}
+			files = append(files, file)
+		} else {
+			err := o.cmd.Help()
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("verify: failed to display help")
+			}
+			return
+		}
+
+		keys := o.newRepoKeys()
+		problems := 0
+		checked := 0
+		for _, file := range files {
+			pk, err := keys.forFile(file)
+			if err != nil {
+				o.logger.Fatal().Err(err).Msg("verify: failed to select keys")
+			}
+			s, _ := o.newSls("", pk)
+			s.FilePath = file
+			if err := s.ReadSlsFile(); err != nil {
+				if errors.Is(err, sls.ErrIncludeDirective) {
+					o.logger.Warn().Msgf("verify: skipping %s, it contains include directives", file)
+					continue
+				}
+				fmt.Printf("%s: unreadable: %s\n", file, err)
+				problems++
+				continue
+			}
+
+			issues, count := s.Verify(o.on("decrypt"))
+			checked += count
+			for _, issue := range issues {
+				if issue.Path != "" {
+					fmt.Printf("%s: %s: %s: %s\n", file, issue.Path, issue.Kind, issue.Message)
+				} else {
+					fmt.Printf("%s: %s: %s\n", file, issue.Kind, issue.Message)
+				}
+			}
+			problems += len(issues)
+		}
+
+		fmt.Printf("%d files, %d encrypted values checked, %d problems found\n", len(files), checked, problems)
+		if problems > 0 {
+			os.Exit(problemsFound)
+		}
+	}),
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.PersistentFlags().StringP("dir", "d", "", "recurse over all .sls files in the given directory")
+	verifyCmd.PersistentFlags().StringP("file", "f", "", "input file")
+	verifyCmd.PersistentFlags().Bool("decrypt", false, "also decrypt every value (requires imported private key)")
+}
@@ -0,0 +1,336 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package config/profile reads the profiles of the user config file
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Defaults are global options a profile or the repository config file sets, options
+// given on the command line or in the environment take precedence
+type Defaults struct {
+	// Element is the top level element encrypted values are kept under
+	Element string `yaml:"element,omitempty"`
+	// Jobs is the number of files processed at once in a directory
+	Jobs int `yaml:"jobs,omitempty"`
+	// Recipients are more keys values are encrypted to, along with the key of the profile
+	Recipients []string `yaml:"recipients,omitempty"`
+	Backend    string   `yaml:"backend,omitempty"`
+	// Include and Exclude are globs selecting the files of a directory, relative to it
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	DryRun  bool     `yaml:"dry_run,omitempty"`
+	// LogFormat is text or json, LogLevel is debug, info, warn or error
+	LogFormat string `yaml:"log_format,omitempty"`
+	LogLevel  string `yaml:"log_level,omitempty"`
+	// Output is the format of the keys reports: text, json, yaml or csv
+	Output string `yaml:"output,omitempty"`
+}
+
+// Over returns the defaults with the values they leave empty taken from base
+func (d Defaults) Over(base Defaults) Defaults {
+	fillEmpty(reflect.ValueOf(&d).Elem(), reflect.ValueOf(base))
+	return d
+}
+
+func (d *Defaults) validate() []error {
+	var errs []error
+	switch d.Backend {
+	case "", pki.BackendKeyring, pki.BackendAgent:
+	default:
+		errs = append(errs, fmt.Errorf("unknown backend '%s', use %s or %s", d.Backend, pki.BackendKeyring, pki.BackendAgent))
+	}
+	if d.Jobs < 0 {
+		errs = append(errs, fmt.Errorf("jobs cannot be negative"))
+	}
+	switch d.LogFormat {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("unknown log format '%s', use text or json", d.LogFormat))
+	}
+	switch strings.ToLower(d.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("unknown log level '%s', use debug, info, warn or error", d.LogLevel))
+	}
+	switch d.Output {
+	case "", "text", "json", "yaml", "csv":
+	default:
+		errs = append(errs, fmt.Errorf("unknown output format '%s', use text, json, yaml or csv", d.Output))
+	}
+	for _, pattern := range append(append([]string{}, d.Include...), d.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("bad glob '%s': %w", pattern, err))
+		}
+	}
+	return errs
+}
+
+// Profile is a named set of keys and options in the user config file
+type Profile struct {
+	Name    string `yaml:"name"`
+	Default bool   `yaml:"default,omitempty"`
+	// Extends names a profile whose values are used for the ones this profile leaves empty
+	Extends string `yaml:"extends,omitempty"`
+	// DefaultKey is the name, email or ID of the key values are encrypted to
+	DefaultKey     string `yaml:"default_key,omitempty"`
+	KeyFingerprint string `yaml:"key_fingerprint,omitempty"`
+	RecipientFile  string `yaml:"recipient_file,omitempty"`
+	// GnupgHome holds pubring.gpg and secring.gpg, DefaultPubRing and DefaultSecRing
+	// name the key rings directly
+	GnupgHome       string `yaml:"gnupg_home,omitempty"`
+	DefaultPubRing  string `yaml:"default_pub_ring,omitempty"`
+	DefaultSecRing  string `yaml:"default_sec_ring,omitempty"`
+	AllowInvalidKey bool   `yaml:"allow_invalid_key,omitempty"`
+	// ExpiryWarningDays is nil when not set, 0 turns the warning off
+	ExpiryWarningDays *int     `yaml:"expiry_warning_days,omitempty"`
+	SigningKey        string   `yaml:"signing_key,omitempty"`
+	SignaturePolicy   string   `yaml:"signature_policy,omitempty"`
+	TrustedSigners    []string `yaml:"trusted_signers,omitempty"`
+	// AuditLog is the JSONL file, or "syslog", the operations done with the profile's keys
+	// are recorded in
+	AuditLog string            `yaml:"audit_log,omitempty"`
+	Crypto   pki.CryptoOptions `yaml:"crypto,omitempty"`
+	Defaults `yaml:",inline"`
+}
+
+// Config is the user config file
+type Config struct {
+	// File is the path of the config file
+	File     string    `yaml:"-"`
+	Profiles []Profile `yaml:"profiles"`
+}
+
+// LoadConfig reads a user config file, an empty file has no profiles. Unknown keys are
+// errors, but the config is returned with them so it can be validated as well.
+func LoadConfig(file string) (*Config, error) {
+	buf, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{File: file}
+	dec := yamlv3.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	err = dec.Decode(config)
+	var typeErr *yamlv3.TypeError
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		return config, nil
+	case errors.As(err, &typeErr):
+		// the rest of the file is still decoded, so it can be validated too
+		errs := make([]error, 0, len(typeErr.Errors))
+		for _, msg := range typeErr.Errors {
+			if m := unknownField.FindStringSubmatch(msg); m != nil {
+				msg = fmt.Sprintf("line %s: unknown key '%s'", m[1], m[2])
+			}
+			errs = append(errs, fmt.Errorf("%s: %s", file, msg))
+		}
+		return config, errors.Join(errs...)
+	default:
+		return nil, fmt.Errorf("cannot read %s: %w", file, err)
+	}
+}
+
+var unknownField = regexp.MustCompile(`^line (\d+): field (\S+) not found in type`)
+
+// Validate checks every profile and returns all the problems found, a profile is
+// checked along with the values it inherits
+func (c *Config) Validate() error {
+	var errs []error
+	names := map[string]bool{}
+	bases := map[string]bool{}
+	var defaults []string
+	for i, profile := range c.Profiles {
+		if profile.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: profile %d has no name", c.File, i+1))
+			continue
+		}
+		if names[profile.Name] {
+			errs = append(errs, fmt.Errorf("%s: profile '%s' is defined more than once", c.File, profile.Name))
+		}
+		names[profile.Name] = true
+		bases[profile.Extends] = true
+		if profile.Default {
+			defaults = append(defaults, profile.Name)
+		}
+	}
+	if len(defaults) > 1 {
+		errs = append(errs, fmt.Errorf("%s: only one profile can be the default, found %q", c.File, defaults))
+	}
+
+	for _, profile := range c.Profiles {
+		if profile.Name == "" {
+			continue
+		}
+		resolved, err := c.resolve(profile)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// a base profile only needs a key when it is used on its own
+		for _, err := range resolved.validate(!bases[profile.Name]) {
+			errs = append(errs, fmt.Errorf("%s: profile '%s': %w", c.File, profile.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Profile) validate(needsKey bool) []error {
+	var errs []error
+	if needsKey && p.DefaultKey == "" && p.KeyFingerprint == "" && p.RecipientFile == "" {
+		errs = append(errs, fmt.Errorf("no key, set default_key, key_fingerprint or recipient_file"))
+	}
+	paths := [][2]string{
+		{"gnupg_home", p.GnupgHome},
+		{"default_pub_ring", p.DefaultPubRing},
+		{"default_sec_ring", p.DefaultSecRing},
+		{"recipient_file", p.RecipientFile},
+	}
+	for _, path := range paths {
+		if utils.ContainsDirectoryTraversal(path[1]) {
+			errs = append(errs, fmt.Errorf("%s: directory traversal detected in %s", path[0], path[1]))
+		}
+	}
+	errs = append(errs, p.Defaults.validate()...)
+	switch p.SignaturePolicy {
+	case "", pki.SignaturesIgnore, pki.SignaturesWarn, pki.SignaturesRequire:
+	default:
+		errs = append(errs, fmt.Errorf("unknown signature_policy '%s', use ignore, warn or require", p.SignaturePolicy))
+	}
+	if p.ExpiryWarningDays != nil && *p.ExpiryWarningDays < 0 {
+		errs = append(errs, fmt.Errorf("expiry_warning_days cannot be negative"))
+	}
+	if _, err := p.Crypto.Config(); err != nil {
+		errs = append(errs, fmt.Errorf("crypto: %w", err))
+	}
+
+	return errs
+}
+
+// Profile returns the named profile, or the default profile when name is empty, with the
+// values it inherits filled in. nil is returned when no name is given and there is no
+// default profile.
+func (c *Config) Profile(name string) (*Profile, error) {
+	for _, profile := range c.Profiles {
+		if (name == "" && profile.Default) || (name != "" && profile.Name == name) {
+			resolved, err := c.resolve(profile)
+			if err != nil {
+				return nil, err
+			}
+			return &resolved, nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("profile '%s' is not in %s", name, c.File)
+	}
+	return nil, nil
+}
+
+// resolve fills in the values a profile inherits from the profiles it extends
+func (c *Config) resolve(profile Profile) (Profile, error) {
+	seen := map[string]bool{profile.Name: true}
+	for base := profile.Extends; base != ""; {
+		if seen[base] {
+			return profile, fmt.Errorf("%s: profile '%s' extends itself through '%s'", c.File, profile.Name, base)
+		}
+		seen[base] = true
+
+		var found *Profile
+		for i := range c.Profiles {
+			if c.Profiles[i].Name == base {
+				found = &c.Profiles[i]
+				break
+			}
+		}
+		if found == nil {
+			return profile, fmt.Errorf("%s: profile '%s' extends unknown profile '%s'", c.File, profile.Name, base)
+		}
+		profile = profile.inherit(*found)
+		base = found.Extends
+	}
+	return profile, nil
+}
+
+// inherit returns the profile with the values it leaves empty taken from base, the
+// name, default, extends and key of a profile are its own
+func (p Profile) inherit(base Profile) Profile {
+	base.Name, base.Default, base.Extends = p.Name, p.Default, p.Extends
+	// the key is chosen as a whole, a profile naming its own key takes none of the base's
+	if p.DefaultKey != "" || p.KeyFingerprint != "" || p.RecipientFile != "" {
+		base.DefaultKey, base.KeyFingerprint, base.RecipientFile = "", "", ""
+	}
+	fillEmpty(reflect.ValueOf(&p).Elem(), reflect.ValueOf(base))
+	return p
+}
+
+// fillEmpty sets the zero fields of dst to those of src, embedded structs are filled
+// field by field and other values are taken whole
+func fillEmpty(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Field(i)
+		switch {
+		case dst.Type().Field(i).Anonymous:
+			fillEmpty(field, src.Field(i))
+		case field.IsZero():
+			field.Set(src.Field(i))
+		}
+	}
+}
+
+// PubRing is the public key ring of the profile, default_pub_ring or pubring.gpg in
+// gnupg_home, empty when the profile names neither
+func (p *Profile) PubRing() string {
+	if p.DefaultPubRing != "" {
+		return p.DefaultPubRing
+	}
+	if p.GnupgHome != "" {
+		return filepath.Join(p.GnupgHome, "pubring.gpg")
+	}
+	return ""
+}
+
+// SecRing is the secret key ring of the profile, default_sec_ring or secring.gpg in
+// gnupg_home, empty when the profile names neither
+func (p *Profile) SecRing() string {
+	if p.DefaultSecRing != "" {
+		return p.DefaultSecRing
+	}
+	if p.GnupgHome != "" {
+		return filepath.Join(p.GnupgHome, "secring.gpg")
+	}
+	return ""
+}
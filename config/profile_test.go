@@ -0,0 +1,237 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// TestLoadConfig tests that all documented fields are read and the rings are resolved
+func TestLoadConfig(t *testing.T) {
+	t.Parallel()
+	file := writeConfig(t, `profiles:
+  - name: dev
+    default: true
+    default_key: Dev Salt Master
+    gnupg_home: ~/.gnupg
+  - name: prod
+    default_key: Prod Salt Master
+    key_fingerprint: 4CCC209C2087ECF97D1AD177E78ADB0AF03CE5DD
+    gnupg_home: ~/.gnupg
+    default_pub_ring: /etc/salt/gpgkeys/pubring.asc
+    default_sec_ring: /etc/salt/gpgkeys/secring.asc
+    backend: agent
+    expiry_warning_days: 0
+    signature_policy: require
+    trusted_signers:
+      - Prod Release Signer
+    crypto:
+      cipher: aes256
+      compression_level: 9
+`)
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := cfg.Profile("")
+	if err != nil || dev == nil || dev.Name != "dev" {
+		t.Fatalf("expected the default profile, got %v, %v", dev, err)
+	}
+	if dev.PubRing() != "~/.gnupg/pubring.gpg" || dev.SecRing() != "~/.gnupg/secring.gpg" {
+		t.Errorf("expected the rings in gnupg_home, got %s and %s", dev.PubRing(), dev.SecRing())
+	}
+	if dev.ExpiryWarningDays != nil {
+		t.Errorf("expected no expiry warning days, got %d", *dev.ExpiryWarningDays)
+	}
+
+	prod, err := cfg.Profile("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prod.PubRing() != "/etc/salt/gpgkeys/pubring.asc" || prod.SecRing() != "/etc/salt/gpgkeys/secring.asc" {
+		t.Errorf("expected the default rings, got %s and %s", prod.PubRing(), prod.SecRing())
+	}
+	if prod.ExpiryWarningDays == nil || *prod.ExpiryWarningDays != 0 {
+		t.Errorf("expected the expiry warning to be off")
+	}
+	if prod.Crypto.Cipher != "aes256" || prod.Crypto.CompressionLevel != 9 || len(prod.TrustedSigners) != 1 {
+		t.Errorf("unexpected profile %+v", prod)
+	}
+
+	if _, err = cfg.Profile("stage"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+
+	cfg, err = LoadConfig(writeConfig(t, ""))
+	if err != nil || len(cfg.Profiles) != 0 {
+		t.Errorf("expected an empty config, got %v, %v", cfg, err)
+	}
+	if prof, err := cfg.Profile(""); prof != nil || err != nil {
+		t.Errorf("expected no default profile, got %v, %v", prof, err)
+	}
+}
+
+// TestValidateConfig tests that every problem in the config file is reported
+func TestValidateConfig(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		content string
+		want    string
+	}{
+		"unknown key":      {"profiles:\n  - name: dev\n    default_key: Dev\n    colour: red\n", "line 4: unknown key 'colour'"},
+		"no name":          {"profiles:\n  - default_key: Dev\n", "profile 1 has no name"},
+		"no key":           {"profiles:\n  - name: dev\n    gnupg_home: ~/.gnupg\n", "profile 'dev': no key"},
+		"duplicate":        {"profiles:\n  - name: dev\n    default_key: Dev\n  - name: dev\n    default_key: Dev\n", "defined more than once"},
+		"several defaults": {"profiles:\n  - name: dev\n    default: true\n    default_key: Dev\n  - name: prod\n    default: true\n    default_key: Prod\n", "only one profile can be the default"},
+		"bad backend":      {"profiles:\n  - name: dev\n    default_key: Dev\n    backend: gpg\n", "unknown backend 'gpg'"},
+		"bad policy":       {"profiles:\n  - name: dev\n    default_key: Dev\n    signature_policy: always\n", "unknown signature_policy 'always'"},
+		"bad crypto":       {"profiles:\n  - name: dev\n    default_key: Dev\n    crypto:\n      cipher: rot13\n", "crypto:"},
+		"traversal":        {"profiles:\n  - name: dev\n    default_key: Dev\n    gnupg_home: ../keys\n", "gnupg_home: directory traversal"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, tt.content))
+			if cfg == nil {
+				t.Fatal(err)
+			}
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestProfileExtends tests that profiles inherit the values they leave empty
+func TestProfileExtends(t *testing.T) {
+	t.Parallel()
+	cfg, err := LoadConfig(writeConfig(t, `profiles:
+  - name: base
+    gnupg_home: /etc/salt/gpgkeys
+    element: secure
+    jobs: 4
+    exclude:
+      - "**/vendor/**"
+    crypto:
+      cipher: aes256
+  - name: prod
+    extends: base
+    default_key: Prod Salt Master
+    key_fingerprint: 4CCC209C2087ECF97D1AD177E78ADB0AF03CE5DD
+    recipients:
+      - Break Glass
+  - name: prod-eu
+    default: true
+    extends: prod
+    element: secure_eu
+  - name: stage
+    extends: prod
+    default_key: Stage Salt Master
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := cfg.Profile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof.Name != "prod-eu" || !prof.Default || prof.Extends != "prod" {
+		t.Errorf("expected the profile's own name, default and extends, got %+v", prof)
+	}
+	if prof.DefaultKey != "Prod Salt Master" || prof.PubRing() != "/etc/salt/gpgkeys/pubring.gpg" || prof.Crypto.Cipher != "aes256" {
+		t.Errorf("expected the keys and crypto settings of the bases, got %+v", prof)
+	}
+	if prof.Element != "secure_eu" || prof.Jobs != 4 || len(prof.Recipients) != 1 || len(prof.Exclude) != 1 {
+		t.Errorf("expected the defaults to be inherited, got %+v", prof.Defaults)
+	}
+
+	base, err := cfg.Profile("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.DefaultKey != "" || base.Default {
+		t.Errorf("expected the base profile to be unchanged, got %+v", base)
+	}
+
+	stage, err := cfg.Profile("stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage.DefaultKey != "Stage Salt Master" || stage.KeyFingerprint != "" {
+		t.Errorf("expected only the profile's own key, got %+v", stage)
+	}
+
+	repoDefaults := Defaults{Element: "pillar", Include: []string{"prod/**"}}
+	merged := repoDefaults.Over(prof.Defaults)
+	if merged.Element != "pillar" || merged.Jobs != 4 || merged.Include[0] != "prod/**" || merged.Exclude[0] != "**/vendor/**" {
+		t.Errorf("expected the repository defaults over the profile, got %+v", merged)
+	}
+}
+
+// TestProfileExtendsErrors tests that missing and circular bases are reported
+func TestProfileExtendsErrors(t *testing.T) {
+	t.Parallel()
+	tests := map[string]struct {
+		content string
+		want    string
+	}{
+		"unknown base": {"profiles:\n  - name: dev\n    default_key: Dev\n    extends: base\n", "extends unknown profile 'base'"},
+		"cycle":        {"profiles:\n  - name: a\n    default_key: A\n    extends: b\n  - name: b\n    extends: a\n", "extends itself"},
+		"base key":     {"profiles:\n  - name: base\n    jobs: 2\n  - name: dev\n    extends: base\n", "profile 'dev': no key"},
+		"bad jobs":     {"profiles:\n  - name: dev\n    default_key: Dev\n    jobs: -1\n", "jobs cannot be negative"},
+		"bad glob":     {"profiles:\n  - name: dev\n    default_key: Dev\n    include: ['[']\n", "bad glob"},
+		"bad log":      {"profiles:\n  - name: dev\n    default_key: Dev\n    log_level: loud\n", "unknown log level 'loud'"},
+		"bad output":   {"profiles:\n  - name: dev\n    default_key: Dev\n    output: xml\n", "unknown output format 'xml'"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package config reads the repository config file that maps pillar files to profiles
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/glob"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// RepoFile is the name of the repository config file, looked for in the directory of a
+// pillar file and its parents
+const RepoFile = ".gsp.yaml"
+
+// Rule selects a profile for the files matching a glob
+type Rule struct {
+	// Path is a slash separated glob relative to the repository config file, ** matches
+	// any number of directories
+	Path    string `yaml:"path"`
+	Profile string `yaml:"profile"`
+}
+
+// Repo is a repository config file
+type Repo struct {
+	// File is the path of the config file, rule paths are relative to its directory
+	File  string `yaml:"-"`
+	Rules []Rule `yaml:"rules"`
+	// Defaults apply to commands run in the repository, over those of the profile
+	Defaults Defaults `yaml:"defaults,omitempty"`
+}
+
+// FindRepo looks for a repository config file in dir and its parents, nil is returned
+// when there is none
+func FindRepo(dir string) (*Repo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		file := filepath.Join(dir, RepoFile)
+		if _, err := os.Stat(file); err == nil {
+			return LoadRepo(file)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// LoadRepo reads a repository config file, unknown keys and incomplete rules are errors
+func LoadRepo(file string) (*Repo, error) {
+	buf, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &Repo{File: file}
+	dec := yamlv3.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err = dec.Decode(repo); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot read %s: %w", file, err)
+	}
+
+	for i, rule := range repo.Rules {
+		if rule.Path == "" || rule.Profile == "" {
+			return nil, fmt.Errorf("%s: rule %d needs a path and a profile", file, i+1)
+		}
+		if _, err = path.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("%s: rule %d has a bad path '%s': %w", file, i+1, rule.Path, err)
+		}
+	}
+
+	if errs := repo.Defaults.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("%s: defaults: %w", file, errors.Join(errs...))
+	}
+
+	return repo, nil
+}
+
+// ProfileFor returns the profile of the first rule matching the file, files outside
+// the repository match no rule
+func (r *Repo) ProfileFor(file string) (string, bool) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Dir(r.File), file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	for _, rule := range r.Rules {
+		if glob.Match(rule.Path, filepath.ToSlash(rel)) {
+			return rule.Profile, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFindRepo tests that the config file is found from nested directories and rules are applied in order
+func TestFindRepo(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	nested := filepath.Join(root, "pillar", "prod", "app")
+	if err := os.MkdirAll(nested, 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := "rules:\n  - path: pillar/prod/**\n    profile: prod\n  - path: pillar/**\n    profile: dev\n"
+	if err := os.WriteFile(filepath.Join(root, RepoFile), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := FindRepo(nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo == nil {
+		t.Fatal("expected to find the repository config")
+	}
+
+	tests := map[string]string{
+		filepath.Join(nested, "db.sls"):                  "prod",
+		filepath.Join(root, "pillar", "dev", "db.sls"):   "dev",
+		filepath.Join(root, "other", "db.sls"):           "",
+		filepath.Join(filepath.Dir(root), "outside.sls"): "",
+	}
+	for file, want := range tests {
+		got, _ := repo.ProfileFor(file)
+		if got != want {
+			t.Errorf("ProfileFor(%s) = %q, want %q", file, got, want)
+		}
+	}
+
+	repo, err = FindRepo(filepath.Dir(root))
+	if err != nil || repo != nil {
+		t.Errorf("expected no repository config above the root, got %v, %v", repo, err)
+	}
+}
+
+// TestLoadRepoErrors tests that unknown keys and incomplete rules are rejected
+func TestLoadRepoErrors(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"unknown key":     "rulez:\n  - path: pillar/**\n    profile: prod\n",
+		"missing profile": "rules:\n  - path: pillar/**\n",
+		"bad glob":        "rules:\n  - path: 'pillar/[/**'\n    profile: prod\n",
+		"bad defaults":    "defaults:\n  backend: gpg\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), RepoFile)
+			if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadRepo(file); err == nil {
+				t.Errorf("expected an error for %s", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package glob matches slash separated paths against globs where ** spans directories
+package glob
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Filter keeps the files matching one of the include globs, or all of them when
+// there are none, that match none of the exclude globs. The globs are matched against the
+// slash separated path of each file relative to searchDir.
+func Filter(searchDir string, files []string, include []string, exclude []string) []string {
+	if len(include) == 0 && len(exclude) == 0 {
+		return files
+	}
+	searchDir, err := filepath.Abs(searchDir)
+	if err != nil {
+		return nil
+	}
+
+	var kept []string
+	for _, file := range files {
+		rel, err := filepath.Rel(searchDir, file)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if (len(include) == 0 || matchAny(include, rel)) && !matchAny(exclude, rel) {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether a slash separated name matches a glob, ** matches any number
+// of directories and the other patterns are those of path.Match
+func Match(pattern string, name string) bool {
+	return matchParts(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchParts(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
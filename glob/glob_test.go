@@ -0,0 +1,78 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package glob
+
+import "testing"
+
+// TestMatch tests globs with and without ** segments
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"pillar/prod/**", "pillar/prod/db.sls", true},
+		{"pillar/prod/**", "pillar/prod/nested/db.sls", true},
+		{"pillar/prod/**", "pillar/production/db.sls", false},
+		{"pillar/prod/*.sls", "pillar/prod/nested/db.sls", false},
+		{"pillar/**/secrets.sls", "pillar/secrets.sls", true},
+		{"pillar/**/secrets.sls", "pillar/a/b/secrets.sls", true},
+		{"**/*.sls", "db.sls", true},
+		{"pillar/dev/*.sls", "pillar/dev/db.sls", true},
+		{"pillar/dev", "pillar/dev/db.sls", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFilter tests that include and exclude globs are relative to the directory
+func TestFilter(t *testing.T) {
+	t.Parallel()
+	dir := "/srv/pillar"
+	files := []string{
+		"/srv/pillar/prod/db.sls",
+		"/srv/pillar/prod/vendor/lib.sls",
+		"/srv/pillar/dev/db.sls",
+		"/srv/pillar/top.sls",
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    int
+	}{
+		{"no globs", nil, nil, 4},
+		{"include", []string{"prod/**"}, nil, 2},
+		{"exclude", nil, []string{"**/vendor/**", "top.sls"}, 2},
+		{"include and exclude", []string{"prod/**", "dev/**"}, []string{"**/vendor/**"}, 2},
+	}
+	for _, tt := range tests {
+		if got := Filter(dir, files, tt.include, tt.exclude); len(got) != tt.want {
+			t.Errorf("%s: got %v, want %d files", tt.name, got, tt.want)
+		}
+	}
+}
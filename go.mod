@@ -11,8 +11,8 @@ require (
 	github.com/rs/zerolog v1.31.0
 	github.com/ryboe/q v1.0.19
 	github.com/spf13/cobra v1.6.1
-	github.com/spf13/viper v1.15.0
-	gopkg.in/mattes/go-expand-tilde.v1 v1.0.0-20150330173918-cb884138e64c
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/sys v0.12.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -21,25 +21,13 @@ require (
 	github.com/edlitmus/to v0.0.0-20231025141937-dd8488388a59 // indirect
 	github.com/esilva-everbridge/dig v0.0.0-20230222145646-42ad4ced5ae3 // indirect
 	github.com/esilva-everbridge/to v0.0.0-20220524174750-493ecaf861c8 // indirect
-	github.com/fsnotify/fsnotify v1.6.0 // indirect
-	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
-	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/mozilla-services/yaml v0.0.0-20201007153854-c369669a6625 // indirect
-	github.com/pelletier/go-toml/v2 v2.0.6 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/sergi/go-diff v1.3.1 // indirect
-	github.com/spf13/afero v1.9.3 // indirect
-	github.com/spf13/cast v1.5.0 // indirect
-	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/subosito/gotenv v1.4.2 // indirect
-	golang.org/x/sys v0.12.0 // indirect
-	golang.org/x/text v0.5.0 // indirect
-	gopkg.in/ini.v1 v1.67.0 // indirect
+	github.com/stretchr/testify v1.8.1 // indirect
 )
@@ -0,0 +1,242 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package gsp encrypts, decrypts and rotates the values of Salt pillar files from Go
+// programs. Its exported API follows semantic versioning with the module: within a major
+// version functions and options are only added, never changed or removed.
+//
+// Every function takes the keys and selectors as options, and stops with ctx.Err() once
+// the context is done. The functions are safe to call from several goroutines, keys given
+// WithPki are shared rather than copied. A file with include directives is not processed and
+// sls.ErrIncludeDirective is returned, a missing YAML path returns sls.ErrPathNotFound.
+package gsp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Everbridge/generate-secure-pillar/glob"
+	"github.com/Everbridge/generate-secure-pillar/sls"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+)
+
+// Action is applied to the values of a file
+type Action string
+
+const (
+	// ActionEncrypt encrypts the plain text values
+	ActionEncrypt Action = sls.Encrypt
+	// ActionDecrypt decrypts the encrypted values
+	ActionDecrypt Action = sls.Decrypt
+	// ActionRotate re-encrypts the encrypted values to the current keys
+	ActionRotate Action = sls.Rotate
+)
+
+// Encrypt reads a pillar file from r and writes it to w with its plain text values encrypted
+func Encrypt(ctx context.Context, r io.Reader, w io.Writer, opts ...Option) error {
+	return stream(ctx, r, w, ActionEncrypt, opts)
+}
+
+// Decrypt reads a pillar file from r and writes it to w with its values decrypted
+func Decrypt(ctx context.Context, r io.Reader, w io.Writer, opts ...Option) error {
+	return stream(ctx, r, w, ActionDecrypt, opts)
+}
+
+// EncryptBytes returns the pillar file with its plain text values encrypted
+func EncryptBytes(ctx context.Context, data []byte, opts ...Option) ([]byte, error) {
+	return apply(ctx, data, ActionEncrypt, opts)
+}
+
+// DecryptBytes returns the pillar file with its values decrypted
+func DecryptBytes(ctx context.Context, data []byte, opts ...Option) ([]byte, error) {
+	return apply(ctx, data, ActionDecrypt, opts)
+}
+
+// Rotate returns the pillar file with its values re-encrypted to the current keys, or
+// only those encrypted to the keys given WithRotateFrom
+func Rotate(ctx context.Context, data []byte, opts ...Option) ([]byte, error) {
+	return apply(ctx, data, ActionRotate, opts)
+}
+
+// EncryptFile encrypts the plain text values of a pillar file in place
+func EncryptFile(ctx context.Context, file string, opts ...Option) error {
+	return applyFile(ctx, file, ActionEncrypt, newOptions(ActionEncrypt, opts))
+}
+
+// DecryptFile decrypts the values of a pillar file in place
+func DecryptFile(ctx context.Context, file string, opts ...Option) error {
+	return applyFile(ctx, file, ActionDecrypt, newOptions(ActionDecrypt, opts))
+}
+
+// GetPath returns the decrypted value at a colon separated YAML path, a plain text value
+// is returned as it is
+func GetPath(ctx context.Context, data []byte, path string, opts ...Option) (string, error) {
+	s, err := load(ctx, data, newOptions(ActionDecrypt, opts))
+	if err != nil {
+		return "", err
+	}
+	vals := s.GetValueFromPath(path)
+	if vals == nil {
+		return "", fmt.Errorf("%w: '%s'", sls.ErrPathNotFound, path)
+	}
+	switch vals.(type) {
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("'%s' is not a single value", path)
+	}
+	val, err := s.ProcessValuesAt(vals, sls.Decrypt, path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v", val), nil
+}
+
+// SetPath returns the pillar file with the value encrypted and set at a colon separated
+// YAML path, the path is created when missing. An empty file starts a new one.
+func SetPath(ctx context.Context, data []byte, path string, value string, opts ...Option) ([]byte, error) {
+	s, err := load(ctx, data, newOptions(ActionEncrypt, opts))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.ProcessYaml([]string{path}, []string{value}); err != nil {
+		return nil, err
+	}
+	buf, err := s.FormatBuffer(sls.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), ctx.Err()
+}
+
+// WalkDir applies an action in place to every .sls file under a directory, selected
+// WithInclude and WithExclude. Files with include directives are skipped, and a rotation
+// limited WithRotateFrom leaves the files it changes nothing in untouched. The walk stops
+// at the first error, files already processed stay written.
+func WalkDir(ctx context.Context, dir string, action Action, opts ...Option) error {
+	o := newOptions(action, opts)
+	files, _, err := utils.FindFilesByExt(dir, ".sls")
+	if err != nil {
+		return err
+	}
+	// the keys are loaded once for the whole directory
+	if o.keys, err = o.pki(); err != nil {
+		return err
+	}
+	for _, file := range glob.Filter(dir, files, o.include, o.exclude) {
+		err = applyFile(ctx, file, action, o)
+		if errors.Is(err, sls.ErrIncludeDirective) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stream(ctx context.Context, r io.Reader, w io.Writer, action Action, opts []Option) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	out, err := apply(ctx, data, action, opts)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func apply(ctx context.Context, data []byte, action Action, opts []Option) ([]byte, error) {
+	s, err := load(ctx, data, newOptions(action, opts))
+	if err != nil {
+		return nil, err
+	}
+	buf, err := s.PerformAction(string(action))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), ctx.Err()
+}
+
+func applyFile(ctx context.Context, file string, action Action, o *options) error {
+	s, err := newSls(ctx, file, o)
+	if err != nil {
+		return err
+	}
+	buf, err := s.PerformAction(string(action))
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if action == ActionRotate && len(o.rotateFrom) > 0 && s.Rotated == 0 {
+		// nothing was encrypted to the old keys, leave the file alone
+		return nil
+	}
+	// a cancelled operation writes nothing
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	_, err = s.WriteFile(buf, file)
+	return err
+}
+
+// load reads pillar file data with the keys and selectors of the options
+func load(ctx context.Context, data []byte, o *options) (*sls.Sls, error) {
+	s, err := newSls(ctx, "", o)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err = s.ReadBytes(data); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func newSls(ctx context.Context, file string, o *options) (*sls.Sls, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p, err := o.pki()
+	if err != nil {
+		return nil, err
+	}
+	s, err := sls.NewWithOptions(sls.Options{
+		FilePath:       file,
+		Pki:            p,
+		EncryptionPath: o.element,
+		Logger:         o.logger,
+		Audit:          o.audit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range o.rotateFrom {
+		ids, err := p.KeyIDs(key)
+		if err != nil {
+			return nil, err
+		}
+		s.RotateFrom = append(s.RotateFrom, ids...)
+	}
+	return &s, nil
+}
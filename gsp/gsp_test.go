@@ -0,0 +1,309 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/sls"
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/packet"
+)
+
+var keys []Option
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gsp")
+	if err != nil {
+		panic(err)
+	}
+	entity, err := pki.GenerateKey("GSP Test Key", "", "gsp@example.com", nil)
+	if err != nil {
+		panic(err)
+	}
+	files, err := pki.WriteKeyFiles(entity, dir)
+	if err != nil {
+		panic(err)
+	}
+	keys = []Option{WithKey("GSP Test Key"), WithKeyRings(files.PublicKeyRing, files.SecretKeyRing)}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestEncryptDecryptBytes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	plain := []byte("#!yaml|gpg\n\ndb:\n    password: hunter2\n")
+
+	encrypted, err := EncryptBytes(ctx, plain, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encrypted), "hunter2") || !strings.Contains(string(encrypted), pki.PGPHeader) {
+		t.Fatalf("value was not encrypted:\n%s", encrypted)
+	}
+
+	decrypted, err := DecryptBytes(ctx, encrypted, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != string(plain) {
+		t.Errorf("got\n%s\nwant\n%s", decrypted, plain)
+	}
+
+	rotated, err := Rotate(ctx, encrypted, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := GetPath(ctx, rotated, "db:password", keys...); err != nil || value != "hunter2" {
+		t.Errorf("GetPath after rotate = %q, %v", value, err)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	data, err := SetPath(ctx, nil, "db:password", "hunter2", keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Fatalf("value was not encrypted:\n%s", data)
+	}
+
+	value, err := GetPath(ctx, data, "db:password", keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "hunter2" {
+		t.Errorf("got %q, want hunter2", value)
+	}
+
+	if _, err = GetPath(ctx, data, "db:user", keys...); !errors.Is(err, sls.ErrPathNotFound) {
+		t.Errorf("got %v, want %v", err, sls.ErrPathNotFound)
+	}
+	if _, err = GetPath(ctx, data, "db", keys...); err == nil {
+		t.Error("expected an error getting a map")
+	}
+}
+
+func TestExpiredKey(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// a key that expired an hour after it was created two days ago
+	created := time.Now().Add(-48 * time.Hour)
+	keyConfig := &packet.Config{RSABits: 2048, Time: func() time.Time { return created }}
+	entity, err := openpgp.NewEntity("GSP Expired Key", "", "", keyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifetime := uint32(3600)
+	for _, ident := range entity.Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	if err = entity.SerializePrivate(io.Discard, keyConfig); err != nil {
+		t.Fatal(err)
+	}
+	files, err := pki.WriteKeyFiles(entity, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := []Option{WithKey("GSP Expired Key"), WithKeyRings(files.PublicKeyRing, files.SecretKeyRing)}
+	plain := []byte("#!yaml|gpg\n\npassword: hunter2\n")
+
+	// only encrypting refuses the key
+	if _, err = EncryptBytes(ctx, plain, expired...); err == nil {
+		t.Fatal("expected encrypting to an expired key to fail")
+	}
+	encrypted, err := EncryptBytes(ctx, plain, WithKeyOptions(pki.Options{PgpKeyName: "GSP Expired Key",
+		PublicKeyRing: files.PublicKeyRing, SecretKeyRing: files.SecretKeyRing, AllowInvalidKey: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := DecryptBytes(ctx, encrypted, expired...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != string(plain) {
+		t.Errorf("got\n%s\nwant\n%s", decrypted, plain)
+	}
+	if value, err := GetPath(ctx, encrypted, "password", expired...); err != nil || value != "hunter2" {
+		t.Errorf("GetPath = %q, %v", value, err)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	prod := write("prod/db.sls", "#!yaml|gpg\n\npassword: hunter2\n")
+	vendor := write("vendor/lib.sls", "#!yaml|gpg\n\npassword: hunter2\n")
+	include := write("top.sls", "include:\n  - prod.db\n")
+
+	// a cancelled walk writes nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WalkDir(ctx, dir, ActionEncrypt, keys...); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	assertEncrypted(t, prod, false)
+
+	opts := append([]Option{WithExclude("vendor/**")}, keys...)
+	if err := WalkDir(context.Background(), dir, ActionEncrypt, opts...); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, prod, true)
+	assertEncrypted(t, vendor, false)
+
+	if err := EncryptFile(context.Background(), include, keys...); !errors.Is(err, sls.ErrIncludeDirective) {
+		t.Errorf("got %v, want %v", err, sls.ErrIncludeDirective)
+	}
+
+	if err := DecryptFile(context.Background(), prod, keys...); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, prod, false)
+}
+
+func TestSharedPki(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	p, err := newOptions(ActionEncrypt, keys).pki()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := fmt.Sprintf("secret-%d", i)
+			data, err := SetPath(ctx, nil, "value", value, WithPki(p))
+			if err == nil {
+				var got string
+				if got, err = GetPath(ctx, data, "value", WithPki(p)); err == nil && got != value {
+					err = fmt.Errorf("got %q, want %q", got, value)
+				}
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func assertEncrypted(t *testing.T, file string, encrypted bool) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), pki.PGPHeader) != encrypted {
+		t.Errorf("%s: encrypted should be %v:\n%s", file, encrypted, data)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "audit.jsonl")
+	log, err := audit.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	opts := append([]Option{WithAuditLog(log)}, keys...)
+
+	file := filepath.Join(dir, "db.sls")
+	if err = os.WriteFile(file, []byte("#!yaml|gpg\n\ndb:\n    password: hunter2\n    user: app\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = EncryptFile(ctx, file, opts...); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetPath(ctx, data, "db:password", opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "hunter2") {
+		t.Fatalf("the audit log has a plain text value:\n%s", buf)
+	}
+	var operations []string
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var e audit.Entry
+		if err = json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Operation != audit.Write && (e.Path == "" || e.KeyFingerprint == "" || e.CipherTextHash == "") {
+			t.Errorf("expected the path, key and ciphertext hash of a value: %s", line)
+		}
+		operations = append(operations, e.Operation)
+	}
+	sort.Strings(operations[:2])
+	if got := strings.Join(operations, ","); got != "encrypt,encrypt,write,decrypt" {
+		t.Errorf("got operations %s", got)
+	}
+	if count, err := audit.Verify(strings.NewReader(string(buf))); err != nil || count != 4 {
+		t.Errorf("expected 4 chained entries, got %d: %v", count, err)
+	}
+}
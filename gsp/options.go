@@ -0,0 +1,161 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gsp
+
+import (
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/rs/zerolog"
+)
+
+// Option sets the keys used, or selects the values or files an operation works on
+type Option func(*options)
+
+type options struct {
+	keys       *pki.Pki
+	keyOptions pki.Options
+	element    string
+	rotateFrom []string
+	include    []string
+	exclude    []string
+	logger     *zerolog.Logger
+	audit      *audit.Log
+	// encrypting operations refuse an invalid key unless allowed, the others only warn so
+	// that an expired key can still read what it encrypted
+	encrypting bool
+}
+
+func newOptions(action Action, opts []Option) *options {
+	o := &options{
+		encrypting: action != ActionDecrypt,
+		keyOptions: pki.Options{
+			PublicKeyRing: "~/.gnupg/pubring.gpg",
+			SecretKeyRing: "~/.gnupg/secring.gpg",
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithKey names the key values are encrypted to, by name, email or ID
+func WithKey(name string) Option {
+	return func(o *options) {
+		o.keyOptions.PgpKeyName = name
+	}
+}
+
+// WithKeyFingerprint pins the key values are encrypted to by its full fingerprint
+func WithKeyFingerprint(fingerprint string) Option {
+	return func(o *options) {
+		o.keyOptions.KeyFingerprint = fingerprint
+	}
+}
+
+// WithKeyRings sets the public and secret key rings, ~/.gnupg/pubring.gpg and
+// ~/.gnupg/secring.gpg are used otherwise
+func WithKeyRings(publicKeyRing string, secretKeyRing string) Option {
+	return func(o *options) {
+		o.keyOptions.PublicKeyRing = publicKeyRing
+		o.keyOptions.SecretKeyRing = secretKeyRing
+	}
+}
+
+// WithRecipients names more keys in the public key ring values are encrypted to
+func WithRecipients(names ...string) Option {
+	return func(o *options) {
+		o.keyOptions.Recipients = append(o.keyOptions.Recipients, names...)
+	}
+}
+
+// WithKeyOptions sets every key option at once, see pki.Options
+func WithKeyOptions(keyOptions pki.Options) Option {
+	return func(o *options) {
+		o.keyOptions = keyOptions
+	}
+}
+
+// WithPki uses keys that are already loaded, the other key options are then ignored.
+// Loading the key rings once and passing them to each call saves reading them every time.
+func WithPki(p *pki.Pki) Option {
+	return func(o *options) {
+		o.keys = p
+	}
+}
+
+// WithLogger logs to the given logger, by default warnings and written files are logged
+// to STDERR
+func WithLogger(logger zerolog.Logger) Option {
+	return func(o *options) {
+		o.logger = &logger
+	}
+}
+
+// WithAuditLog records the values encrypted, decrypted or rotated and the files written
+// in the audit log, which can be shared between calls
+func WithAuditLog(log *audit.Log) Option {
+	return func(o *options) {
+		o.audit = log
+	}
+}
+
+// WithElement limits an operation to the values under a top level element
+func WithElement(element string) Option {
+	return func(o *options) {
+		o.element = element
+	}
+}
+
+// WithRotateFrom limits a rotation to the values encrypted to one of the named keys
+func WithRotateFrom(keys ...string) Option {
+	return func(o *options) {
+		o.rotateFrom = append(o.rotateFrom, keys...)
+	}
+}
+
+// WithInclude limits WalkDir to the files matching one of the globs, relative to the
+// directory, ** matches any number of directories
+func WithInclude(globs ...string) Option {
+	return func(o *options) {
+		o.include = append(o.include, globs...)
+	}
+}
+
+// WithExclude skips the files WalkDir finds matching one of the globs
+func WithExclude(globs ...string) Option {
+	return func(o *options) {
+		o.exclude = append(o.exclude, globs...)
+	}
+}
+
+// pki returns the keys to use
+func (o *options) pki() (*pki.Pki, error) {
+	if o.keys != nil {
+		return o.keys, nil
+	}
+	keyOptions := o.keyOptions
+	if o.logger != nil {
+		keyOptions.Logger = o.logger
+	}
+	keyOptions.AllowInvalidKey = keyOptions.AllowInvalidKey || !o.encrypting
+	return pki.NewWithOptions(keyOptions)
+}
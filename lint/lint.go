@@ -0,0 +1,245 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package lint finds plain text secrets left in pillar files
+package lint
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/Everbridge/generate-secure-pillar/utils"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Rule describes a check made on pillar files
+type Rule struct {
+	ID          string
+	Description string
+}
+
+// Finding is a possible problem found in a pillar file, it never includes the secret itself
+type Finding struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Path    string `json:"path"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Rules are all the checks made, in the order they are applied to a value
+var Rules = []Rule{
+	{"private-key", "plain text PEM private key"},
+	{"aws-access-key", "plain text AWS access key ID"},
+	{"jwt", "plain text JSON Web Token"},
+	{"secret-name", "plain text value under a key name that looks secret"},
+	{"high-entropy", "plain text value that looks randomly generated"},
+	{"missing-gpg-renderer", "file contains PGP messages but lacks the #!yaml|gpg renderer line"},
+}
+
+var (
+	privateKeyPattern = regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)
+	awsKeyPattern     = regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)
+	jwtPattern        = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	secretNamePattern = regexp.MustCompile(`(?i)(pass(word|wd|phrase)?|secret|token|api[_-]?key|private[_-]?key|access[_-]?key|credential)`)
+	// auth is only a secret name as a word of its own, not in author or oauth_client_id
+	authNamePattern  = regexp.MustCompile(`(?i)(^|[^a-z])auth([^a-z]|$)`)
+	camelCasePattern = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+	hexPattern       = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+// Dir lints every file with the given extension under a directory,
+// files that cannot be read or parsed are returned in the error but do not stop the walk
+func Dir(searchDir string, fileExt string) ([]Finding, error) {
+	files, _, err := utils.FindFilesByExt(searchDir, fileExt)
+	if err != nil {
+		return nil, err
+	}
+	return Files(files)
+}
+
+// Files lints each of the files, files that cannot be read or parsed are returned in
+// the error but do not stop the others being linted
+func Files(files []string) ([]Finding, error) {
+	var findings []Finding
+	var errs []error
+
+	for _, file := range files {
+		fileFindings, err := File(file)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		findings = append(findings, fileFindings...)
+	}
+
+	return findings, errors.Join(errs...)
+}
+
+// File lints a single file
+func File(filePath string) ([]Finding, error) {
+	if utils.ContainsDirectoryTraversal(filePath) {
+		return nil, fmt.Errorf("invalid file path: directory traversal detected in %s", filePath)
+	}
+	buf, err := os.ReadFile(filepath.Clean(filePath))
+	if err != nil {
+		return nil, err
+	}
+	return Bytes(filePath, buf)
+}
+
+// Bytes lints the YAML content of a file
+func Bytes(filePath string, buf []byte) ([]Finding, error) {
+	var findings []Finding
+
+	if bytes.Contains(buf, []byte(pki.PGPHeader)) && !hasGpgRenderer(buf) {
+		findings = append(findings, Finding{
+			File:    filePath,
+			Line:    1,
+			Rule:    "missing-gpg-renderer",
+			Message: "file contains PGP messages but lacks the #!yaml|gpg renderer line, salt will not decrypt them",
+		})
+	}
+
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(buf, &doc); err != nil {
+		return findings, fmt.Errorf("%s: %s", filePath, err)
+	}
+	walkNode(&doc, "", "", func(path string, key string, node *yamlv3.Node) {
+		rule, message := checkValue(key, node)
+		if rule != "" {
+			findings = append(findings, Finding{filePath, node.Line, path, rule, message})
+		}
+	})
+
+	return findings, nil
+}
+
+// looksSecret checks a key name for words used to name secrets, camelCase words are
+// split so that basicAuth matches as auth does
+func looksSecret(key string) bool {
+	return secretNamePattern.MatchString(key) ||
+		authNamePattern.MatchString(camelCasePattern.ReplaceAllString(key, "${1}_${2}"))
+}
+
+// hasGpgRenderer checks the first line of the file for a renderer pipeline that includes gpg
+func hasGpgRenderer(buf []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	if !scanner.Scan() {
+		return false
+	}
+	line := strings.TrimSpace(scanner.Text())
+	return strings.HasPrefix(line, "#!") && strings.Contains(line, "gpg")
+}
+
+// walkNode calls fn for every scalar along with its colon separated YAML path
+// and the name of the closest map key it is found under
+func walkNode(node *yamlv3.Node, path string, key string, fn func(path string, key string, node *yamlv3.Node)) {
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		for _, child := range node.Content {
+			walkNode(child, path, key, fn)
+		}
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			walkNode(node.Content[i+1], joinPath(path, name), name, fn)
+		}
+	case yamlv3.SequenceNode:
+		for i, child := range node.Content {
+			walkNode(child, joinPath(path, strconv.Itoa(i)), key, fn)
+		}
+	case yamlv3.ScalarNode:
+		fn(path, key, node)
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + ":" + key
+}
+
+// checkValue returns the first rule a plain text scalar breaks along with a message
+func checkValue(key string, node *yamlv3.Node) (string, string) {
+	value := node.Value
+	if value == "" || strings.Contains(value, pki.PGPHeader) || strings.HasPrefix(value, "{{") {
+		return "", ""
+	}
+
+	switch {
+	case privateKeyPattern.MatchString(value):
+		return "private-key", "plain text private key, encrypt this value"
+	case awsKeyPattern.MatchString(value):
+		return "aws-access-key", "plain text AWS access key ID, encrypt this value"
+	case jwtPattern.MatchString(value):
+		return "jwt", "plain text JSON Web Token, encrypt this value"
+	}
+
+	// a null leaves nothing to encrypt, numbers and booleans can be secrets as well
+	if node.Tag == "!!null" {
+		return "", ""
+	}
+	if looksSecret(key) {
+		return "secret-name", fmt.Sprintf("plain text value under '%s', encrypt this value", key)
+	}
+	if looksRandom(value) {
+		return "high-entropy", "plain text value looks randomly generated, encrypt this value"
+	}
+
+	return "", ""
+}
+
+// looksRandom checks for long strings without spaces that have a high Shannon entropy
+func looksRandom(value string) bool {
+	if len(value) < 20 || strings.ContainsAny(value, " \t\n") {
+		return false
+	}
+	if hexPattern.MatchString(value) {
+		return len(value) >= 32 && entropy(value) >= 3.0
+	}
+	return entropy(value) >= 4.0
+}
+
+// entropy returns the Shannon entropy of a string in bits per character
+func entropy(value string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range value {
+		counts[r]++
+		total++
+	}
+
+	bits := 0.0
+	for _, count := range counts {
+		freq := float64(count) / float64(total)
+		bits -= freq * math.Log2(freq)
+	}
+	return bits
+}
@@ -22,9 +22,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -33,14 +38,21 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/config"
 	"github.com/Everbridge/generate-secure-pillar/pki"
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/Everbridge/generate-secure-pillar/utils"
 	"github.com/andreyvit/diff"
 	yaml "github.com/edlitmus/ezyaml"
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
 )
 
 var pgpKeyName string
@@ -69,7 +81,8 @@ func TestCliArgs(t *testing.T) {
 	binaryName := "generate-secure-pillar"
 
 	// set up: encrypt the test sls files
-	_, slsCount := utils.FindFilesByExt(dirPath, ".sls")
+	_, slsCount, err := utils.FindFilesByExt(dirPath, ".sls")
+	Ok(t, err)
 	Equals(t, 7, slsCount)
 	pk, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	if err != nil {
@@ -247,7 +260,9 @@ func TestWriteSlsFile(t *testing.T) {
 
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(slsFile, *p, topLevelElement)
+	s, err := sls.New("", *p, topLevelElement)
+	Ok(t, err)
+	s.FilePath = slsFile
 
 	secText := "secret"
 	valType := "text"
@@ -288,10 +303,12 @@ func TestReadIncludeFile(t *testing.T) {
 	slsFile := "./testdata/inc.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(slsFile, *p, topLevelElement)
+	s, err := sls.New(slsFile, *p, topLevelElement)
+	Assert(t, errors.Is(err, sls.ErrIncludeDirective), "failed to detect include file", err)
 	Assert(t, s.IsInclude, "failed to detect include file", s.IsInclude)
 	slsFile = "./testdata/new.sls"
-	s = sls.New(slsFile, *p, topLevelElement)
+	s, err = sls.New(slsFile, *p, topLevelElement)
+	Ok(t, err)
 	Assert(t, !s.IsInclude, "bad status for non-include file", s.IsInclude)
 }
 
@@ -334,7 +351,8 @@ func TestGetPath(t *testing.T) {
 	file := "./testdata/test/bar.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(file, *p, topLevelElement)
+	s, err := sls.New(file, *p, topLevelElement)
+	Ok(t, err)
 
 	buffer, err := s.PerformAction("encrypt")
 	Ok(t, err)
@@ -387,7 +405,8 @@ func TestGetValueFromPath(t *testing.T) {
 	filePath := "./testdata/new.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(filePath, *p, topLevelElement)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 	val := s.GetValueFromPath("bar:baz")
 	Equals(t, "qux", val.(string))
 }
@@ -398,7 +417,8 @@ func TestNestedAndMultiLineFile(t *testing.T) {
 	filePath := "./testdata/test.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(filePath, *p, topLevelElement)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 
 	buffer, err := s.PerformAction("encrypt")
 	Ok(t, err)
@@ -412,7 +432,8 @@ func TestNestedAndMultiLineFile(t *testing.T) {
 	filePath = "./testdata/test.sls"
 	p, err = pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s = sls.New(filePath, *p, topLevelElement)
+	s, err = sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 
 	buffer, err = s.PerformAction("decrypt")
 	Ok(t, err)
@@ -430,7 +451,8 @@ func TestSetValueFromPath(t *testing.T) {
 	filePath := "./testdata/new.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(filePath, *p, topLevelElement)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 
 	err = s.SetValueFromPath("bar:baz", "foo")
 	Ok(t, err)
@@ -446,7 +468,8 @@ func TestRotateFile(t *testing.T) {
 	filePath := "./testdata/new.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(filePath, *p, topLevelElement)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 
 	buffer, err := s.PerformAction("encrypt")
 	Ok(t, err)
@@ -469,6 +492,1310 @@ func TestRotateFile(t *testing.T) {
 	}
 }
 
+func TestRotateFromKey(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	topLevelElement = ""
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "rotate.sls")
+	err = os.WriteFile(filePath, []byte("#!yaml|gpg\nfoo: bar\nbaz:\n  qux: quux\n"), 0600)
+	Ok(t, err)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
+	_, err = s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+	before := s.GetValueFromPath("foo").(string)
+
+	// values encrypted to other keys are left alone
+	s.RotateFrom = []uint64{0x1234567890ABCDEF}
+	_, err = s.PerformAction(sls.Rotate)
+	Ok(t, err)
+	Equals(t, 0, s.Rotated)
+	Equals(t, 2, s.Skipped)
+	Equals(t, before, s.GetValueFromPath("foo").(string))
+
+	ids, err := p.KeyIDs(pgpKeyName)
+	Ok(t, err)
+	s.RotateFrom = ids
+	_, err = s.PerformAction(sls.Rotate)
+	Ok(t, err)
+	Equals(t, 2, s.Rotated)
+	Equals(t, 0, s.Skipped)
+	Assert(t, before != s.GetValueFromPath("foo").(string), "value was not re-encrypted", before)
+}
+
+func TestRotateToPublicKey(t *testing.T) {
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	oldKey, _, secretKeyRing := getTestKeyRings()
+	dir := t.TempDir()
+
+	// the new key is only known by its public key
+	pubRing, err := pki.OpenKeyRing(filepath.Join(dir, "pubring.gpg"))
+	Ok(t, err)
+	secRing, err := pki.OpenKeyRing(filepath.Join(dir, "secring.gpg"))
+	Ok(t, err)
+	secData, err := os.ReadFile(secretKeyRing)
+	Ok(t, err)
+	_, err = pki.ImportKeys(secData, pubRing, secRing)
+	Ok(t, err)
+	entity, err := pki.GenerateKey("New Salt Master", "", "", &packet.Config{RSABits: 2048})
+	Ok(t, err)
+	var public bytes.Buffer
+	Ok(t, entity.Serialize(&public))
+	_, err = pki.ImportKeys(public.Bytes(), pubRing, secRing)
+	Ok(t, err)
+	Ok(t, pubRing.Save())
+	Ok(t, secRing.Save())
+
+	p, err := pki.New(oldKey, pubRing.Path, secRing.Path)
+	Ok(t, err)
+	file := filepath.Join(dir, "rotate.sls")
+	Ok(t, os.WriteFile(file, []byte("#!yaml|gpg\nfoo: bar\n"), 0600))
+	s, err := sls.New(file, *p, "")
+	Ok(t, err)
+	buffer, err := s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+	Ok(t, os.WriteFile(file, buffer.Bytes(), 0600))
+
+	output, err := exec.Command(binary, "--pubring", pubRing.Path, "--secring", secRing.Path,
+		"rotate", "--from-key", oldKey, "--to-key", "New Salt Master", "-f", file, "-u").CombinedOutput()
+	Assert(t, err == nil, "rotate failed: %s", output)
+	Assert(t, strings.Contains(string(output), "1 rotated, 0 skipped"), "expected a rotated value, got %s", output)
+
+	s, err = sls.New(file, *p, "")
+	Ok(t, err)
+	ids, err := pki.EncryptedToKeyIDs(s.GetValueFromPath("foo").(string))
+	Ok(t, err)
+	newIDs, err := p.KeyIDs("New Salt Master")
+	Ok(t, err)
+	Equals(t, 1, len(ids))
+	toNew := false
+	for _, id := range newIDs {
+		toNew = toNew || id == ids[0]
+	}
+	Assert(t, toNew, "expected the value encrypted to the new key, got %X", ids[0])
+	_, err = p.DecryptSecret(s.GetValueFromPath("foo").(string))
+	Assert(t, errors.Is(err, pki.ErrNoSecretKey), "expected no secret key for the new key, got %v", err)
+}
+
+func TestRotatePath(t *testing.T) {
+	t.Parallel()
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	file := filepath.Join(t.TempDir(), "rotate.sls")
+	Ok(t, os.WriteFile(file, []byte("#!yaml|gpg\nfirst: one\nsecond: two\n"), 0600))
+	s, err := sls.New(file, *p, "")
+	Ok(t, err)
+	buffer, err := s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+	Ok(t, os.WriteFile(file, buffer.Bytes(), 0600))
+	first := s.GetValueFromPath("first").(string)
+	second := s.GetValueFromPath("second").(string)
+	run := func(stdin []byte, args ...string) []byte {
+		cmd := exec.Command(binary, append([]string{"--pubring", publicKeyRing, "--secring", secretKeyRing, "-k", pgpKeyName}, args...)...)
+		if stdin != nil {
+			cmd.Stdin = bytes.NewReader(stdin)
+		}
+		output, err := cmd.Output()
+		Assert(t, err == nil, "%v failed: %s", args, err)
+		return output
+	}
+
+	// only the value at the path is re-encrypted, and the file is written back
+	run(nil, "rotate", "path", "-f", file, "-p", "first", "-u")
+	s, err = sls.New(file, *p, "")
+	Ok(t, err)
+	Assert(t, s.GetValueFromPath("first").(string) != first, "expected the value at the path to be rotated")
+	Equals(t, second, s.GetValueFromPath("second").(string))
+	rotated, err := os.ReadFile(file)
+	Ok(t, err)
+
+	// a file with nothing encrypted to the old key is not written
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	Ok(t, os.Chtimes(file, past, past))
+	run(nil, "rotate", "all", "-f", file, "--from-key", "1234567890ABCDEF", "-u")
+	info, err := os.Stat(file)
+	Ok(t, err)
+	Equals(t, past, info.ModTime())
+
+	// a file piped to STDIN is rotated to STDOUT
+	output := run(rotated, "rotate")
+	s, err = sls.New("", *p, "")
+	Ok(t, err)
+	Ok(t, s.ReadBytes(output))
+	Assert(t, s.GetValueFromPath("second").(string) != second, "expected the piped file to be rotated:\n%s", output)
+	value, err := p.DecryptSecret(s.GetValueFromPath("second").(string))
+	Ok(t, err)
+	Equals(t, "two", value)
+}
+
+func TestRotateDryRun(t *testing.T) {
+	t.Parallel()
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "rotate.sls")
+	err = os.WriteFile(filePath, []byte("#!yaml|gpg\nfoo: bar\n"), 0600)
+	Ok(t, err)
+	err = utils.ProcessDir(dir, ".sls", sls.Encrypt, "", "", *p)
+	Ok(t, err)
+	before, err := os.ReadFile(filePath)
+	Ok(t, err)
+
+	opts := utils.DirOptions{FileExt: ".sls", Action: sls.Rotate, DryRun: true}
+	err = utils.ProcessDirWithOptions(dir, opts, *p)
+	Ok(t, err)
+
+	after, err := os.ReadFile(filePath)
+	Ok(t, err)
+	Equals(t, string(before), string(after))
+}
+
+func TestDryRunPlan(t *testing.T) {
+	t.Parallel()
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "plan.sls")
+	content := "#!yaml|gpg\nfoo: bar\nlist:\n  - one\n  - nested: two\n"
+	err = os.WriteFile(filePath, []byte(content), 0600)
+	Ok(t, err)
+
+	s, err := sls.New(filePath, *p, "")
+	Ok(t, err)
+	buffer, err := s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+	Equals(t, 3, len(s.Changes))
+
+	var plan strings.Builder
+	err = utils.PrintPlan(&plan, &s, filePath, buffer)
+	Ok(t, err)
+	for _, path := range []string{"foo", "list:0", "list:1:nested"} {
+		Assert(t, strings.Contains(plan.String(), "encrypt  "+path+" "), "plan is missing %s", path)
+	}
+
+	after, err := os.ReadFile(filePath)
+	Ok(t, err)
+	Equals(t, content, string(after))
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "verify.sls")
+	err = os.WriteFile(filePath, []byte("#!yaml|gpg\nfoo: bar\nlist:\n  - baz\n"), 0600)
+	Ok(t, err)
+	s, err := sls.New(filePath, *p, "")
+	Ok(t, err)
+	_, err = s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+
+	issues, checked := s.Verify(true)
+	Equals(t, 2, checked)
+	Equals(t, 0, len(issues))
+
+	err = s.SetValueFromPath("foo", pki.PGPHeader+"\n\nbm90IGEgbWVzc2FnZQ==\n-----END PGP MESSAGE-----\n")
+	Ok(t, err)
+	issues, checked = s.Verify(false)
+	Equals(t, 2, checked)
+	Equals(t, 1, len(issues))
+	Equals(t, "foo", issues[0].Path)
+	Equals(t, sls.Corrupt, issues[0].Kind)
+}
+
+func TestKeyReport(t *testing.T) {
+	t.Parallel()
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "report.sls")
+	err = os.WriteFile(filePath, []byte("#!yaml|gpg\nfoo: bar\nlist:\n  - baz\nplain: text\n"), 0600)
+	Ok(t, err)
+	s, err := sls.New(filePath, *p, "")
+	Ok(t, err)
+	_, err = s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+
+	report := s.KeyReport()
+	Equals(t, filePath, report.File)
+	Equals(t, 1, len(report.Keys))
+	Equals(t, 3, len(report.Paths))
+	Equals(t, "foo", report.Paths[0].Path)
+	Equals(t, "list:0", report.Paths[1].Path)
+
+	key := report.Keys[0]
+	Equals(t, p.PublicKey.PrimaryKey.KeyId, mustParseKeyID(t, key.PrimaryKeyID))
+	Equals(t, fmt.Sprintf("%X", p.PublicKey.PrimaryKey.Fingerprint), key.Fingerprint)
+	Assert(t, len(key.UserIDs) > 0 && strings.Contains(key.UserIDs[0], pgpKeyName), "expected user ID for %s, got %v", pgpKeyName, key.UserIDs)
+	Assert(t, strings.HasPrefix(key.Algorithm, "RSA"), "expected RSA key, got %s", key.Algorithm)
+	Assert(t, key.Created != "", "expected key creation date")
+
+	// an element limits the report to the values under it
+	s.EncryptionPath = "list"
+	report = s.KeyReport()
+	Equals(t, 1, len(report.Paths))
+	Equals(t, "list:0", report.Paths[0].Path)
+	Equals(t, 1, len(report.Keys))
+}
+
+func TestKeysByPath(t *testing.T) {
+	t.Parallel()
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "bypath.sls")
+	err = os.WriteFile(filePath, []byte("#!yaml|gpg\na: 1\nb:\n  c: 2\n  d: 3\nl:\n  - x\n  - y: z\n"), 0600)
+	Ok(t, err)
+	s, err := sls.New(filePath, *p, "")
+	Ok(t, err)
+	_, err = s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+	_, err = s.PerformAction(sls.Validate)
+	Ok(t, err)
+	Equals(t, 1, s.KeyCount)
+
+	rows := s.KeysByPath()
+	Equals(t, 5, len(rows))
+	for i, path := range []string{"a", "b:c", "b:d", "l:0", "l:1:y"} {
+		Assert(t, strings.HasPrefix(rows[i], path+": ") && strings.Contains(rows[i], pgpKeyName), "unexpected row %s", rows[i])
+	}
+}
+
+func TestKeysWithoutSecretKey(t *testing.T) {
+	pgpKeyName, publicKeyRing, _ = getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, filepath.Join(t.TempDir(), "missing-secring.gpg"))
+	Ok(t, err)
+	Assert(t, p.SecRing == nil, "expected no secret key ring")
+
+	cipherText, err := p.EncryptSecret("secret")
+	Ok(t, err)
+	_, err = p.DecryptSecret(cipherText)
+	Assert(t, errors.Is(err, pki.ErrNoSecretKey), "expected no secret key, got %v", err)
+
+	keyStr, err := p.KeyUsedForEncryptedMessage(cipherText)
+	Ok(t, err)
+	Assert(t, strings.Contains(keyStr, pgpKeyName), "expected %s in %s", pgpKeyName, keyStr)
+
+	// with neither key ring holding the recipient the raw key ID is shown
+	ids, err := pki.EncryptedToKeyIDs(cipherText)
+	Ok(t, err)
+	keyStr, err = (&pki.Pki{}).KeyUsedForEncryptedMessage(cipherText)
+	Ok(t, err)
+	Equals(t, fmt.Sprintf("%X: not in key rings\n", ids[0]), keyStr)
+
+	// keys needs neither a secret key nor a key name
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	dir := t.TempDir()
+	indented := strings.ReplaceAll(strings.TrimSpace(cipherText), "\n", "\n  ")
+	filePath := filepath.Join(dir, "secret.sls")
+	Ok(t, os.WriteFile(filePath, []byte("#!yaml|gpg\npassword: |\n  "+indented+"\n"), 0600))
+	cmd := exec.Command(binary, "--pubring", publicKeyRing, "--secring", filepath.Join(dir, "missing-secring.gpg"),
+		"keys", "all", "--by-path", "-f", filePath)
+	cmd.Env = append(os.Environ(), "HOME="+dir)
+	output, err := cmd.Output()
+	Assert(t, err == nil, "keys all --by-path failed: %s", err)
+	Assert(t, strings.HasPrefix(string(output), "password: ") && strings.Contains(string(output), pgpKeyName), "unexpected output %s", output)
+}
+
+func TestValidateNotEncrypted(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	s, err := sls.New("", *p, "")
+	Ok(t, err)
+	Ok(t, s.ReadBytes([]byte("#!yaml|gpg\nsecret: plain\n")))
+	_, err = s.PerformAction(sls.Validate)
+	Ok(t, err)
+	Equals(t, 0, s.KeyCount)
+	Equals(t, 0, len(s.KeysByPath()))
+}
+
+func TestKeysMixedFile(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	cipherText, err := p.EncryptSecret("secret")
+	Ok(t, err)
+	indented := strings.ReplaceAll(strings.TrimSpace(cipherText), "\n", "\n    ")
+	filePath := filepath.Join(t.TempDir(), "mixed.sls")
+	Ok(t, os.WriteFile(filePath, []byte(fmt.Sprintf("#!yaml|gpg\nport: 5432\ndb:\n  host: localhost\n  password: |\n    %s\nl:\n  - plain\n  - |\n    %s\n", indented, indented)), 0600))
+
+	// one row per encrypted value, the plain text values are skipped
+	output, err := exec.Command(binary, "--pubring", publicKeyRing, "--secring", secretKeyRing, "-k", pgpKeyName,
+		"keys", "all", "--by-path", "-f", filePath).CombinedOutput()
+	Assert(t, err == nil, "keys all --by-path failed: %s\n%s", err, output)
+	rows := strings.Split(strings.TrimSpace(string(output)), "\n")
+	Equals(t, 2, len(rows))
+	for i, path := range []string{"db:password", "l:1"} {
+		Assert(t, strings.HasPrefix(rows[i], path+": ") && strings.Contains(rows[i], pgpKeyName), "unexpected row %s", rows[i])
+	}
+	Assert(t, !strings.Contains(string(output), "localhost"), "plain text value in the key rows:\n%s", output)
+}
+
+func mustParseKeyID(t *testing.T, id string) uint64 {
+	keyID, err := strconv.ParseUint(id, 16, 64)
+	Ok(t, err)
+	return keyID
+}
+
+func TestSignedValues(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+
+	unsigned, err := p.EncryptSecret("secret")
+	Ok(t, err)
+	Ok(t, p.SetSigner(pgpKeyName))
+	signed, err := p.EncryptSecret("secret")
+	Ok(t, err)
+
+	plainText, sigErr, err := p.DecryptAndVerify(signed)
+	Ok(t, err)
+	Ok(t, sigErr)
+	Equals(t, "secret", plainText)
+
+	_, sigErr, err = p.DecryptAndVerify(unsigned)
+	Ok(t, err)
+	Assert(t, sigErr != nil, "expected an error for an unsigned value")
+
+	// the default policy ignores signatures
+	plainText, err = p.DecryptSecret(unsigned)
+	Ok(t, err)
+	Equals(t, "secret", plainText)
+
+	p.SignaturePolicy = pki.SignaturesRequire
+	_, err = p.DecryptSecret(unsigned)
+	Assert(t, err != nil, "expected unsigned value to be refused")
+	_, err = p.DecryptSecret(signed)
+	Ok(t, err)
+
+	// signed by a key in the key ring that is not a trusted signer
+	p.TrustedSigners = []uint64{0x0123456789ABCDEF}
+	_, err = p.DecryptSecret(signed)
+	Assert(t, err != nil, "expected untrusted signer to be refused")
+	Ok(t, p.SetTrustedSigners([]string{pgpKeyName}))
+	_, err = p.DecryptSecret(signed)
+	Ok(t, err)
+}
+
+func TestValidateKey(t *testing.T) {
+	newEntity := func() *openpgp.Entity {
+		entity, err := openpgp.NewEntity("Validity Test", "", "validity@example.com", &packet.Config{RSABits: 1024})
+		Ok(t, err)
+		return entity
+	}
+	now := time.Now()
+
+	entity := newEntity()
+	id, expires, err := pki.ValidateKey(entity, now)
+	Ok(t, err)
+	Equals(t, entity.Subkeys[0].PublicKey.KeyId, id)
+	Assert(t, expires.IsZero(), "expected key without expiry, got %s", expires)
+
+	// expiry counts from the key creation time
+	entity = newEntity()
+	lifetime := uint32(3600)
+	for _, ident := range entity.Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	_, expires, err = pki.ValidateKey(entity, now)
+	Ok(t, err)
+	Equals(t, entity.PrimaryKey.CreationTime.Add(time.Hour), expires)
+	_, _, err = pki.ValidateKey(entity, now.Add(2*time.Hour))
+	Assert(t, err != nil && strings.Contains(err.Error(), "expired"), "expected expired key error, got %v", err)
+
+	entity = newEntity()
+	entity.Revocations = append(entity.Revocations, &packet.Signature{})
+	_, _, err = pki.ValidateKey(entity, now)
+	Assert(t, err != nil && strings.Contains(err.Error(), "revoked"), "expected revoked key error, got %v", err)
+
+	// a revoked encryption subkey leaves a sign only primary key
+	entity = newEntity()
+	entity.Subkeys[0].Revocation = &packet.Signature{}
+	for _, ident := range entity.Identities {
+		ident.SelfSignature.FlagsValid = true
+		ident.SelfSignature.FlagEncryptCommunications = false
+	}
+	_, _, err = pki.ValidateKey(entity, now)
+	Assert(t, err != nil && strings.Contains(err.Error(), "no usable encryption key"), "expected encryption key error, got %v", err)
+}
+
+func TestExpiredKeyReads(t *testing.T) {
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	dir := t.TempDir()
+
+	// a key that expired an hour after it was created two days ago
+	created := time.Now().Add(-48 * time.Hour)
+	keyConfig := &packet.Config{RSABits: 2048, Time: func() time.Time { return created }}
+	entity, err := openpgp.NewEntity("Expired Salt Master", "", "", keyConfig)
+	Ok(t, err)
+	lifetime := uint32(3600)
+	for _, ident := range entity.Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	Ok(t, entity.SerializePrivate(io.Discard, keyConfig))
+	keys, err := pki.WriteKeyFiles(entity, filepath.Join(dir, "keys"))
+	Ok(t, err)
+
+	// a value encrypted while the key was valid
+	var cipherText bytes.Buffer
+	armored, err := armor.Encode(&cipherText, "PGP MESSAGE", nil)
+	Ok(t, err)
+	plain, err := openpgp.Encrypt(armored, []*openpgp.Entity{entity}, nil, nil, keyConfig)
+	Ok(t, err)
+	_, err = plain.Write([]byte("secret"))
+	Ok(t, err)
+	Ok(t, plain.Close())
+	Ok(t, armored.Close())
+	filePath := filepath.Join(dir, "expired.sls")
+	indented := strings.ReplaceAll(strings.TrimSpace(cipherText.String()), "\n", "\n  ")
+	Ok(t, os.WriteFile(filePath, []byte("#!yaml|gpg\npassword: |\n  "+indented+"\n"), 0600))
+
+	run := func(args ...string) ([]byte, error) {
+		return exec.Command(binary, append([]string{"--pubring", keys.PublicKeyRing, "--secring", keys.SecretKeyRing,
+			"-k", "Expired Salt Master"}, args...)...).CombinedOutput()
+	}
+
+	// reading only warns about the key
+	for _, args := range [][]string{{"decrypt", "all", "-f", filePath}, {"keys", "all", "-f", filePath}} {
+		output, err := run(args...)
+		Assert(t, err == nil, "%v failed: %s\n%s", args, err, output)
+		Assert(t, strings.Contains(string(output), "using invalid key"), "expected a warning from %v:\n%s", args, output)
+	}
+	output, err := run("decrypt", "all", "-f", filePath)
+	Ok(t, err)
+	Assert(t, strings.Contains(string(output), "password: secret"), "expected the decrypted value:\n%s", output)
+
+	// encrypting is refused
+	output, err = run("encrypt", "all", "-f", filePath)
+	Assert(t, err != nil, "expected encrypt to refuse an expired key:\n%s", output)
+	Assert(t, strings.Contains(string(output), "expired"), "expected an expired key error:\n%s", output)
+}
+
+func TestFindKey(t *testing.T) {
+	config := &packet.Config{RSABits: 1024}
+	first, err := openpgp.NewEntity("Salt Master", "first", "first@example.com", config)
+	Ok(t, err)
+	second, err := openpgp.NewEntity("Salt Master", "second", "second@example.com", config)
+	Ok(t, err)
+	ring := openpgp.EntityList{first, second}
+	p := &pki.Pki{}
+
+	fingerprint := fmt.Sprintf("%X", second.PrimaryKey.Fingerprint)
+	for _, id := range []string{
+		fingerprint,
+		strings.ToLower(fingerprint),
+		"0x" + second.PrimaryKey.KeyIdString(),
+		second.PrimaryKey.KeyIdShortString(),
+		second.Subkeys[0].PublicKey.KeyIdString(),
+		"second@example.com",
+	} {
+		entity, err := p.FindKey(&ring, id)
+		Ok(t, err)
+		Assert(t, entity == second, "expected %s to match the second key", id)
+	}
+
+	entity, err := p.FindKey(&ring, "Nobody")
+	Ok(t, err)
+	Assert(t, entity == nil, "expected no match")
+
+	_, err = p.FindKey(&ring, "Salt Master")
+	Assert(t, err != nil, "expected ambiguous match error")
+	Assert(t, strings.Contains(err.Error(), fmt.Sprintf("%X", first.PrimaryKey.Fingerprint)) && strings.Contains(err.Error(), fingerprint),
+		"expected candidates in error, got %s", err)
+	Assert(t, p.GetKeyByID(&ring, "Salt Master") == nil, "expected no key for an ambiguous match")
+}
+
+func TestKeySources(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	cipherText, err := p.EncryptSecret("secret")
+	Ok(t, err)
+
+	// an ASCII armored copy of the public key ring
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	Ok(t, err)
+	Ok(t, p.PublicKey.Serialize(w))
+	Ok(t, w.Close())
+	armoredFile := filepath.Join(t.TempDir(), "key.asc")
+	Ok(t, os.WriteFile(armoredFile, armored.Bytes(), 0600))
+
+	pubRing, err := os.ReadFile(publicKeyRing)
+	Ok(t, err)
+	secRing, err := os.ReadFile(secretKeyRing)
+	Ok(t, err)
+
+	tests := []struct {
+		name string
+		opts pki.Options
+	}{
+		{"armored pubring", pki.Options{PgpKeyName: pgpKeyName, PublicKeyRing: armoredFile}},
+		{"recipient file without key name", pki.Options{RecipientFile: armoredFile}},
+		{"armored key data", pki.Options{PublicKeyData: armored.String()}},
+		{"base64 key data", pki.Options{PublicKeyData: base64.StdEncoding.EncodeToString(pubRing)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kp, err := pki.NewWithOptions(tt.opts)
+			Ok(t, err)
+			Equals(t, p.PublicKey.PrimaryKey.Fingerprint, kp.PublicKey.PrimaryKey.Fingerprint)
+			_, err = kp.EncryptSecret("secret")
+			Ok(t, err)
+		})
+	}
+
+	// decryption with the secret key given as data alone
+	kp, err := pki.NewWithOptions(pki.Options{
+		PgpKeyName:    pgpKeyName,
+		PublicKeyData: base64.StdEncoding.EncodeToString(pubRing),
+		SecretKeyData: base64.StdEncoding.EncodeToString(secRing),
+	})
+	Ok(t, err)
+	plainText, err := kp.DecryptSecret(cipherText)
+	Ok(t, err)
+	Equals(t, "secret", plainText)
+
+	_, err = pki.NewWithOptions(pki.Options{PublicKeyData: "not a key"})
+	Assert(t, err != nil, "expected an error for bad key data")
+}
+
+func TestCryptoSettings(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	topLevelElement = ""
+
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	legacy, err := p.EncryptSecret("secret")
+	Ok(t, err)
+
+	strict, err := pki.NewWithOptions(pki.Options{
+		PgpKeyName:    pgpKeyName,
+		PublicKeyRing: publicKeyRing,
+		SecretKeyRing: secretKeyRing,
+		Crypto:        pki.CryptoOptions{Cipher: "aes256", Hash: "sha512", Compression: "zlib", CompressionLevel: 9},
+	})
+	Ok(t, err)
+	cipherText, err := strict.EncryptSecret("secret")
+	Ok(t, err)
+	algorithms, err := strict.MessageAlgorithms(cipherText)
+	Ok(t, err)
+	Equals(t, packet.CipherAES256, algorithms.Cipher)
+	Equals(t, packet.CompressionZLIB, algorithms.Compression)
+	Ok(t, strict.CheckAlgorithms(algorithms))
+	plainText, err := strict.DecryptSecret(cipherText)
+	Ok(t, err)
+	Equals(t, "secret", plainText)
+
+	// signed values are compressed and signed with the configured hash
+	Ok(t, strict.SetSigner(pgpKeyName))
+	signed, err := strict.EncryptSecret("secret")
+	Ok(t, err)
+	algorithms, err = strict.MessageAlgorithms(signed)
+	Ok(t, err)
+	Equals(t, crypto.SHA512, algorithms.Hash)
+	Equals(t, packet.CompressionZLIB, algorithms.Compression)
+	plainText, sigErr, err := strict.DecryptAndVerify(signed)
+	Ok(t, err)
+	Ok(t, sigErr)
+	Equals(t, "secret", plainText)
+	strict.Signer = nil
+
+	// the library default cipher is weaker than the policy
+	algorithms, err = strict.MessageAlgorithms(legacy)
+	Ok(t, err)
+	Equals(t, packet.CipherAES128, algorithms.Cipher)
+	Equals(t, packet.CompressionNone, algorithms.Compression)
+	Assert(t, strict.CheckAlgorithms(algorithms) != nil, "expected aes128 to be weaker than aes256")
+
+	filePath := filepath.Join(t.TempDir(), "crypto.sls")
+	Ok(t, os.WriteFile(filePath, []byte("#!yaml|gpg\nfoo: bar\n"), 0600))
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
+	_, err = s.PerformAction(sls.Encrypt)
+	Ok(t, err)
+	s.Pki = strict
+	issues, checked := s.Verify(true)
+	Equals(t, 1, checked)
+	Equals(t, 1, len(issues))
+	Equals(t, sls.WeakAlgorithm, issues[0].Kind)
+
+	bad := []pki.CryptoOptions{
+		{Cipher: "rot13"},
+		{Hash: "md5"},
+		{Compression: "bzip2"},
+		{CompressionLevel: 10},
+		{RSABits: 1024},
+		{AEAD: "ocb"},
+	}
+	for _, opts := range bad {
+		_, err = opts.Config()
+		Assert(t, err != nil, "expected an error for %+v", opts)
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	_, err := pki.GenerateKey("", "", "", nil)
+	Assert(t, err != nil, "expected an error for an empty key name")
+
+	entity, err := pki.GenerateKey("Stage Salt Master", "", "salt@example.com", &packet.Config{RSABits: 2048})
+	Ok(t, err)
+
+	dir := filepath.Join(t.TempDir(), "gpgkeys")
+	files, err := pki.WriteKeyFiles(entity, dir)
+	Ok(t, err)
+	Equals(t, filepath.Join(dir, "stage-salt-master.asc"), files.ArmoredPublicKey)
+	info, err := os.Stat(files.SecretKeyRing)
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), info.Mode().Perm())
+
+	p, err := pki.New("Stage Salt Master", files.PublicKeyRing, files.SecretKeyRing)
+	Ok(t, err)
+	cipherText, err := p.EncryptSecret("secret")
+	Ok(t, err)
+	plainText, err := p.DecryptSecret(cipherText)
+	Ok(t, err)
+	Equals(t, "secret", plainText)
+
+	p, err = pki.NewWithOptions(pki.Options{RecipientFile: files.ArmoredPublicKey})
+	Ok(t, err)
+	Equals(t, entity.PrimaryKey.Fingerprint, p.PublicKey.PrimaryKey.Fingerprint)
+
+	_, err = pki.WriteKeyFiles(entity, dir)
+	Assert(t, err != nil, "expected an error when the key files exist")
+}
+
+func TestKeyRings(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+
+	dir := t.TempDir()
+	pubRing, err := pki.OpenKeyRing(filepath.Join(dir, "pubring.gpg"))
+	Ok(t, err)
+	secRing, err := pki.OpenKeyRing(filepath.Join(dir, "secring.gpg"))
+	Ok(t, err)
+	Equals(t, 0, len(pki.ListKeys(pubRing, secRing)))
+
+	secData, err := os.ReadFile(secretKeyRing)
+	Ok(t, err)
+	imported, err := pki.ImportKeys(secData, pubRing, secRing)
+	Ok(t, err)
+	Equals(t, 1, len(imported))
+
+	entity, err := pki.GenerateKey("Stage Salt Master", "", "", &packet.Config{RSABits: 2048})
+	Ok(t, err)
+	var public bytes.Buffer
+	Ok(t, entity.Serialize(&public))
+	_, err = pki.ImportKeys(public.Bytes(), pubRing, secRing)
+	Ok(t, err)
+	Ok(t, pubRing.Save())
+	Ok(t, secRing.Save())
+
+	keys := pki.ListKeys(pubRing, secRing)
+	Equals(t, 2, len(keys))
+	Equals(t, true, keys[0].Secret)
+	Equals(t, false, keys[1].Secret)
+
+	// the rings can be used to encrypt and decrypt, and secret keys are kept as they were
+	p, err := pki.New(pgpKeyName, pubRing.Path, secRing.Path)
+	Ok(t, err)
+	cipherText, err := p.EncryptSecret("secret")
+	Ok(t, err)
+	plainText, err := p.DecryptSecret(cipherText)
+	Ok(t, err)
+	Equals(t, "secret", plainText)
+	saved, err := os.ReadFile(secRing.Path)
+	Ok(t, err)
+	Equals(t, secData, saved)
+
+	// an exported key imports into a new ring
+	armored, err := pubRing.Export(entity.PrimaryKey.Fingerprint, false)
+	Ok(t, err)
+	other := &pki.KeyRing{Path: filepath.Join(dir, "other.gpg")}
+	imported, err = pki.ImportKeys(armored, other, nil)
+	Ok(t, err)
+	Equals(t, entity.PrimaryKey.Fingerprint, imported[0].PrimaryKey.Fingerprint)
+	_, err = pubRing.Export(entity.PrimaryKey.Fingerprint, true)
+	Assert(t, err != nil, "expected an error exporting a secret key from a public ring")
+
+	found, err := pubRing.Find("Stage Salt Master")
+	Ok(t, err)
+	Assert(t, pubRing.Remove(found.PrimaryKey.Fingerprint), "expected the key to be removed")
+	Ok(t, pubRing.Save())
+	pubRing, err = pki.OpenKeyRing(pubRing.Path)
+	Ok(t, err)
+	Equals(t, 1, len(pubRing.Entities()))
+
+	_, err = pki.ImportKeys([]byte("not a key"), pubRing, secRing)
+	Assert(t, err != nil, "expected an error importing bad key data")
+}
+
+func TestRepoProfiles(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	topLevelElement = ""
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	prodHome, err := filepath.Abs(filepath.Dir(publicKeyRing))
+	Ok(t, err)
+
+	dir := t.TempDir()
+	entity, err := pki.GenerateKey("Dev Salt Master", "", "", &packet.Config{RSABits: 2048})
+	Ok(t, err)
+	devKeys, err := pki.WriteKeyFiles(entity, filepath.Join(dir, "devkeys"))
+	Ok(t, err)
+
+	configFile := filepath.Join(dir, "config.yaml")
+	Ok(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`profiles:
+  - name: prod
+    gnupg_home: %s
+    default_key: Test Salt Master
+  - name: dev
+    gnupg_home: %s
+    default_key: Dev Salt Master
+`, prodHome, filepath.Join(dir, "devkeys"))), 0600))
+
+	repo := filepath.Join(dir, "repo")
+	Ok(t, os.MkdirAll(filepath.Join(repo, "pillar", "prod", "app"), 0700))
+	Ok(t, os.MkdirAll(filepath.Join(repo, "pillar", "dev"), 0700))
+	Ok(t, os.WriteFile(filepath.Join(repo, config.RepoFile), []byte(`rules:
+  - path: pillar/prod/**
+    profile: prod
+  - path: pillar/dev/**
+    profile: dev
+`), 0600))
+	prodFile := filepath.Join(repo, "pillar", "prod", "app", "secrets.sls")
+	devFile := filepath.Join(repo, "pillar", "dev", "secrets.sls")
+	Ok(t, os.WriteFile(prodFile, []byte("#!yaml|gpg\nfoo: bar\n"), 0600))
+	Ok(t, os.WriteFile(devFile, []byte("#!yaml|gpg\nfoo: bar\n"), 0600))
+
+	run := func(args ...string) ([]byte, error) {
+		return exec.Command(binary, append([]string{"--config", configFile}, args...)...).CombinedOutput()
+	}
+
+	// each file is encrypted with the key of the profile its rule names
+	output, err := run("encrypt", "recurse", "-d", filepath.Join(repo, "pillar"))
+	Assert(t, err == nil, "encrypt recurse failed: %s\n%s", err, output)
+	prod, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	dev, err := pki.New("Dev Salt Master", devKeys.PublicKeyRing, devKeys.SecretKeyRing)
+	Ok(t, err)
+	for file, p := range map[string]*pki.Pki{prodFile: prod, devFile: dev} {
+		s, err := sls.New(file, *p, topLevelElement)
+		Ok(t, err)
+		issues, checked := s.Verify(true)
+		Equals(t, 1, checked)
+		Assert(t, len(issues) == 0, "%s: unexpected issues %+v", file, issues)
+	}
+
+	// --from-key is looked up in the keys of each file's profile, no -k or default is needed
+	before, err := os.ReadFile(prodFile)
+	Ok(t, err)
+	output, err = run("rotate", "recurse", "--from-key", "Test Salt Master", "-d", filepath.Join(repo, "pillar", "prod"))
+	Assert(t, err == nil, "rotate recurse --from-key failed: %s\n%s", err, output)
+	Assert(t, strings.Contains(string(output), "1 rotated, 0 skipped"), "unexpected output:\n%s", output)
+	after, err := os.ReadFile(prodFile)
+	Ok(t, err)
+	Assert(t, !bytes.Equal(before, after), "%s was not rotated", prodFile)
+
+	// keys that contradict the rule are refused
+	for _, args := range [][]string{
+		{"--profile", "dev", "encrypt", "all", "-f", prodFile, "-u"},
+		{"-k", "Dev Salt Master", "verify", "-f", prodFile},
+		{"--profile", "prod", "encrypt", "recurse", "-d", filepath.Join(repo, "pillar")},
+	} {
+		output, err = run(args...)
+		Assert(t, err != nil, "expected %v to fail:\n%s", args, output)
+	}
+	output, err = run("--recipient", "Test Salt Master", "encrypt", "all", "-f", prodFile, "-u")
+	Assert(t, err != nil && strings.Contains(string(output), "not --recipient"), "expected --recipient to be refused:\n%s", output)
+}
+
+func TestConfigValidate(t *testing.T) {
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	run := func(args ...string) ([]byte, int) {
+		cmd := exec.Command(binary, append([]string{"--config", configFile}, args...)...)
+		output, _ := cmd.CombinedOutput()
+		return output, cmd.ProcessState.ExitCode()
+	}
+
+	Ok(t, os.WriteFile(configFile, []byte(`profiles:
+  - name: dev
+    default: true
+    default_key: Dev Salt Master
+    gnupg_home: /etc/salt/gpgkeys
+    default_sec_ring: /etc/salt/gpgkeys/secring.asc
+`), 0600))
+	output, code := run("config", "validate")
+	Equals(t, 0, code)
+	output, code = run("config", "show")
+	Equals(t, 0, code)
+	Assert(t, strings.Contains(string(output), "default_pub_ring: /etc/salt/gpgkeys/pubring.gpg"), "expected the resolved public ring:\n%s", output)
+	Assert(t, strings.Contains(string(output), "default_sec_ring: /etc/salt/gpgkeys/secring.asc"), "expected the secret ring:\n%s", output)
+	_, code = run("--profile", "prod", "config", "show")
+	Equals(t, 1, code)
+
+	Ok(t, os.WriteFile(configFile, []byte(`profiles:
+  - name: dev
+    default: true
+    default_key: Dev Salt Master
+    keyring: ~/.gnupg
+  - name: prod
+    default: true
+`), 0600))
+	output, code = run("config", "validate")
+	Equals(t, 2, code)
+	Equals(t, 3, strings.Count(string(output), configFile))
+
+	// a config file that cannot be read is an error, not a problem found
+	_, code = run("--config", filepath.Join(dir, "missing.yaml"), "config", "validate")
+	Equals(t, 1, code)
+	_, code = run("--config", dir, "config", "validate")
+	Equals(t, 1, code)
+
+	// commands that need keys refuse a bad config file
+	_, code = run("encrypt", "all", "-f", filepath.Join(dir, "missing.sls"))
+	Equals(t, 1, code)
+}
+
+func TestLintExitCodes(t *testing.T) {
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	dir := t.TempDir()
+	run := func(args ...string) ([]byte, int) {
+		cmd := exec.Command(binary, args...)
+		output, _ := cmd.CombinedOutput()
+		return output, cmd.ProcessState.ExitCode()
+	}
+
+	Ok(t, os.WriteFile(filepath.Join(dir, "clean.sls"), []byte("#!yaml|gpg\nauthor: someone\n"), 0600))
+	output, code := run("lint", "-d", dir)
+	Assert(t, code == 0, "expected a clean lint, got %d:\n%s", code, output)
+
+	Ok(t, os.WriteFile(filepath.Join(dir, "secret.sls"), []byte("db:\n  password: hunter2\n"), 0600))
+	output, code = run("lint", "-d", dir)
+	Assert(t, code == 2, "expected findings, got %d:\n%s", code, output)
+
+	// a file that cannot be parsed is an error, not a clean result
+	Ok(t, os.Remove(filepath.Join(dir, "secret.sls")))
+	Ok(t, os.WriteFile(filepath.Join(dir, "broken.sls"), []byte("key: [unterminated\n"), 0600))
+	output, code = run("lint", "-d", dir)
+	Assert(t, code == 1, "expected an error, got %d:\n%s", code, output)
+}
+
+func TestRecipients(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+
+	dir := t.TempDir()
+	entity, err := pki.GenerateKey("Break Glass", "", "", &packet.Config{RSABits: 2048})
+	Ok(t, err)
+	files, err := pki.WriteKeyFiles(entity, filepath.Join(dir, "breakglass"))
+	Ok(t, err)
+
+	// one public ring holding both keys
+	pubRing, err := pki.OpenKeyRing(filepath.Join(dir, "pubring.gpg"))
+	Ok(t, err)
+	for _, ring := range []string{publicKeyRing, files.PublicKeyRing} {
+		data, err := os.ReadFile(ring)
+		Ok(t, err)
+		_, err = pki.ImportKeys(data, pubRing, nil)
+		Ok(t, err)
+	}
+	Ok(t, pubRing.Save())
+
+	for _, crypto := range []pki.CryptoOptions{{}, {Compression: "zlib"}} {
+		p, err := pki.NewWithOptions(pki.Options{
+			PgpKeyName:    pgpKeyName,
+			PublicKeyRing: pubRing.Path,
+			SecretKeyRing: secretKeyRing,
+			Recipients:    []string{"Break Glass"},
+			Crypto:        crypto,
+		})
+		Ok(t, err)
+		Equals(t, 1, len(p.Recipients))
+		cipherText, err := p.EncryptSecret("secret")
+		Ok(t, err)
+
+		// either secret key decrypts the value
+		for _, secRing := range []string{secretKeyRing, files.SecretKeyRing} {
+			name := pgpKeyName
+			if secRing == files.SecretKeyRing {
+				name = "Break Glass"
+			}
+			d, err := pki.New(name, pubRing.Path, secRing)
+			Ok(t, err)
+			plainText, err := d.DecryptSecret(cipherText)
+			Ok(t, err)
+			Equals(t, "secret", plainText)
+		}
+	}
+
+	_, err = pki.NewWithOptions(pki.Options{
+		PgpKeyName:    pgpKeyName,
+		PublicKeyRing: pubRing.Path,
+		Recipients:    []string{"Nobody"},
+	})
+	Assert(t, err != nil, "expected an error for an unknown recipient")
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	home, err := filepath.Abs(filepath.Dir(publicKeyRing))
+	Ok(t, err)
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	Ok(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`profiles:
+  - name: base
+    gnupg_home: %s
+    element: first
+  - name: test
+    default: true
+    extends: base
+    default_key: Test Salt Master
+`, home)), 0600))
+	repo := filepath.Join(dir, "repo")
+	Ok(t, os.MkdirAll(filepath.Join(repo, "vendor"), 0700))
+	file := filepath.Join(repo, "values.sls")
+	content := []byte("#!yaml|gpg\nfirst:\n  a: one\nsecond:\n  b: two\n")
+	Ok(t, os.WriteFile(file, content, 0600))
+
+	// encrypted reports which of the two elements a run of the command encrypted
+	encrypted := func(env []string, args ...string) string {
+		cmd := exec.Command(binary, append([]string{"--config", configFile, "encrypt", "all", "-f", file}, args...)...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), env...)
+		output, err := cmd.Output()
+		Assert(t, err == nil, "encrypt failed: %s\n%s", err, output)
+		switch {
+		case !strings.Contains(string(output), "a: one") && strings.Contains(string(output), "b: two"):
+			return "first"
+		case strings.Contains(string(output), "a: one") && !strings.Contains(string(output), "b: two"):
+			return "second"
+		case !strings.Contains(string(output), "a: one") && !strings.Contains(string(output), "b: two"):
+			return "all"
+		}
+		return string(output)
+	}
+
+	// the base profile sets the element
+	Equals(t, "first", encrypted(nil))
+	// the repository config comes before the profile
+	Ok(t, os.WriteFile(filepath.Join(repo, config.RepoFile), []byte("defaults:\n  element: second\n"), 0600))
+	Equals(t, "second", encrypted(nil))
+	// the environment comes before the repository config
+	Equals(t, "first", encrypted([]string{"GSP_ELEMENT=first"}))
+	// and a flag before the environment
+	Equals(t, "second", encrypted([]string{"GSP_ELEMENT=first"}, "-e", "second"))
+	// an empty flag is given too, it encrypts the whole file
+	Equals(t, "all", encrypted(nil, "-e", ""))
+
+	// every global option has a default, here the log format, and a flag still comes first
+	Ok(t, os.WriteFile(filepath.Join(repo, config.RepoFile), []byte("defaults:\n  log_format: text\n  dry_run: true\n"), 0600))
+	logged := func(args ...string) string {
+		cmd := exec.Command(binary, append([]string{"--config", configFile, "--log-level", "debug"}, args...)...)
+		cmd.Dir = repo
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		Assert(t, err == nil, "%v failed: %s\n%s", args, err, stderr.String())
+		return string(output) + stderr.String()
+	}
+	output := logged("encrypt", "all", "-f", file, "-u")
+	Assert(t, strings.Contains(output, "DBG") && !strings.Contains(output, `"level":`), "expected a text log:\n%s", output)
+	buf, err := os.ReadFile(file)
+	Ok(t, err)
+	Equals(t, string(content), string(buf))
+	output = logged("--log-format", "json", "--dry-run=false", "encrypt", "all", "-f", file, "-u")
+	Assert(t, strings.Contains(output, `"level":"debug"`), "expected a JSON log:\n%s", output)
+	buf, err = os.ReadFile(file)
+	Ok(t, err)
+	Assert(t, strings.Contains(string(buf), pki.PGPHeader), "expected %s to be encrypted", file)
+	Ok(t, os.WriteFile(file, content, 0600))
+
+	// the include and exclude globs of a profile select the files of a directory
+	Ok(t, os.WriteFile(filepath.Join(repo, config.RepoFile), []byte("defaults:\n  exclude:\n    - vendor/**\n  jobs: 1\n"), 0600))
+	vendored := filepath.Join(repo, "vendor", "values.sls")
+	Ok(t, os.WriteFile(vendored, content, 0600))
+	cmd := exec.Command(binary, "--config", configFile, "encrypt", "recurse", "-d", repo)
+	cmd.Dir = repo
+	combined, err := cmd.CombinedOutput()
+	Assert(t, err == nil, "encrypt recurse failed: %s\n%s", err, combined)
+	buf, err = os.ReadFile(vendored)
+	Ok(t, err)
+	Equals(t, string(content), string(buf))
+	buf, err = os.ReadFile(file)
+	Ok(t, err)
+	Assert(t, strings.Contains(string(buf), pki.PGPHeader), "expected %s to be encrypted", file)
+}
+
+func TestReadsCreateNoFiles(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	home := t.TempDir()
+	run := func(args ...string) ([]byte, int) {
+		cmd := exec.Command(binary, args...)
+		cmd.Env = append(os.Environ(), "HOME="+home)
+		output, _ := cmd.CombinedOutput()
+		return output, cmd.ProcessState.ExitCode()
+	}
+
+	// a mistyped input file is an error and is not created, nor is the config file
+	missing := filepath.Join(home, "pillar", "typo.sls")
+	for _, command := range []string{"decrypt", "encrypt", "keys"} {
+		output, code := run("--pubring", publicKeyRing, "--secring", secretKeyRing, "-k", pgpKeyName, command, "all", "-f", missing)
+		Equals(t, 1, code)
+		Assert(t, strings.Contains(string(output), "cannot read input file"), "expected a missing file error:\n%s", output)
+	}
+	_, err = os.Stat(filepath.Join(home, "pillar"))
+	Assert(t, os.IsNotExist(err), "expected no directory for the missing file")
+	configFile := filepath.Join(home, ".config", "generate-secure-pillar", "config.yaml")
+	_, err = os.Stat(configFile)
+	Assert(t, os.IsNotExist(err), "expected no config file")
+
+	// create writes a new file
+	output, code := run("--pubring", publicKeyRing, "-k", pgpKeyName, "create", "--name", "key", "--value", "value", "--outfile", missing)
+	Equals(t, 0, code)
+	buf, err := os.ReadFile(missing)
+	Assert(t, err == nil, "expected create to write %s:\n%s", missing, output)
+	Assert(t, strings.Contains(string(buf), pki.PGPHeader), "expected an encrypted value")
+
+	// a dry run of create or update prints a plan and leaves the file alone
+	for _, args := range [][]string{
+		{"create", "--name", "other", "--value", "value", "--outfile", missing},
+		{"update", "--name", "other", "--value", "value", "-f", missing},
+	} {
+		output, code = run(append([]string{"--pubring", publicKeyRing, "-k", pgpKeyName, "--dry-run"}, args...)...)
+		Equals(t, 0, code)
+		Assert(t, strings.Contains(string(output), "encrypt  other "), "expected a plan from %s:\n%s", args[0], output)
+		after, err := os.ReadFile(missing)
+		Ok(t, err)
+		Equals(t, string(buf), string(after))
+	}
+
+	// config init writes the template once
+	_, code = run("config", "init")
+	Equals(t, 0, code)
+	info, err := os.Stat(configFile)
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), info.Mode().Perm())
+	output, code = run("config", "init")
+	Equals(t, 1, code)
+	Assert(t, strings.Contains(string(output), "already exists"), "expected config init to keep the file:\n%s", output)
+	_, code = run("config", "validate")
+	Equals(t, 0, code)
+	_, code = run("config", "init", "--force")
+	Equals(t, 0, code)
+
+	// an explicit config file must exist
+	_, code = run("--config", filepath.Join(home, "missing.yaml"), "-k", pgpKeyName, "encrypt", "all", "-f", missing)
+	Equals(t, 1, code)
+}
+
+func TestLogOutput(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	file := filepath.Join(t.TempDir(), "new.sls")
+	buf, err := os.ReadFile(filepath.Join(dirPath, "new.sls"))
+	Ok(t, err)
+	Ok(t, os.WriteFile(file, buf, 0600))
+	run := func(args ...string) (string, string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(binary, append([]string{"--pubring", publicKeyRing, "--secring", secretKeyRing, "-k", pgpKeyName}, args...)...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		return stdout.String(), stderr.String(), err
+	}
+
+	// the encrypted file is all that is written to STDOUT, the log goes to STDERR as JSON
+	stdout, stderr, err := run("--log-level", "debug", "encrypt", "all", "-f", file)
+	Assert(t, err == nil, "encrypt failed: %s\n%s", err, stderr)
+	Assert(t, strings.Contains(stdout, pki.PGPHeader), "expected the encrypted file on STDOUT:\n%s", stdout)
+	Assert(t, !strings.Contains(stdout, `"level"`), "expected no log on STDOUT:\n%s", stdout)
+	var done map[string]interface{}
+	Ok(t, json.Unmarshal([]byte(stderr), &done))
+	Equals(t, "debug", done["level"])
+	Equals(t, "encrypt", done["action"])
+	_, ok := done["duration"].(float64)
+	Assert(t, ok, "expected a duration:\n%s", stderr)
+
+	// a path that is not in the file is a warning, hidden at the error level
+	_, stderr, err = run("decrypt", "path", "-f", file, "-p", "missing")
+	Ok(t, err)
+	entries, err := getLinesAsJSON(stderr)
+	Ok(t, err)
+	Equals(t, 1, len(entries))
+	Equals(t, "warn", entries[0]["level"])
+	Equals(t, "missing", entries[0]["path"])
+	Equals(t, file, entries[0]["file"])
+	_, stderr, err = run("--log-level", "error", "decrypt", "path", "-f", file, "-p", "missing")
+	Ok(t, err)
+	Equals(t, "", stderr)
+
+	// the text format is for people
+	_, stderr, err = run("--log-format", "text", "decrypt", "path", "-f", file, "-p", "missing")
+	Ok(t, err)
+	Assert(t, strings.Contains(stderr, "WRN") && !strings.HasPrefix(stderr, "{"), "expected a text log:\n%s", stderr)
+
+	// unknown options are an error
+	_, stderr, err = run("--log-format", "xml", "decrypt", "path", "-f", file, "-p", "missing")
+	Assert(t, err != nil, "expected an unknown log format to fail")
+	Assert(t, strings.Contains(stderr, "unknown log format 'xml'"), "expected an unknown format error:\n%s", stderr)
+	_, _, err = run("--log-level", "loud", "decrypt", "path", "-f", file, "-p", "missing")
+	Assert(t, err != nil, "expected an unknown log level to fail")
+}
+
+func TestStdinStreams(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	run := func(input []byte, args ...string) []byte {
+		cmd := exec.Command(binary, append([]string{"--pubring", publicKeyRing, "--secring", secretKeyRing, "-k", pgpKeyName}, args...)...)
+		cmd.Stdin = bytes.NewReader(input)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		Assert(t, err == nil, "%v failed: %s\n%s", args, err, stderr.String())
+		return output
+	}
+
+	// with no --file the input is read from STDIN and written to STDOUT
+	plain := []byte("#!yaml|gpg\n\nsecret: hunter2\n")
+	encrypted := run(plain, "encrypt", "all")
+	Assert(t, strings.Contains(string(encrypted), pki.PGPHeader), "expected an encrypted value:\n%s", encrypted)
+	Assert(t, !strings.Contains(string(encrypted), "hunter2"), "expected no plain text value:\n%s", encrypted)
+	decrypted := run(encrypted, "decrypt", "all")
+	Assert(t, strings.Contains(string(decrypted), "secret: hunter2"), "expected the value decrypted:\n%s", decrypted)
+}
+
+func TestAuditLogCommands(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
+	binary, err := filepath.Abs("generate-secure-pillar")
+	Ok(t, err)
+	home, err := filepath.Abs(filepath.Dir(publicKeyRing))
+	Ok(t, err)
+
+	// the audit log is set by the profile
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "audit", "audit.jsonl")
+	configFile := filepath.Join(dir, "config.yaml")
+	Ok(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`profiles:
+  - name: test
+    default: true
+    gnupg_home: %s
+    default_key: Test Salt Master
+    audit_log: %s
+`, home, logFile)), 0600))
+	file := filepath.Join(dir, "values.sls")
+	Ok(t, os.WriteFile(file, []byte("#!yaml|gpg\nsecret: hunter2\nother: value\n"), 0600))
+	run := func(args ...string) (string, int) {
+		cmd := exec.Command(binary, append([]string{"--config", configFile}, args...)...)
+		output, _ := cmd.CombinedOutput()
+		return string(output), cmd.ProcessState.ExitCode()
+	}
+
+	output, code := run("encrypt", "all", "-f", file, "-u")
+	Assert(t, code == 0, "encrypt failed:\n%s", output)
+	output, code = run("decrypt", "path", "-f", file, "-p", "secret")
+	Assert(t, code == 0 && strings.Contains(output, "hunter2"), "decrypt failed:\n%s", output)
+	output, code = run("rotate", "all", "-f", file, "-u")
+	Assert(t, code == 0, "rotate failed:\n%s", output)
+	output, code = run("verify", "--decrypt", "-f", file)
+	Assert(t, code == 0, "verify failed:\n%s", output)
+
+	// a dry run changes nothing and records nothing
+	for _, args := range [][]string{
+		{"--dry-run", "rotate", "all", "-f", file, "-u"},
+		{"--dry-run", "decrypt", "all", "-f", file, "-u"},
+		{"--dry-run", "rotate", "recurse", "-d", dir},
+	} {
+		output, code = run(args...)
+		Assert(t, code == 0, "%v failed:\n%s", args, output)
+	}
+
+	buf, err := os.ReadFile(logFile)
+	Ok(t, err)
+	Assert(t, !strings.Contains(string(buf), "hunter2"), "the audit log has a plain text value:\n%s", buf)
+	abs, err := filepath.Abs(file)
+	Ok(t, err)
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	fingerprint := fmt.Sprintf("%X", p.PublicKey.PrimaryKey.Fingerprint)
+	var operations []string
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var e audit.Entry
+		Ok(t, json.Unmarshal([]byte(line), &e))
+		Equals(t, abs, e.File)
+		Equals(t, fingerprint, e.KeyFingerprint)
+		operations = append(operations, e.Operation+" "+e.Path)
+	}
+	sort.Strings(operations)
+	Equals(t, []string{
+		"decrypt other", "decrypt secret", "decrypt secret", "encrypt other", "encrypt secret", "rotate other", "rotate secret", "write ", "write ",
+	}, operations)
+
+	output, code = run("audit", "verify")
+	Equals(t, 0, code)
+	Assert(t, strings.Contains(output, "9 entries, the chain is intact"), "unexpected output:\n%s", output)
+
+	// a changed entry breaks the chain
+	Ok(t, os.WriteFile(logFile, []byte(strings.Replace(string(buf), `"operation":"decrypt"`, `"operation":"encrypt"`, 1)), 0600))
+	output, code = run("audit", "verify", logFile)
+	Equals(t, 2, code)
+	Assert(t, strings.Contains(output, "tampered"), "unexpected output:\n%s", output)
+}
+
+func TestDecryptionKeyFingerprint(t *testing.T) {
+	pgpKeyName, publicKeyRing, secretKeyRing := getTestKeyRings()
+	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	Ok(t, err)
+	cipherText, err := p.EncryptSecret("secret")
+	Ok(t, err)
+
+	// the key comes from the message, not from the key selected
+	rings, err := pki.NewWithOptions(pki.Options{PublicKeyRing: publicKeyRing, SecretKeyRing: secretKeyRing, KeyOptional: true})
+	Ok(t, err)
+	Assert(t, rings.PublicKey == nil, "expected no key to be selected")
+	Equals(t, fmt.Sprintf("%X", p.PublicKey.PrimaryKey.Fingerprint), rings.DecryptionKeyFingerprint(cipherText))
+	Equals(t, "", (&pki.Pki{}).DecryptionKeyFingerprint(cipherText))
+}
+
 func TestKeyInfo(t *testing.T) {
 	pgpKeyName, publicKeyRing, secretKeyRing = getTestKeyRings()
 	topLevelElement = ""
@@ -476,7 +1803,8 @@ func TestKeyInfo(t *testing.T) {
 	filePath := "./testdata/new.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(filePath, *p, topLevelElement)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 
 	buffer, err := s.PerformAction("encrypt")
 	Ok(t, err)
@@ -506,7 +1834,8 @@ func TestEncryptProcessDir(t *testing.T) {
 	topLevelElement = ""
 
 	dirPath := "./testdata"
-	slsFiles, slsCount := utils.FindFilesByExt(dirPath, ".sls")
+	slsFiles, slsCount, err := utils.FindFilesByExt(dirPath, ".sls")
+	Ok(t, err)
 	Equals(t, 7, slsCount)
 
 	pk, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
@@ -515,10 +1844,11 @@ func TestEncryptProcessDir(t *testing.T) {
 	Ok(t, err)
 
 	for n := 0; n < slsCount; n++ {
-		s := sls.New(slsFiles[n], *pk, topLevelElement)
-		if s.IsInclude {
+		_, err := sls.New(slsFiles[n], *pk, topLevelElement)
+		if errors.Is(err, sls.ErrIncludeDirective) {
 			continue
 		}
+		Ok(t, err)
 		var buf []byte
 		buf, err = os.ReadFile(slsFiles[n])
 		Ok(t, err)
@@ -539,7 +1869,8 @@ func TestDecryptProcessDir(t *testing.T) {
 	topLevelElement = ""
 
 	dirPath := "./testdata"
-	slsFiles, slsCount := utils.FindFilesByExt(dirPath, ".sls")
+	slsFiles, slsCount, err := utils.FindFilesByExt(dirPath, ".sls")
+	Ok(t, err)
 	Equals(t, 7, slsCount)
 
 	pk, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
@@ -548,10 +1879,11 @@ func TestDecryptProcessDir(t *testing.T) {
 	Ok(t, err)
 
 	for n := 0; n < slsCount; n++ {
-		s := sls.New(slsFiles[n], *pk, topLevelElement)
-		if s.IsInclude {
+		_, err := sls.New(slsFiles[n], *pk, topLevelElement)
+		if errors.Is(err, sls.ErrIncludeDirective) {
 			continue
 		}
+		Ok(t, err)
 		var buf []byte
 		buf, err = os.ReadFile(slsFiles[n])
 		Ok(t, err)
@@ -871,10 +2203,11 @@ nested:
 			Ok(t, err)
 
 			// Try to create SLS object
-			s := sls.New(testFile, *p, topLevelElement)
-
-			// Try to perform an operation
-			_, err = s.PerformAction("encrypt")
+			s, err := sls.New(testFile, *p, topLevelElement)
+			if err == nil {
+				// Try to perform an operation
+				_, err = s.PerformAction("encrypt")
+			}
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("PerformAction() error = %v, wantErr %v", err, tt.wantErr)
@@ -897,7 +2230,8 @@ func TestPathOperationsEdgeCases(t *testing.T) {
 	filePath := "./testdata/new.sls"
 	p, err := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
 	Ok(t, err)
-	s := sls.New(filePath, *p, topLevelElement)
+	s, err := sls.New(filePath, *p, topLevelElement)
+	Ok(t, err)
 
 	tests := []struct {
 		name    string
@@ -967,10 +2301,14 @@ func TestConcurrentOperations(t *testing.T) {
 	for i := 0; i < numGoroutines; i++ {
 		go func(goroutineID int) {
 			for j, testFile := range testFiles {
-				s := sls.New(testFile, *p, topLevelElement)
+				s, err := sls.New(testFile, *p, topLevelElement)
+				if err != nil {
+					errors <- fmt.Errorf("goroutine %d, file %d: read failed: %v", goroutineID, j, err)
+					continue
+				}
 
 				// Perform encrypt operation
-				_, err := s.PerformAction("encrypt")
+				_, err = s.PerformAction("encrypt")
 				if err != nil {
 					errors <- fmt.Errorf("goroutine %d, file %d: encrypt failed: %v", goroutineID, j, err)
 					continue
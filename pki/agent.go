@@ -0,0 +1,501 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" // #nosec G505 -- keygrips are defined as SHA-1 digests
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
+	"github.com/keybase/go-crypto/rsa"
+)
+
+// BackendKeyring decrypts with the secret key ring loaded into the process
+const BackendKeyring = "keyring"
+
+// BackendAgent decrypts with the secret keys held by gpg-agent
+const BackendAgent = "agent"
+
+// assuan lines are limited to 1000 bytes including the command and line feed
+const assuanLineData = 900
+
+// AgentSocket returns the path of the gpg-agent socket for a GnuPG home directory,
+// falling back to the per user runtime directory newer versions of GnuPG use
+func AgentSocket(gnupgHome string) string {
+	socket := filepath.Join(gnupgHome, "S.gpg-agent")
+	if _, err := os.Stat(socket); err == nil {
+		return socket
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	runtimeSocket := filepath.Join(runtimeDir, "gnupg", "S.gpg-agent")
+	if _, err := os.Stat(runtimeSocket); err == nil {
+		return runtimeSocket
+	}
+
+	return socket
+}
+
+// Keygrip returns the keygrip gpg-agent uses to name an RSA key,
+// the SHA-1 digest of the modulus as an unsigned big endian MPI
+func Keygrip(key *packet.PublicKey) (string, error) {
+	pub, ok := key.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("key %X is not an RSA key, only RSA keys can be used with gpg-agent", key.KeyId)
+	}
+
+	modulus := pub.N.Bytes()
+	if len(modulus) > 0 && modulus[0]&0x80 != 0 {
+		modulus = append([]byte{0}, modulus...)
+	}
+	digest := sha1.Sum(modulus) // #nosec G401 -- keygrips are defined as SHA-1 digests
+	return fmt.Sprintf("%X", digest), nil
+}
+
+// decryptWithAgent decrypts a message with a secret key held by gpg-agent, the session
+// key is decrypted by the agent and the rest of the message is read here
+func (p *Pki) decryptWithAgent(cipherText string) (plainText string, sigErr error, err error) {
+	block, err := armor.Decode(strings.NewReader(cipherText))
+	if err != nil {
+		return cipherText, nil, fmt.Errorf("decode error: %w", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return cipherText, nil, fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
+	}
+
+	body := bufio.NewReader(block.Body)
+	cipherFunc, key, err := p.agentSessionKey(body)
+	if err != nil {
+		return cipherText, nil, err
+	}
+	se, err := readEncryptedData(body)
+	if err != nil {
+		return cipherText, nil, err
+	}
+	decrypted, err := se.Decrypt(cipherFunc, key)
+	if err != nil {
+		return cipherText, nil, fmt.Errorf("unable to decrypt PGP message: %s", err)
+	}
+
+	// what is left is a plain, possibly signed, message
+	md, err := openpgp.ReadMessage(decrypted, p.PubRing, nil, nil)
+	if err != nil {
+		return cipherText, nil, fmt.Errorf("unable to read PGP message: %s", err)
+	}
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return cipherText, nil, fmt.Errorf("unable to read message body: %s", err)
+	}
+	// closing checks the modification detection code
+	if err = decrypted.Close(); err != nil {
+		return cipherText, nil, fmt.Errorf("unable to read message body: %s", err)
+	}
+
+	return string(plain), p.checkSignature(md), nil
+}
+
+// agentSessionKey has gpg-agent decrypt the session key of the message, leaving the
+// reader at the encrypted data
+func (p *Pki) agentSessionKey(body *bufio.Reader) (packet.CipherFunction, []byte, error) {
+	sessionKeys, err := readSessionKeys(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	agent, err := dialAgent(p.AgentSocket)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer agent.Close()
+
+	for _, sessionKey := range sessionKeys {
+		if p.PubRing == nil {
+			break
+		}
+		for _, k := range p.PubRing.KeysById(sessionKey.keyID, nil) {
+			grip, err := Keygrip(k.PublicKey)
+			if err != nil || !agent.haveKey(grip) {
+				continue
+			}
+			frame, err := agent.pkDecrypt(grip, sessionKey.mpi)
+			if err != nil {
+				return 0, nil, err
+			}
+			return unpadSessionKey(frame)
+		}
+	}
+
+	return 0, nil, fmt.Errorf("%w in gpg-agent for encrypted key IDs %s", ErrNoSecretKey, formatIDs(sessionKeys))
+}
+
+// readEncryptedData reads the symmetrically encrypted data packet following the session keys
+func readEncryptedData(body io.Reader) (*packet.SymmetricallyEncrypted, error) {
+	pkt, err := packet.NewReader(body).Next()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PGP message: %s", err)
+	}
+	se, ok := pkt.(*packet.SymmetricallyEncrypted)
+	if !ok {
+		return nil, fmt.Errorf("unable to read PGP message: no encrypted data")
+	}
+	return se, nil
+}
+
+type sessionKey struct {
+	keyID uint64
+	mpi   []byte
+}
+
+func formatIDs(sessionKeys []sessionKey) string {
+	ids := make([]string, len(sessionKeys))
+	for i, k := range sessionKeys {
+		ids[i] = fmt.Sprintf("%X", k.keyID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// readSessionKeys reads the RSA public key encrypted session key packets at the start
+// of a message, leaving the reader at the encrypted data
+func readSessionKeys(r *bufio.Reader) ([]sessionKey, error) {
+	var keys []sessionKey
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return keys, fmt.Errorf("unable to read PGP message: %s", err)
+		}
+		if first[0]&0x80 == 0 {
+			return keys, fmt.Errorf("unable to read PGP message: bad packet header")
+		}
+		tag := (first[0] & 0x3f) >> 2
+		if first[0]&0x40 != 0 {
+			tag = first[0] & 0x3f
+		}
+		if tag != 1 {
+			return keys, nil
+		}
+
+		body, err := readPacketBody(r)
+		if err != nil {
+			return keys, fmt.Errorf("unable to read PGP message: %s", err)
+		}
+		// version 3, key ID, algorithm and the encrypted session key as an MPI
+		if len(body) < 12 || body[0] != 3 {
+			continue
+		}
+		algo := packet.PublicKeyAlgorithm(body[9])
+		if algo != packet.PubKeyAlgoRSA && algo != packet.PubKeyAlgoRSAEncryptOnly {
+			continue
+		}
+		bits := int(binary.BigEndian.Uint16(body[10:12]))
+		mpi := body[12:]
+		if len(mpi) < (bits+7)/8 {
+			return keys, fmt.Errorf("unable to read PGP message: short session key")
+		}
+		keys = append(keys, sessionKey{binary.BigEndian.Uint64(body[1:9]), mpi[:(bits+7)/8]})
+	}
+}
+
+// readPacketBody reads a whole packet with a definite length
+func readPacketBody(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var length int
+	if header&0x40 != 0 {
+		l0, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case l0 < 192:
+			length = int(l0)
+		case l0 < 224:
+			l1, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = (int(l0)-192)<<8 + int(l1) + 192
+		case l0 == 255:
+			var buf [4]byte
+			if _, err = io.ReadFull(r, buf[:]); err != nil {
+				return nil, err
+			}
+			length = int(binary.BigEndian.Uint32(buf[:]))
+		default:
+			return nil, fmt.Errorf("partial length session key packet")
+		}
+	} else {
+		sizes := []int{1, 2, 4}
+		lengthType := int(header & 3)
+		if lengthType == 3 {
+			return nil, fmt.Errorf("indeterminate length session key packet")
+		}
+		buf := make([]byte, sizes[lengthType])
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return body, err
+}
+
+// unpadSessionKey takes the PKCS#1 v1.5 frame returned by the agent, with or without its
+// leading zero, and returns the cipher and session key after checking the key's checksum
+func unpadSessionKey(frame []byte) (packet.CipherFunction, []byte, error) {
+	if len(frame) > 0 && frame[0] == 0 {
+		frame = frame[1:]
+	}
+	if len(frame) < 2 || frame[0] != 2 {
+		return 0, nil, fmt.Errorf("gpg-agent returned a badly padded session key")
+	}
+	sep := bytes.IndexByte(frame[1:], 0)
+	if sep < 0 {
+		return 0, nil, fmt.Errorf("gpg-agent returned a badly padded session key")
+	}
+	frame = frame[sep+2:]
+
+	// cipher, key and a two byte checksum of the key
+	if len(frame) < 4 {
+		return 0, nil, fmt.Errorf("gpg-agent returned a short session key")
+	}
+	cipherFunc := packet.CipherFunction(frame[0])
+	key := frame[1 : len(frame)-2]
+	var checksum uint16
+	for _, b := range key {
+		checksum += uint16(b)
+	}
+	if checksum != binary.BigEndian.Uint16(frame[len(frame)-2:]) {
+		return 0, nil, fmt.Errorf("session key checksum mismatch")
+	}
+	if cipherFunc.KeySize() != len(key) {
+		return 0, nil, fmt.Errorf("session key does not fit cipher %d", cipherFunc)
+	}
+
+	return cipherFunc, key, nil
+}
+
+// agentConn is a connection to gpg-agent speaking the Assuan protocol
+type agentConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialAgent(socket string) (*agentConn, error) {
+	socket = agentRedirect(socket)
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to gpg-agent at '%s': %w", socket, err)
+	}
+
+	agent := &agentConn{conn: conn, reader: bufio.NewReader(conn)}
+	if _, _, err = agent.response(nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("gpg-agent greeting: %w", err)
+	}
+	return agent, nil
+}
+
+// agentRedirect follows the redirect files GnuPG leaves in place of sockets
+func agentRedirect(socket string) string {
+	fi, err := os.Stat(socket)
+	if err != nil || !fi.Mode().IsRegular() {
+		return socket
+	}
+	content, err := os.ReadFile(filepath.Clean(socket))
+	if err != nil || !bytes.HasPrefix(content, []byte("%Assuan%")) {
+		return socket
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "socket=") {
+			return os.ExpandEnv(strings.TrimPrefix(line, "socket="))
+		}
+	}
+	return socket
+}
+
+func (a *agentConn) Close() error {
+	return a.conn.Close()
+}
+
+func (a *agentConn) haveKey(grip string) bool {
+	_, _, err := a.transact("HAVEKEY "+grip, nil)
+	return err == nil
+}
+
+// pkDecrypt asks the agent to decrypt an RSA encrypted value with the key with the given keygrip
+func (a *agentConn) pkDecrypt(grip string, mpi []byte) ([]byte, error) {
+	if _, _, err := a.transact("SETKEY "+grip, nil); err != nil {
+		return nil, fmt.Errorf("gpg-agent SETKEY: %w", err)
+	}
+	// the description is shown by pinentry when the key needs a passphrase
+	_, _, _ = a.transact("SETKEYDESC Decrypting+a+secure+pillar+value", nil)
+
+	cipherText := []byte(fmt.Sprintf("(7:enc-val(3:rsa(1:a%d:", len(mpi)))
+	cipherText = append(cipherText, mpi...)
+	cipherText = append(cipherText, ")))"...)
+
+	data, _, err := a.transact("PKDECRYPT", func(keyword string) ([]byte, error) {
+		if keyword != "CIPHERTEXT" {
+			return nil, fmt.Errorf("unexpected inquiry %s", keyword)
+		}
+		return cipherText, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gpg-agent PKDECRYPT: %w", err)
+	}
+
+	return parseSexpValue(data)
+}
+
+// parseSexpValue returns the data of a canonical (5:value<n>:<data>) s-expression
+func parseSexpValue(sexp []byte) ([]byte, error) {
+	const prefix = "(5:value"
+	if !bytes.HasPrefix(sexp, []byte(prefix)) {
+		return nil, fmt.Errorf("unexpected gpg-agent result")
+	}
+	rest := sexp[len(prefix):]
+	colon := bytes.IndexByte(rest, ':')
+	if colon < 0 {
+		return nil, fmt.Errorf("unexpected gpg-agent result")
+	}
+	n, err := strconv.Atoi(string(rest[:colon]))
+	if err != nil || n < 0 || len(rest) < colon+1+n {
+		return nil, fmt.Errorf("unexpected gpg-agent result")
+	}
+	return rest[colon+1 : colon+1+n], nil
+}
+
+// transact sends a command and reads the response, answering any inquiries
+func (a *agentConn) transact(command string, inquire func(keyword string) ([]byte, error)) ([]byte, []string, error) {
+	if _, err := fmt.Fprintf(a.conn, "%s\n", command); err != nil {
+		return nil, nil, err
+	}
+	return a.response(inquire)
+}
+
+// response reads data, status and inquiry lines up to the closing OK or ERR
+func (a *agentConn) response(inquire func(keyword string) ([]byte, error)) ([]byte, []string, error) {
+	var data bytes.Buffer
+	var status []string
+
+	for {
+		line, err := a.reader.ReadString('\n')
+		if err != nil {
+			return nil, status, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.Bytes(), status, nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, status, fmt.Errorf("%s", strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			data.Write(assuanUnescape(line[2:]))
+		case strings.HasPrefix(line, "S "):
+			status = append(status, line[2:])
+		case strings.HasPrefix(line, "INQUIRE "):
+			keyword := strings.Fields(line[8:])[0]
+			if inquire == nil {
+				_, _ = fmt.Fprint(a.conn, "CAN\n")
+				continue
+			}
+			reply, err := inquire(keyword)
+			if err != nil {
+				_, _ = fmt.Fprint(a.conn, "CAN\n")
+				continue
+			}
+			if err = a.sendData(reply); err != nil {
+				return nil, status, err
+			}
+		}
+	}
+}
+
+// sendData answers an inquiry with escaped data lines and END
+func (a *agentConn) sendData(data []byte) error {
+	escaped := assuanEscape(data)
+	for len(escaped) > 0 {
+		n := assuanLineData
+		if n > len(escaped) {
+			n = len(escaped)
+		}
+		// do not split an escape sequence across lines
+		for n > 0 && n < len(escaped) && (escaped[n-1] == '%' || (n > 1 && escaped[n-2] == '%')) {
+			n--
+		}
+		if _, err := fmt.Fprintf(a.conn, "D %s\n", escaped[:n]); err != nil {
+			return err
+		}
+		escaped = escaped[n:]
+	}
+	_, err := fmt.Fprint(a.conn, "END\n")
+	return err
+}
+
+func assuanEscape(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		if c == '%' || c == '\r' || c == '\n' || c == '\\' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func assuanUnescape(line string) []byte {
+	var out []byte
+	for i := 0; i < len(line); i++ {
+		if line[i] == '%' && i+2 < len(line) {
+			if v, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, line[i])
+	}
+	return out
+}
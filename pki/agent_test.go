@@ -0,0 +1,223 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
+	"github.com/keybase/go-crypto/rsa"
+)
+
+// fakeAgent is a stand-in gpg-agent that answers HAVEKEY, SETKEY and PKDECRYPT for one RSA key
+type fakeAgent struct {
+	grip string
+	key  *rsa.PrivateKey
+}
+
+func (f *fakeAgent) serve(t *testing.T, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(t, conn)
+	}
+}
+
+func (f *fakeAgent) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "OK Pleased to meet you\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "HAVEKEY", "SETKEY":
+			if len(fields) < 2 || fields[1] != f.grip {
+				fmt.Fprint(conn, "ERR 67108881 No secret key <GPG Agent>\n")
+				continue
+			}
+			fmt.Fprint(conn, "OK\n")
+		case "PKDECRYPT":
+			fmt.Fprint(conn, "INQUIRE CIPHERTEXT\n")
+			var sexp []byte
+			for {
+				line, err = reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\n")
+				if line == "END" {
+					break
+				}
+				sexp = append(sexp, assuanUnescape(strings.TrimPrefix(line, "D "))...)
+			}
+			a, err := parseSexpA(sexp)
+			if err != nil {
+				t.Errorf("fake agent: %s", err)
+				fmt.Fprint(conn, "ERR 1 bad ciphertext\n")
+				continue
+			}
+			// a raw RSA decryption, the agent leaves the PKCS#1 padding in place
+			m := new(big.Int).Exp(new(big.Int).SetBytes(a), f.key.D, f.key.N)
+			value := m.Bytes()
+			result := append([]byte(fmt.Sprintf("(5:value%d:", len(value))), value...)
+			result = append(result, ')')
+			fmt.Fprintf(conn, "S PADDING 0\nD %s\nOK\n", assuanEscape(result))
+		default:
+			fmt.Fprint(conn, "OK\n")
+		}
+	}
+}
+
+func parseSexpA(sexp []byte) ([]byte, error) {
+	i := bytes.Index(sexp, []byte("(1:a"))
+	if i < 0 {
+		return nil, fmt.Errorf("no value in %q", sexp)
+	}
+	rest := sexp[i+4:]
+	colon := bytes.IndexByte(rest, ':')
+	n, err := strconv.Atoi(string(rest[:colon]))
+	if err != nil {
+		return nil, err
+	}
+	return rest[colon+1 : colon+1+n], nil
+}
+
+func newAgentTestKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Agent Test", "", "agent@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// self signatures are made when the private key is serialized
+	if err = entity.SerializePrivate(io.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return entity, armored.String()
+}
+
+// TestAgentDecrypt tests decryption through a stand-in gpg-agent socket
+func TestAgentDecrypt(t *testing.T) {
+	t.Parallel()
+	entity, armoredKey := newAgentTestKey(t)
+	subkey := entity.Subkeys[0]
+	grip, err := Keygrip(subkey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "S.gpg-agent")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	agent := &fakeAgent{grip: grip, key: subkey.PrivateKey.PrivateKey.(*rsa.PrivateKey)}
+	go agent.serve(t, listener)
+
+	p, err := NewWithOptions(Options{PublicKeyData: armoredKey, Backend: BackendAgent, AgentSocket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", strings.Repeat("a longer secret value\n", 100)} {
+		cipherText, err := p.EncryptSecret(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainText, err := p.DecryptSecret(cipherText)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plainText != secret {
+			t.Errorf("expected %q, got %q", secret, plainText)
+		}
+	}
+
+	// the agent does not hold the key of a different key pair
+	agent.grip = "0000000000000000000000000000000000000000"
+	cipherText, err := p.EncryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.DecryptSecret(cipherText); err == nil || !strings.Contains(err.Error(), "no secret key") {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
+
+// TestUnpadSessionKey tests session key frames with and without the leading zero
+func TestUnpadSessionKey(t *testing.T) {
+	t.Parallel()
+	key := bytes.Repeat([]byte{7}, 32)
+	var checksum uint16
+	for _, b := range key {
+		checksum += uint16(b)
+	}
+	frame := append([]byte{2, 0xff, 0xee, 0}, byte(packet.CipherAES256))
+	frame = append(frame, key...)
+	frame = append(frame, byte(checksum>>8), byte(checksum))
+
+	for _, f := range [][]byte{frame, append([]byte{0}, frame...)} {
+		cipherFunc, sessionKey, err := unpadSessionKey(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cipherFunc != packet.CipherAES256 || !bytes.Equal(sessionKey, key) {
+			t.Errorf("unexpected session key %d %x", cipherFunc, sessionKey)
+		}
+	}
+
+	frame[len(frame)-1]++
+	if _, _, err := unpadSessionKey(frame); err == nil {
+		t.Error("expected checksum error")
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"bufio"
+	"crypto"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
+)
+
+// MinRSABits is the smallest RSA key size allowed for generated keys
+const MinRSABits = 2048
+
+// ciphers are the symmetric ciphers values can be encrypted with, weakest first
+var ciphers = map[string]packet.CipherFunction{
+	"cast5":  packet.CipherCAST5,
+	"aes128": packet.CipherAES128,
+	"aes256": packet.CipherAES256,
+}
+
+// hashes are the hashes values can be signed with
+var hashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+var compressions = map[string]packet.CompressionAlgo{
+	"none": packet.CompressionNone,
+	"zip":  packet.CompressionZIP,
+	"zlib": packet.CompressionZLIB,
+}
+
+// CryptoOptions names the algorithms used to encrypt values and to generate keys,
+// empty values keep the library defaults
+type CryptoOptions struct {
+	// Cipher is aes256, aes128 or cast5, it is also the weakest cipher verify accepts
+	Cipher string `yaml:"cipher,omitempty"`
+	// Hash is sha256, sha512 or sha1 for signed values, it is also the weakest hash verify accepts
+	Hash string `yaml:"hash,omitempty"`
+	// Compression is none, zip or zlib
+	Compression string `yaml:"compression,omitempty"`
+	// CompressionLevel is 1 (fastest) to 9 (smallest), 0 for the default level
+	CompressionLevel int `yaml:"compression_level,omitempty"`
+	// RSABits is the size of generated RSA keys
+	RSABits int `yaml:"rsa_bits,omitempty"`
+	// AEAD is refused, the OpenPGP library cannot write AEAD packets so values are always
+	// encrypted with a modification detection code instead
+	AEAD string `yaml:"aead,omitempty"`
+}
+
+// Config returns the packet config for the options, nil when no option is set
+func (c CryptoOptions) Config() (*packet.Config, error) {
+	if c == (CryptoOptions{}) {
+		return nil, nil
+	}
+
+	if c.AEAD != "" {
+		return nil, fmt.Errorf("AEAD mode '%s' is not supported, the OpenPGP library used cannot write AEAD packets", c.AEAD)
+	}
+
+	config := &packet.Config{}
+	if c.Cipher != "" {
+		cipher, ok := ciphers[strings.ToLower(c.Cipher)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher '%s', use %s", c.Cipher, names(ciphers))
+		}
+		config.DefaultCipher = cipher
+	}
+	if c.Hash != "" {
+		hash, ok := hashes[strings.ToLower(c.Hash)]
+		if !ok {
+			return nil, fmt.Errorf("unknown hash '%s', use %s", c.Hash, names(hashes))
+		}
+		config.DefaultHash = hash
+	}
+	if c.Compression != "" {
+		compression, ok := compressions[strings.ToLower(c.Compression)]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression '%s', use %s", c.Compression, names(compressions))
+		}
+		config.DefaultCompressionAlgo = compression
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > 9 {
+		return nil, fmt.Errorf("compression level %d is not between 1 and 9", c.CompressionLevel)
+	}
+	if c.CompressionLevel != 0 {
+		config.CompressionConfig = &packet.CompressionConfig{Level: c.CompressionLevel}
+	}
+	if c.RSABits != 0 && c.RSABits < MinRSABits {
+		return nil, fmt.Errorf("RSA key size %d is below the minimum of %d bits", c.RSABits, MinRSABits)
+	}
+	config.RSABits = c.RSABits
+
+	return config, nil
+}
+
+func names[T comparable](algorithms map[string]T) string {
+	list := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// checkPreferences makes sure the key accepts the configured cipher and hash, as the
+// library would otherwise quietly fall back to an algorithm the key prefers
+func checkPreferences(entity *openpgp.Entity, config *packet.Config) error {
+	if config == nil {
+		return nil
+	}
+	identity := primaryIdentity(entity)
+	if identity == nil || identity.SelfSignature == nil {
+		return nil
+	}
+
+	sig := identity.SelfSignature
+	if config.DefaultCipher != 0 && len(sig.PreferredSymmetric) > 0 && !containsID(sig.PreferredSymmetric, uint8(config.DefaultCipher)) {
+		return fmt.Errorf("key does not accept cipher %s", CipherName(config.DefaultCipher))
+	}
+	if config.DefaultHash != 0 && len(sig.PreferredHash) > 0 && !containsID(sig.PreferredHash, hashID(config.DefaultHash)) {
+		return fmt.Errorf("key does not accept hash %s", HashName(config.DefaultHash))
+	}
+
+	return nil
+}
+
+func containsID(ids []uint8, id uint8) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// hashID is the OpenPGP ID of a hash, see RFC 4880 section 9.4
+func hashID(hash crypto.Hash) uint8 {
+	switch hash {
+	case crypto.SHA1:
+		return 2
+	case crypto.SHA256:
+		return 8
+	case crypto.SHA384:
+		return 9
+	case crypto.SHA512:
+		return 10
+	case crypto.SHA224:
+		return 11
+	}
+	return 0
+}
+
+// CipherName returns the name of a symmetric cipher
+func CipherName(cipher packet.CipherFunction) string {
+	switch cipher {
+	case packet.Cipher3DES:
+		return "3des"
+	case packet.CipherAES192:
+		return "aes192"
+	}
+	for name, c := range ciphers {
+		if c == cipher {
+			return name
+		}
+	}
+	return fmt.Sprintf("cipher %d", cipher)
+}
+
+// HashName returns the name of a hash
+func HashName(hash crypto.Hash) string {
+	for name, h := range hashes {
+		if h == hash {
+			return name
+		}
+	}
+	return strings.ToLower(strings.ReplaceAll(hash.String(), "-", ""))
+}
+
+// cipherStrength orders ciphers by key size
+func cipherStrength(cipher packet.CipherFunction) int {
+	switch cipher {
+	case packet.Cipher3DES, packet.CipherCAST5:
+		return 1
+	case packet.CipherAES128:
+		return 2
+	case packet.CipherAES192:
+		return 3
+	case packet.CipherAES256:
+		return 4
+	}
+	return 0
+}
+
+// hashStrength orders hashes by digest size, broken hashes first
+func hashStrength(hash crypto.Hash) int {
+	switch hash {
+	case crypto.MD5:
+		return 1
+	case crypto.SHA1, crypto.RIPEMD160:
+		return 2
+	}
+	return hash.Size()
+}
+
+// encryptCompressed opens a compressed message to the encryption key, openpgp.Encrypt
+// never compresses so the packets are written here. Only compression is added, the message
+// is the same integrity protected packet openpgp.Encrypt writes, there is no AEAD mode.
+func (p *Pki) encryptCompressed(ciphertext io.Writer, hints *openpgp.FileHints) (io.WriteCloser, error) {
+	keys := openpgp.EntityList{p.PublicKey}.KeysById(p.EncryptionKeyID, nil)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption key for '%s'", p.PgpKeyName)
+	}
+	for _, recipient := range p.Recipients {
+		id, _, _ := ValidateKey(recipient, time.Now())
+		recipientKeys := openpgp.EntityList{recipient}.KeysById(id, nil)
+		if len(recipientKeys) == 0 {
+			return nil, fmt.Errorf("no encryption key for recipient %X", recipient.PrimaryKey.Fingerprint)
+		}
+		keys = append(keys, recipientKeys[0])
+	}
+
+	cipher := p.Config.Cipher()
+	key := make([]byte, cipher.KeySize())
+	if _, err := io.ReadFull(p.Config.Random(), key); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err := packet.SerializeEncryptedKey(ciphertext, k.PublicKey, cipher, key, p.Config); err != nil {
+			return nil, err
+		}
+	}
+	encrypted, err := packet.SerializeSymmetricallyEncrypted(ciphertext, cipher, key, p.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// a signed message is compressed by AttachedSign
+	if p.Signer != nil {
+		return openpgp.AttachedSign(encrypted, *p.Signer, hints, p.Config)
+	}
+	compressed, err := packet.SerializeCompressed(encrypted, p.Config.Compression(), p.Config.CompressionConfig)
+	if err != nil {
+		return nil, err
+	}
+	return packet.SerializeLiteral(compressed, hints.IsBinary, hints.FileName, 0)
+}
+
+// Algorithms are the algorithms a message was encrypted, compressed and signed with
+type Algorithms struct {
+	Cipher      packet.CipherFunction
+	Compression packet.CompressionAlgo
+	// Hash is the signature hash, zero for unsigned messages
+	Hash crypto.Hash
+}
+
+// MessageAlgorithms decrypts the session key of the message to find the algorithms it
+// was written with
+func (p *Pki) MessageAlgorithms(cipherText string) (Algorithms, error) {
+	var algorithms Algorithms
+
+	block, err := armor.Decode(strings.NewReader(cipherText))
+	if err != nil {
+		return algorithms, fmt.Errorf("decode error: %w", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return algorithms, fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
+	}
+
+	var se *packet.SymmetricallyEncrypted
+	var key []byte
+	body := bufio.NewReader(block.Body)
+	if p.AgentSocket != "" {
+		algorithms.Cipher, key, err = p.agentSessionKey(body)
+		if err == nil {
+			se, err = readEncryptedData(body)
+		}
+	} else {
+		algorithms.Cipher, key, se, err = p.keyringSessionKey(body)
+	}
+	if err != nil {
+		return algorithms, err
+	}
+
+	decrypted, err := se.Decrypt(algorithms.Cipher, key)
+	if err != nil {
+		return algorithms, fmt.Errorf("unable to decrypt PGP message: %s", err)
+	}
+	defer decrypted.Close()
+
+	// a compressed message, then a one pass signature for signed messages
+	plain := bufio.NewReader(decrypted)
+	algorithms.Compression = peekCompression(plain)
+	pkt, err := packet.NewReader(plain).Next()
+	if err != nil {
+		return algorithms, fmt.Errorf("unable to read PGP message: %s", err)
+	}
+	if compressed, ok := pkt.(*packet.Compressed); ok {
+		if pkt, err = packet.NewReader(compressed.Body).Next(); err != nil {
+			return algorithms, fmt.Errorf("unable to read PGP message: %s", err)
+		}
+	}
+	if ops, ok := pkt.(*packet.OnePassSignature); ok {
+		algorithms.Hash = ops.Hash
+	}
+
+	return algorithms, nil
+}
+
+// keyringSessionKey decrypts the session key of the message with the secret key ring
+func (p *Pki) keyringSessionKey(body *bufio.Reader) (packet.CipherFunction, []byte, *packet.SymmetricallyEncrypted, error) {
+	if p.SecRing == nil {
+		return 0, nil, nil, fmt.Errorf("%w, no secring set", ErrNoSecretKey)
+	}
+
+	var sessionKey *packet.EncryptedKey
+	packets := packet.NewReader(body)
+	for {
+		pkt, err := packets.Next()
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("unable to read PGP message: %s", err)
+		}
+		switch pkt := pkt.(type) {
+		case *packet.EncryptedKey:
+			if sessionKey != nil {
+				continue
+			}
+			for _, k := range p.SecRing.KeysById(pkt.KeyId, nil) {
+				if k.PrivateKey == nil || k.PrivateKey.Encrypted {
+					continue
+				}
+				if pkt.Decrypt(k.PrivateKey, nil) == nil {
+					sessionKey = pkt
+					break
+				}
+			}
+		case *packet.SymmetricallyEncrypted:
+			if sessionKey == nil {
+				return 0, nil, nil, fmt.Errorf("%w for the encrypted key IDs", ErrNoSecretKey)
+			}
+			return sessionKey.CipherFunc, sessionKey.Key, pkt, nil
+		}
+	}
+}
+
+// peekCompression returns the algorithm of a compressed data packet at the start of r,
+// or CompressionNone when the message is not compressed
+func peekCompression(r *bufio.Reader) packet.CompressionAlgo {
+	header, err := r.Peek(2)
+	if err != nil || header[0]&0x80 == 0 {
+		return packet.CompressionNone
+	}
+
+	var tag byte
+	var offset int
+	if header[0]&0x40 != 0 {
+		tag = header[0] & 0x3f
+		switch {
+		case header[1] < 192, header[1] >= 224 && header[1] < 255:
+			offset = 2
+		case header[1] < 224:
+			offset = 3
+		default:
+			offset = 6
+		}
+	} else {
+		tag = (header[0] & 0x3f) >> 2
+		offset = 1 + []int{1, 2, 4, 0}[header[0]&3]
+	}
+	// tag 8 is compressed data, its body starts with the algorithm
+	if tag != 8 {
+		return packet.CompressionNone
+	}
+	header, err = r.Peek(offset + 1)
+	if err != nil {
+		return packet.CompressionNone
+	}
+
+	return packet.CompressionAlgo(header[offset])
+}
+
+// CheckAlgorithms returns an error when a message was written with a weaker cipher or
+// hash than the configured ones
+func (p *Pki) CheckAlgorithms(algorithms Algorithms) error {
+	if p.Config == nil {
+		return nil
+	}
+
+	var weak []string
+	if p.Config.DefaultCipher != 0 && cipherStrength(algorithms.Cipher) < cipherStrength(p.Config.DefaultCipher) {
+		weak = append(weak, fmt.Sprintf("cipher %s is weaker than %s", CipherName(algorithms.Cipher), CipherName(p.Config.DefaultCipher)))
+	}
+	if p.Config.DefaultHash != 0 && algorithms.Hash != 0 && hashStrength(algorithms.Hash) < hashStrength(p.Config.DefaultHash) {
+		weak = append(weak, fmt.Sprintf("hash %s is weaker than %s", HashName(algorithms.Hash), HashName(p.Config.DefaultHash)))
+	}
+	if len(weak) > 0 {
+		return fmt.Errorf("%s", strings.Join(weak, ", "))
+	}
+
+	return nil
+}
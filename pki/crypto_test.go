@@ -0,0 +1,82 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+)
+
+// TestEncryptCompressedRoundTrip tests that the packets written for each compression are
+// read back by openpgp.ReadMessage
+func TestEncryptCompressedRoundTrip(t *testing.T) {
+	t.Parallel()
+	entity, armoredKey := newAgentTestKey(t)
+	secret := strings.Repeat("a longer secret value\n", 100)
+
+	sizes := map[string]int{}
+	for _, compression := range []string{"none", "zip", "zlib"} {
+		for _, level := range []int{0, 1, 9} {
+			name := fmt.Sprintf("%s/%d", compression, level)
+			p, err := NewWithOptions(Options{
+				PublicKeyData: armoredKey,
+				Crypto:        CryptoOptions{Compression: compression, CompressionLevel: level},
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			cipherText, err := p.EncryptSecret(secret)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			block, err := armor.Decode(strings.NewReader(cipherText))
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			plainText, err := io.ReadAll(md.UnverifiedBody)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if !md.IsEncrypted || !bytes.Equal([]byte(secret), plainText) {
+				t.Errorf("%s: expected the secret back, got encrypted %t %q", name, md.IsEncrypted, plainText)
+			}
+			if len(md.EncryptedToKeyIds) != 1 || md.EncryptedToKeyIds[0] != p.EncryptionKeyID {
+				t.Errorf("%s: expected a message to %X, got %X", name, p.EncryptionKeyID, md.EncryptedToKeyIds)
+			}
+			sizes[name] = len(cipherText)
+		}
+	}
+
+	if sizes["zlib/9"] >= sizes["none/0"] || sizes["zip/9"] >= sizes["none/0"] {
+		t.Errorf("expected compressed messages to be smaller, got %v", sizes)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
+)
+
+// DefaultRSABits is the size of generated RSA keys when the crypto settings do not set one
+const DefaultRSABits = 4096
+
+// KeyFiles are the files written for a generated key
+type KeyFiles struct {
+	PublicKeyRing    string
+	SecretKeyRing    string
+	ArmoredPublicKey string
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+
+// GenerateKey creates an RSA key with an encryption subkey, its secret key is not
+// protected by a passphrase so a salt master can use it unattended
+func GenerateKey(name string, comment string, email string, config *packet.Config) (*openpgp.Entity, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("key name cannot be empty")
+	}
+
+	cfg := packet.Config{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.RSABits == 0 {
+		cfg.RSABits = DefaultRSABits
+	}
+
+	entity, err := openpgp.NewEntity(name, comment, email, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	// serializing signs the identity and the encryption subkey
+	if err = entity.SerializePrivate(io.Discard, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to sign key: %w", err)
+	}
+
+	return entity, nil
+}
+
+// WriteKeyFiles writes the key in dir the way the salt gpg renderer expects it, as
+// pubring.gpg and secring.gpg, along with an ASCII armored public key named after the
+// key to hand out. The directory is created when missing and existing files are never
+// overwritten.
+func WriteKeyFiles(entity *openpgp.Entity, dir string) (KeyFiles, error) {
+	identity := primaryIdentity(entity)
+	if identity == nil {
+		return KeyFiles{}, fmt.Errorf("key has no identity")
+	}
+	slug := strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(identity.UserId.Name), "-"), "-")
+	if slug == "" {
+		slug = fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+	}
+	files := KeyFiles{
+		PublicKeyRing:    filepath.Join(dir, "pubring.gpg"),
+		SecretKeyRing:    filepath.Join(dir, "secring.gpg"),
+		ArmoredPublicKey: filepath.Join(dir, slug+".asc"),
+	}
+
+	var public, secret, armored bytes.Buffer
+	if err := entity.Serialize(&public); err != nil {
+		return files, fmt.Errorf("unable to serialize public key: %w", err)
+	}
+	if err := entity.SerializePrivate(&secret, nil); err != nil {
+		return files, fmt.Errorf("unable to serialize secret key: %w", err)
+	}
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return files, fmt.Errorf("encode error: %w", err)
+	}
+	if _, err = w.Write(public.Bytes()); err != nil {
+		return files, fmt.Errorf("encode error: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return files, fmt.Errorf("encode error: %w", err)
+	}
+
+	// GnuPG refuses homes other users can read
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return files, fmt.Errorf("unable to create key directory: %w", err)
+	}
+	for _, file := range []string{files.PublicKeyRing, files.SecretKeyRing, files.ArmoredPublicKey} {
+		if _, err = os.Stat(file); err == nil {
+			return files, fmt.Errorf("key file %s already exists", file)
+		}
+	}
+	if err = writeNewFile(files.SecretKeyRing, secret.Bytes(), 0600); err != nil {
+		return files, err
+	}
+	if err = writeNewFile(files.PublicKeyRing, public.Bytes(), 0600); err != nil {
+		return files, err
+	}
+	if err = writeNewFile(files.ArmoredPublicKey, armored.Bytes(), 0644); err != nil {
+		return files, err
+	}
+
+	return files, nil
+}
+
+// writeNewFile writes a file that must not exist yet
+func writeNewFile(file string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filepath.Clean(file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", file, err)
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to write %s: %w", file, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("unable to write %s: %w", file, err)
+	}
+	return nil
+}
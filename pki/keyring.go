@@ -0,0 +1,369 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+)
+
+// KeyRing is a binary key ring file managed by the tool. Keys are kept as the packets
+// they were read from, so writing the ring back never re-signs or re-encrypts a key.
+type KeyRing struct {
+	Path string
+	keys []ringKey
+}
+
+type ringKey struct {
+	// entity is nil for keys the OpenPGP library cannot read, they are kept as they are
+	entity *openpgp.Entity
+	raw    []byte
+}
+
+// RingKey describes a key in a key ring
+type RingKey struct {
+	KeyInfo `yaml:",inline"`
+	Secret  bool   `json:"secret" yaml:"secret"`
+	Expires string `json:"expires,omitempty" yaml:"expires,omitempty"`
+	// Problem is why the key cannot be used for encryption, empty for valid keys
+	Problem string `json:"problem,omitempty" yaml:"problem,omitempty"`
+}
+
+// OpenKeyRing reads a binary or ASCII armored key ring, a missing file is an empty ring
+func OpenKeyRing(path string) (*KeyRing, error) {
+	ring := &KeyRing{Path: path}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return ring, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key ring '%s': %w", path, err)
+	}
+	if err = ring.add(data); err != nil {
+		return nil, fmt.Errorf("cannot read key ring '%s': %w", path, err)
+	}
+	return ring, nil
+}
+
+// Entities returns the keys in the ring
+func (r *KeyRing) Entities() openpgp.EntityList {
+	var list openpgp.EntityList
+	for _, key := range r.keys {
+		if key.entity != nil {
+			list = append(list, key.entity)
+		}
+	}
+	return list
+}
+
+// Find returns the key matching a fingerprint, key ID or identity the same way key names
+// are matched when encrypting, nil when nothing matches and an error when several keys do
+func (r *KeyRing) Find(id string) (*openpgp.Entity, error) {
+	list := r.Entities()
+	return findKey(&list, id)
+}
+
+// ListKeys describes the keys in the public and secret key rings, a key is listed once
+// and marked secret when its secret key is in the secret key ring
+func ListKeys(pubRing *KeyRing, secRing *KeyRing) []RingKey {
+	list := []RingKey{}
+	index := map[[20]byte]int{}
+	for _, ring := range []*KeyRing{pubRing, secRing} {
+		if ring == nil {
+			continue
+		}
+		for _, entity := range ring.Entities() {
+			secret := entity.PrivateKey != nil
+			if i, ok := index[entity.PrimaryKey.Fingerprint]; ok {
+				list[i].Secret = list[i].Secret || secret
+				continue
+			}
+
+			key := RingKey{KeyInfo: keyInfo(entity, entity.PrimaryKey), Secret: secret}
+			_, expires, err := ValidateKey(entity, time.Now())
+			if !expires.IsZero() {
+				key.Expires = expires.UTC().Format(time.RFC3339)
+			}
+			if err != nil {
+				key.Problem = err.Error()
+			}
+			index[entity.PrimaryKey.Fingerprint] = len(list)
+			list = append(list, key)
+		}
+	}
+	return list
+}
+
+// Remove takes the key with the given fingerprint out of the ring
+func (r *KeyRing) Remove(fingerprint [20]byte) bool {
+	for i, key := range r.keys {
+		if key.entity != nil && key.entity.PrimaryKey.Fingerprint == fingerprint {
+			r.keys = append(r.keys[:i], r.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Export returns the key with the given fingerprint ASCII armored, with its secret key
+// when secret is set
+func (r *KeyRing) Export(fingerprint [20]byte, secret bool) ([]byte, error) {
+	for _, key := range r.keys {
+		if key.entity == nil || key.entity.PrimaryKey.Fingerprint != fingerprint {
+			continue
+		}
+
+		blockType := openpgp.PublicKeyType
+		raw := key.raw
+		if secret {
+			if key.entity.PrivateKey == nil {
+				return nil, fmt.Errorf("key %X has no secret key in '%s'", fingerprint, r.Path)
+			}
+			blockType = openpgp.PrivateKeyType
+		} else if key.entity.PrivateKey != nil {
+			var public bytes.Buffer
+			if err := key.entity.Serialize(&public); err != nil {
+				return nil, fmt.Errorf("unable to serialize public key: %w", err)
+			}
+			raw = public.Bytes()
+		}
+
+		var armored bytes.Buffer
+		w, err := armor.Encode(&armored, blockType, nil)
+		if err != nil {
+			return nil, fmt.Errorf("encode error: %w", err)
+		}
+		if _, err = w.Write(raw); err != nil {
+			return nil, fmt.Errorf("encode error: %w", err)
+		}
+		if err = w.Close(); err != nil {
+			return nil, fmt.Errorf("encode error: %w", err)
+		}
+		return armored.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("key %X is not in '%s'", fingerprint, r.Path)
+}
+
+// Save writes the ring back as a binary key ring, replacing the file in one step
+func (r *KeyRing) Save() error {
+	var data bytes.Buffer
+	for _, key := range r.keys {
+		data.Write(key.raw)
+	}
+
+	dir := filepath.Dir(r.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create key ring directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(r.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write key ring '%s': %w", r.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data.Bytes()); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("unable to write key ring '%s': %w", r.Path, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write key ring '%s': %w", r.Path, err)
+	}
+	if err = os.Rename(tmp.Name(), r.Path); err != nil {
+		return fmt.Errorf("unable to write key ring '%s': %w", r.Path, err)
+	}
+	return nil
+}
+
+// ImportKeys adds binary or ASCII armored keys to the rings, public keys to the public
+// ring and secret keys to both, and returns the keys imported. A key already in a ring
+// is replaced by the imported copy.
+func ImportKeys(data []byte, pubRing *KeyRing, secRing *KeyRing) ([]*openpgp.Entity, error) {
+	incoming := &KeyRing{}
+	var imported []*openpgp.Entity
+	if err := incoming.add(data); err != nil {
+		return nil, err
+	}
+
+	for _, key := range incoming.keys {
+		if key.entity == nil {
+			continue
+		}
+		if key.entity.PrivateKey == nil {
+			pubRing.put(key)
+			imported = append(imported, key.entity)
+			continue
+		}
+
+		if secRing == nil {
+			return imported, fmt.Errorf("no secret key ring to import secret key %X to", key.entity.PrimaryKey.Fingerprint)
+		}
+		var public bytes.Buffer
+		if err := key.entity.Serialize(&public); err != nil {
+			return imported, fmt.Errorf("unable to serialize public key: %w", err)
+		}
+		if err := pubRing.add(public.Bytes()); err != nil {
+			return imported, err
+		}
+		secRing.put(key)
+		imported = append(imported, key.entity)
+	}
+	if len(imported) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+
+	return imported, nil
+}
+
+// add reads binary or ASCII armored keys into the ring, replacing keys with the same fingerprint
+func (r *KeyRing) add(data []byte) error {
+	data, err := dearmorKeys(data)
+	if err != nil {
+		return err
+	}
+	blocks, err := splitKeys(data)
+	if err != nil {
+		return err
+	}
+
+	for _, raw := range blocks {
+		key := ringKey{raw: raw}
+		if list, err := openpgp.ReadKeyRing(bytes.NewReader(raw)); err == nil && len(list) == 1 {
+			key.entity = list[0]
+		}
+		r.put(key)
+	}
+	return nil
+}
+
+// put replaces the key with the same fingerprint or appends the key
+func (r *KeyRing) put(key ringKey) {
+	if key.entity != nil {
+		for i, existing := range r.keys {
+			if existing.entity != nil && existing.entity.PrimaryKey.Fingerprint == key.entity.PrimaryKey.Fingerprint {
+				r.keys[i] = key
+				return
+			}
+		}
+	}
+	r.keys = append(r.keys, key)
+}
+
+// dearmorKeys returns the packets of every armored block in data, or data itself when
+// it is not armored
+func dearmorKeys(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		return data, nil
+	}
+
+	var keys bytes.Buffer
+	reader := bytes.NewReader(data)
+	for {
+		block, err := armor.Decode(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode error: %w", err)
+		}
+		if block.Type != openpgp.PublicKeyType && block.Type != openpgp.PrivateKeyType {
+			return nil, fmt.Errorf("block type is not a PGP key: %s", block.Type)
+		}
+		if _, err = io.Copy(&keys, block.Body); err != nil {
+			return nil, fmt.Errorf("decode error: %w", err)
+		}
+	}
+	return keys.Bytes(), nil
+}
+
+// splitKeys splits binary key data into the packets of each key, every key starts
+// with a public or secret key packet
+func splitKeys(data []byte) ([][]byte, error) {
+	var keys [][]byte
+	start := -1
+	for offset := 0; offset < len(data); {
+		tag, length, err := packetLength(data[offset:])
+		if err != nil {
+			return nil, err
+		}
+		// tag 5 is a secret key and tag 6 a public key
+		if tag == 5 || tag == 6 {
+			if start >= 0 {
+				keys = append(keys, data[start:offset])
+			}
+			start = offset
+		}
+		offset += length
+	}
+	if start >= 0 {
+		keys = append(keys, data[start:])
+	}
+	return keys, nil
+}
+
+// packetLength returns the tag and the length, header included, of the packet at the
+// start of data, key rings only hold packets of a known length
+func packetLength(data []byte) (byte, int, error) {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return 0, 0, fmt.Errorf("bad packet header")
+	}
+
+	var tag byte
+	var header, length int
+	if data[0]&0x40 != 0 {
+		tag = data[0] & 0x3f
+		switch l0 := int(data[1]); {
+		case l0 < 192:
+			header, length = 2, l0
+		case l0 < 224 && len(data) >= 3:
+			header, length = 3, (l0-192)<<8+int(data[2])+192
+		case l0 == 255 && len(data) >= 6:
+			header, length = 6, int(binary.BigEndian.Uint32(data[2:6]))
+		default:
+			return 0, 0, fmt.Errorf("unsupported packet length")
+		}
+	} else {
+		tag = (data[0] & 0x3f) >> 2
+		switch {
+		case data[0]&3 == 0:
+			header, length = 2, int(data[1])
+		case data[0]&3 == 1 && len(data) >= 3:
+			header, length = 3, int(binary.BigEndian.Uint16(data[1:3]))
+		case data[0]&3 == 2 && len(data) >= 5:
+			header, length = 5, int(binary.BigEndian.Uint32(data[1:5]))
+		default:
+			return 0, 0, fmt.Errorf("unsupported packet length")
+		}
+	}
+	if header+length > len(data) {
+		return 0, 0, fmt.Errorf("short packet")
+	}
+
+	return tag, header + length, nil
+}
@@ -24,16 +24,22 @@ package pki
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/keybase/go-crypto/openpgp"
 	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
 	"github.com/rs/zerolog"
 	"github.com/ryboe/q"
 )
@@ -41,7 +47,27 @@ import (
 // PGPHeader header const
 const PGPHeader string = "-----BEGIN PGP MESSAGE-----"
 
-// Pki pki info
+// ErrNoSecretKey is returned when the secret key needed to decrypt or sign is not available
+var ErrNoSecretKey = errors.New("no secret key")
+
+// PublicKeyEnv is the environment variable that can hold an ASCII armored or base64 encoded public key
+const PublicKeyEnv = "GSP_PUBLIC_KEY"
+
+// SecretKeyEnv is the environment variable that can hold an ASCII armored or base64 encoded secret key
+const SecretKeyEnv = "GSP_SECRET_KEY"
+
+// SignaturesIgnore policy, signatures on decrypted values are not checked
+const SignaturesIgnore = "ignore"
+
+// SignaturesWarn policy, unsigned or untrusted values are decrypted with a warning
+const SignaturesWarn = "warn"
+
+// SignaturesRequire policy, unsigned or untrusted values are refused
+const SignaturesRequire = "require"
+
+// Pki pki info. Once set up, with SetSigner and SetTrustedSigners called, a *Pki is
+// safe for concurrent use: encrypting, decrypting and looking up keys only read it, so
+// one can be shared by every goroutine instead of being copied.
 type Pki struct {
 	PublicKey     *openpgp.Entity
 	SecretKey     *openpgp.Entity
@@ -50,8 +76,24 @@ type Pki struct {
 	PublicKeyRing string
 	SecretKeyRing string
 	PgpKeyName    string
-	logger        zerolog.Logger
-	debug         bool
+	// AgentSocket is the gpg-agent socket used to decrypt instead of the secret key ring when set
+	AgentSocket string
+	// EncryptionKeyID is the ID of the key or subkey values are encrypted to
+	EncryptionKeyID uint64
+	// KeyExpires is when the encryption key expires, the zero time if never
+	KeyExpires time.Time
+	// Config holds the cipher, hash and compression values are encrypted with, nil for the library defaults
+	Config *packet.Config
+	// Recipients are more keys values are encrypted to, along with PublicKey
+	Recipients []*openpgp.Entity
+	// Signer signs encrypted values when set
+	Signer *openpgp.Entity
+	// TrustedSigners are the key IDs whose signatures are trusted, any key in the key rings when empty
+	TrustedSigners []uint64
+	// SignaturePolicy is one of SignaturesIgnore (the default), SignaturesWarn or SignaturesRequire
+	SignaturePolicy string
+	logger          zerolog.Logger
+	debug           bool
 }
 
 // dbg creates a debug dumper function
@@ -63,10 +105,60 @@ func (p *Pki) dbg() func(thing ...interface{}) {
 	}
 }
 
+// Options configure a new pki object
+type Options struct {
+	// PgpKeyName names the key to use, it can be left empty when KeyFingerprint is set or
+	// RecipientFile or PublicKeyData hold a single key
+	PgpKeyName    string
+	PublicKeyRing string
+	SecretKeyRing string
+	// RecipientFile is a binary or ASCII armored public key file used instead of PublicKeyRing
+	RecipientFile string
+	// PublicKeyData is an ASCII armored or base64 encoded public key used instead of a key file
+	PublicKeyData string
+	// SecretKeyData is an ASCII armored or base64 encoded secret key used instead of SecretKeyRing
+	SecretKeyData string
+	// KeyFingerprint pins the key to use by its full fingerprint, PgpKeyName may then be
+	// left empty, or when set must name the same key
+	KeyFingerprint string
+	// Recipients name more keys in the public key ring values are encrypted to, they are
+	// checked like the main key
+	Recipients []string
+	// Backend is BackendKeyring (the default) or BackendAgent to decrypt with gpg-agent
+	Backend string
+	// AgentSocket is the gpg-agent socket used by BackendAgent
+	AgentSocket string
+	// Crypto names the cipher, hash and compression used to encrypt values
+	Crypto CryptoOptions
+	// AllowInvalidKey allows a revoked or expired key, or one without an encryption key
+	AllowInvalidKey bool
+	// KeyOptional lets every key option be left empty, the Pki then only holds the key rings
+	// to look up the keys values were encrypted to and cannot encrypt
+	KeyOptional bool
+	// ExpiryWarningDays warns when the key expires within this many days, 0 turns the warning off
+	ExpiryWarningDays int
+	// Logger is used in place of the default logger, which writes text to STDERR
+	Logger *zerolog.Logger
+}
+
 // New returns a pki object and an error
 func New(pgpKeyName string, publicKeyRing string, secretKeyRing string) (*Pki, error) {
+	return NewWithOptions(Options{
+		PgpKeyName:        pgpKeyName,
+		PublicKeyRing:     publicKeyRing,
+		SecretKeyRing:     secretKeyRing,
+		ExpiryWarningDays: DefaultExpiryWarningDays,
+	})
+}
+
+// NewWithOptions returns a pki object for the given options and an error,
+// the selected key is checked to be valid for encryption
+func NewWithOptions(opts Options) (*Pki, error) {
 	// Initialize logger
-	logger := zerolog.New(os.Stdout).Output(zerolog.ConsoleWriter{Out: os.Stdout})
+	logger := zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if opts.Logger != nil {
+		logger = *opts.Logger
+	}
 
 	// Check for debug mode
 	debugMode := os.Getenv("GSPPKI_DEBUG") != ""
@@ -74,61 +166,156 @@ func New(pgpKeyName string, publicKeyRing string, secretKeyRing string) (*Pki, e
 	var err error
 
 	// Validate input parameters
-	if pgpKeyName == "" {
-		return nil, fmt.Errorf("PGP key name cannot be empty")
+	if opts.KeyFingerprint != "" && !isFingerprint(normalizeKeyID(opts.KeyFingerprint)) {
+		return nil, fmt.Errorf("key fingerprint '%s' is not a 40 digit hex fingerprint", opts.KeyFingerprint)
 	}
-	if publicKeyRing == "" {
+	if opts.PublicKeyRing == "" && opts.RecipientFile == "" && opts.PublicKeyData == "" {
 		return nil, fmt.Errorf("public key ring path cannot be empty")
 	}
-	if secretKeyRing == "" {
-		return nil, fmt.Errorf("secret key ring path cannot be empty")
-	}
 
 	p := &Pki{
 		PublicKey:     nil,
 		SecretKey:     nil,
 		PubRing:       nil,
 		SecRing:       nil,
-		PublicKeyRing: publicKeyRing,
-		SecretKeyRing: secretKeyRing,
-		PgpKeyName:    pgpKeyName,
+		PublicKeyRing: opts.PublicKeyRing,
+		SecretKeyRing: opts.SecretKeyRing,
+		PgpKeyName:    opts.PgpKeyName,
 		logger:        logger,
 		debug:         debugMode,
 	}
-
-	// Expand and validate public key ring path
-	publicKeyRing, err = p.ExpandTilde(p.PublicKeyRing)
+	p.Config, err = opts.Crypto.Config()
 	if err != nil {
-		return nil, fmt.Errorf("cannot expand public key ring path: %w", err)
+		return nil, err
 	}
-	p.PublicKeyRing = publicKeyRing
 
-	// Load public key ring
-	p.PubRing, err = p.setKeyRing(p.PublicKeyRing)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load public key ring '%s': %w", p.PublicKeyRing, err)
+	// Load public keys from key data, a recipient file or the public key ring
+	switch {
+	case opts.PublicKeyData != "":
+		p.PublicKeyRing = "public key data"
+		p.PubRing, err = decodeKeyData(opts.PublicKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public key data: %w", err)
+		}
+	default:
+		if opts.RecipientFile != "" {
+			p.PublicKeyRing = opts.RecipientFile
+		}
+
+		// Expand and validate public key ring path
+		publicKeyRing, err := p.ExpandTilde(p.PublicKeyRing)
+		if err != nil {
+			return nil, fmt.Errorf("cannot expand public key ring path: %w", err)
+		}
+		p.PublicKeyRing = publicKeyRing
+
+		// Load public key ring
+		p.PubRing, err = p.setKeyRing(p.PublicKeyRing)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public key ring '%s': %w", p.PublicKeyRing, err)
+		}
 	}
 
-	// Expand and validate secret key ring path
-	secKeyRing, err := p.ExpandTilde(p.SecretKeyRing)
-	if err != nil {
-		return nil, fmt.Errorf("cannot expand secret key ring path: %w", err)
+	// Load secret keys (this may fail and is non-fatal for encryption-only operations)
+	switch {
+	case opts.Backend == BackendAgent:
+		if opts.AgentSocket == "" {
+			return nil, fmt.Errorf("gpg-agent socket path cannot be empty")
+		}
+		p.AgentSocket = opts.AgentSocket
+		p.SecretKeyRing = ""
+	case opts.Backend != "" && opts.Backend != BackendKeyring:
+		return nil, fmt.Errorf("unknown decryption backend '%s', use %s or %s", opts.Backend, BackendKeyring, BackendAgent)
+	case opts.SecretKeyData != "":
+		p.SecretKeyRing = "secret key data"
+		p.SecRing, err = decodeKeyData(opts.SecretKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load secret key data: %w", err)
+		}
+	case p.SecretKeyRing != "":
+		// Expand and validate secret key ring path
+		secKeyRing, err := p.ExpandTilde(p.SecretKeyRing)
+		if err != nil {
+			return nil, fmt.Errorf("cannot expand secret key ring path: %w", err)
+		}
+		p.SecretKeyRing = secKeyRing
+
+		p.SecRing, err = p.setKeyRing(p.SecretKeyRing)
+		if err != nil {
+			p.logger.Warn().Err(err).Str("keyring", p.SecretKeyRing).Msg("failed to load secret key ring - decryption operations will not be available")
+		}
 	}
-	p.SecretKeyRing = secKeyRing
 
-	// Load secret key ring (this may fail and is non-fatal for encryption-only operations)
-	p.SecRing, err = p.setKeyRing(p.SecretKeyRing)
+	// Load keys, the fingerprint pins the key when given and a lone key
+	// given as a recipient file or key data needs no name
+	selector := p.PgpKeyName
+	loneKey := (opts.RecipientFile != "" || opts.PublicKeyData != "") && len(*p.PubRing) == 1
+	if opts.KeyFingerprint != "" {
+		selector = opts.KeyFingerprint
+	} else if selector == "" && loneKey && (*p.PubRing)[0].PrimaryKey != nil {
+		selector = fmt.Sprintf("%X", (*p.PubRing)[0].PrimaryKey.Fingerprint)
+	}
+	if selector == "" && opts.KeyOptional {
+		return p, nil
+	}
+	if selector == "" {
+		return nil, fmt.Errorf("PGP key name cannot be empty")
+	}
+	if p.PgpKeyName == "" {
+		p.PgpKeyName = selector
+	}
+	p.PublicKey, err = p.FindKey(p.PubRing, selector)
 	if err != nil {
-		p.logger.Warn().Err(err).Str("keyring", p.SecretKeyRing).Msg("failed to load secret key ring - decryption operations will not be available")
+		return nil, err
+	}
+	if p.PublicKey == nil {
+		return nil, fmt.Errorf("unable to find key '%s' in public key ring '%s'", selector, p.PublicKeyRing)
+	}
+	if opts.KeyFingerprint != "" && p.PgpKeyName != opts.KeyFingerprint && !matchesKey(p.PgpKeyName, p.PublicKey) {
+		return nil, fmt.Errorf("key '%s' does not have fingerprint %s", p.PgpKeyName, opts.KeyFingerprint)
+	}
+	if err = checkPreferences(p.PublicKey, p.Config); err != nil {
+		return nil, fmt.Errorf("invalid crypto settings for key '%s': %w", p.PgpKeyName, err)
 	}
-
-	// Load keys
 	if p.SecRing != nil {
-		p.SecretKey = p.GetKeyByID(p.SecRing, p.PgpKeyName)
+		// the secret key is looked up by fingerprint so it always pairs with the public key
+		p.SecretKey, _ = p.FindKey(p.SecRing, fmt.Sprintf("%X", p.PublicKey.PrimaryKey.Fingerprint))
 	}
-	p.PublicKey = p.GetKeyByID(p.PubRing, p.PgpKeyName)
-	if p.PublicKey == nil {
-		return nil, fmt.Errorf("unable to find key '%s' in public key ring '%s'", p.PgpKeyName, p.PublicKeyRing)
+
+	// Check the key can be used for encryption
+	p.EncryptionKeyID, p.KeyExpires, err = ValidateKey(p.PublicKey, time.Now())
+	if err != nil {
+		if !opts.AllowInvalidKey {
+			return nil, fmt.Errorf("invalid key '%s': %w", p.PgpKeyName, err)
+		}
+		p.logger.Warn().Err(err).Str("key_id", fmt.Sprintf("%X", p.PublicKey.PrimaryKey.KeyId)).
+			Msgf("using invalid key '%s'", p.PgpKeyName)
+	}
+	if !p.KeyExpires.IsZero() && opts.ExpiryWarningDays > 0 &&
+		time.Until(p.KeyExpires) < time.Duration(opts.ExpiryWarningDays)*24*time.Hour {
+		p.logger.Warn().Str("key_id", fmt.Sprintf("%X", p.PublicKey.PrimaryKey.KeyId)).
+			Msgf("key '%s' expires on %s", p.PgpKeyName, p.KeyExpires.Format("2006-01-02"))
+	}
+
+	for _, name := range opts.Recipients {
+		recipient, err := p.FindKey(p.PubRing, name)
+		if err != nil {
+			return nil, err
+		}
+		if recipient == nil {
+			return nil, fmt.Errorf("unable to find recipient '%s' in public key ring '%s'", name, p.PublicKeyRing)
+		}
+		if err = checkPreferences(recipient, p.Config); err != nil {
+			return nil, fmt.Errorf("invalid crypto settings for recipient '%s': %w", name, err)
+		}
+		if _, _, err = ValidateKey(recipient, time.Now()); err != nil {
+			if !opts.AllowInvalidKey {
+				return nil, fmt.Errorf("invalid recipient '%s': %w", name, err)
+			}
+			p.logger.Warn().Err(err).Str("key_id", fmt.Sprintf("%X", recipient.PrimaryKey.KeyId)).
+				Msgf("using invalid recipient '%s'", name)
+		}
+		p.Recipients = append(p.Recipients, recipient)
 	}
 
 	// Debug dump if enabled
@@ -158,7 +345,7 @@ func (p *Pki) setKeyRing(keyRingPath string) (*openpgp.EntityList, error) {
 		}
 	}()
 
-	ring, err := openpgp.ReadKeyRing(keyRingFile)
+	ring, err := readKeyRing(keyRingFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read key ring from file '%s': %w", keyRing, err)
 	}
@@ -169,6 +356,39 @@ func (p *Pki) setKeyRing(keyRingPath string) (*openpgp.EntityList, error) {
 	return &ring, nil
 }
 
+// readKeyRing reads a binary or ASCII armored key ring
+func readKeyRing(r io.Reader) (openpgp.EntityList, error) {
+	reader := bufio.NewReader(r)
+	head, _ := reader.Peek(512)
+	if bytes.HasPrefix(bytes.TrimSpace(head), []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(reader)
+	}
+	return openpgp.ReadKeyRing(reader)
+}
+
+// decodeKeyData reads keys given as ASCII armored or base64 encoded text,
+// the decoded base64 may itself be a binary or an armored key ring
+func decodeKeyData(data string) (*openpgp.EntityList, error) {
+	keyData := []byte(data)
+	if !strings.Contains(data, "-----BEGIN PGP") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+		if err != nil {
+			return nil, fmt.Errorf("key data is neither ASCII armored nor base64 encoded: %w", err)
+		}
+		keyData = decoded
+	}
+
+	ring, err := readKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read keys: %w", err)
+	}
+	if len(ring) == 0 {
+		return nil, fmt.Errorf("key data holds no keys")
+	}
+
+	return &ring, nil
+}
+
 // EncryptSecret returns encrypted plainText
 func (p *Pki) EncryptSecret(plainText string) (string, error) {
 	var memBuffer bytes.Buffer
@@ -180,7 +400,12 @@ func (p *Pki) EncryptSecret(plainText string) (string, error) {
 		return plainText, fmt.Errorf("encode error: %s", err)
 	}
 
-	plainFile, err := openpgp.Encrypt(w, []*openpgp.Entity{p.PublicKey}, nil, &hints, nil)
+	var plainFile io.WriteCloser
+	if p.Config.Compression() != packet.CompressionNone {
+		plainFile, err = p.encryptCompressed(w, &hints)
+	} else {
+		plainFile, err = openpgp.Encrypt(w, append([]*openpgp.Entity{p.PublicKey}, p.Recipients...), p.Signer, &hints, p.Config)
+	}
 	if err != nil {
 		return plainText, fmt.Errorf("encryption error: %s", err)
 	}
@@ -206,46 +431,154 @@ func (p *Pki) EncryptSecret(plainText string) (string, error) {
 	return memBuffer.String(), nil
 }
 
-// DecryptSecret returns decrypted cipherText
+// DecryptSecret returns decrypted cipherText, applying the signature policy
 func (p *Pki) DecryptSecret(cipherText string) (plainText string, err error) {
+	plainText, sigErr, err := p.DecryptAndVerify(cipherText)
+	if err != nil {
+		return cipherText, err
+	}
+
+	if sigErr != nil {
+		switch p.SignaturePolicy {
+		case SignaturesRequire:
+			return cipherText, sigErr
+		case SignaturesWarn:
+			p.logger.Warn().Err(sigErr).Msg("signature check failed")
+		}
+	}
+
+	return plainText, nil
+}
+
+// DecryptAndVerify returns decrypted cipherText along with any problem found with its signature,
+// the signature is checked whatever the signature policy is
+func (p *Pki) DecryptAndVerify(cipherText string) (plainText string, sigErr error, err error) {
+	if p.AgentSocket != "" {
+		return p.decryptWithAgent(cipherText)
+	}
 	if p.SecRing == nil {
-		return cipherText, fmt.Errorf("no secring set")
+		return cipherText, nil, fmt.Errorf("%w, no secring set", ErrNoSecretKey)
+	}
+	// any secret key the value was encrypted to decrypts it, so values can be read while
+	// they are re-encrypted to a key whose secret key is not here
+	ids, err := EncryptedToKeyIDs(cipherText)
+	if err != nil {
+		return cipherText, nil, err
 	}
-	if p.SecretKey == nil {
-		return cipherText, fmt.Errorf("unable to load PGP secret key for '%s'", p.PgpKeyName)
+	if !p.hasSecretKey(ids) {
+		return cipherText, nil, fmt.Errorf("%w for encrypted key IDs %s", ErrNoSecretKey, formatKeyIDs(ids))
 	}
 
 	decbuf := bytes.NewBuffer([]byte(cipherText))
 	block, err := armor.Decode(decbuf)
 	if err != nil {
-		return cipherText, fmt.Errorf("decode error: %w", err)
+		return cipherText, nil, fmt.Errorf("decode error: %w", err)
 	}
 	if block.Type != "PGP MESSAGE" {
-		return cipherText, fmt.Errorf("block type is not PGP MESSAGE: %s", err)
+		return cipherText, nil, fmt.Errorf("block type is not PGP MESSAGE: %s", err)
 	}
 
-	md, err := openpgp.ReadMessage(block.Body, p.SecRing, nil, nil)
+	// the public keys are needed to check signatures, keys without a private part are skipped when decrypting
+	keyring := append(openpgp.EntityList{}, *p.SecRing...)
+	if p.PubRing != nil {
+		keyring = append(keyring, *p.PubRing...)
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
 	if err != nil {
-		return cipherText, fmt.Errorf("unable to read PGP message: %s", err)
+		return cipherText, nil, fmt.Errorf("unable to read PGP message: %s", err)
 	}
 	if md == nil {
-		return cipherText, fmt.Errorf("unable to read PGP message: md is nil")
+		return cipherText, nil, fmt.Errorf("unable to read PGP message: md is nil")
 	}
 
+	// the signature is only checked once the whole body has been read
 	body, err := io.ReadAll(md.UnverifiedBody)
 	if err != nil {
-		return cipherText, fmt.Errorf("unable to read message body: %s", err)
+		return cipherText, nil, fmt.Errorf("unable to read message body: %s", err)
 	}
 
-	return string(body), err
+	return string(body), p.checkSignature(md), nil
 }
 
-// GetKeyByID returns a keyring by the given ID
-func (p *Pki) GetKeyByID(keyring *openpgp.EntityList, id interface{}) *openpgp.Entity {
-	if keyring == nil {
+// hasSecretKey reports whether the secret key ring holds a secret key with one of the IDs
+func (p *Pki) hasSecretKey(ids []uint64) bool {
+	for _, id := range ids {
+		for _, key := range p.SecRing.KeysById(id, nil) {
+			if key.PrivateKey != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatKeyIDs joins key IDs as hex
+func formatKeyIDs(ids []uint64) string {
+	hex := make([]string, len(ids))
+	for i, id := range ids {
+		hex[i] = fmt.Sprintf("%X", id)
+	}
+	return strings.Join(hex, ",")
+}
+
+// checkSignature checks a fully read message was signed by a trusted key
+func (p *Pki) checkSignature(md *openpgp.MessageDetails) error {
+	if !md.IsSigned {
+		return fmt.Errorf("value is not signed")
+	}
+	if md.SignedBy == nil {
+		return fmt.Errorf("value is signed by unknown key %X", md.SignedByKeyId)
+	}
+	if md.SignatureError != nil {
+		return fmt.Errorf("bad signature from key %X: %s", md.SignedByKeyId, md.SignatureError)
+	}
+	if len(p.TrustedSigners) == 0 {
 		return nil
 	}
+	for _, id := range p.TrustedSigners {
+		if id == md.SignedByKeyId {
+			return nil
+		}
+	}
+	return fmt.Errorf("value is signed by untrusted key %X", md.SignedByKeyId)
+}
+
+// SetSigner selects the key in the secret key ring used to sign encrypted values
+func (p *Pki) SetSigner(key string) error {
+	if p.SecRing == nil {
+		return fmt.Errorf("%w, no secring set, unable to sign with '%s'", ErrNoSecretKey, key)
+	}
+	entity, err := p.FindKey(p.SecRing, key)
+	if err != nil {
+		return err
+	}
+	if entity == nil || entity.PrivateKey == nil {
+		return fmt.Errorf("%w, unable to find secret key '%s' for signing", ErrNoSecretKey, key)
+	}
+	if entity.PrivateKey.Encrypted {
+		return fmt.Errorf("signing key '%s' is protected by a passphrase", key)
+	}
+	p.Signer = entity
+	return nil
+}
 
+// SetTrustedSigners sets the keys whose signatures are trusted on decrypted values
+func (p *Pki) SetTrustedSigners(keys []string) error {
+	p.TrustedSigners = nil
+	for _, key := range keys {
+		ids, err := p.KeyIDs(key)
+		if err != nil {
+			return fmt.Errorf("trusted signer: %w", err)
+		}
+		p.TrustedSigners = append(p.TrustedSigners, ids...)
+	}
+	return nil
+}
+
+// GetKeyByID returns a keyring by the given ID, name, email or fingerprint,
+// nil is returned when there is no match or the match is ambiguous
+func (p *Pki) GetKeyByID(keyring *openpgp.EntityList, id interface{}) *openpgp.Entity {
 	// Type assert and validate the id parameter
 	idStr, ok := id.(string)
 	if !ok {
@@ -253,29 +586,114 @@ func (p *Pki) GetKeyByID(keyring *openpgp.EntityList, id interface{}) *openpgp.E
 		return nil
 	}
 
-	if idStr == "" {
-		p.logger.Warn().Msg("GetKeyByID: id parameter is empty")
+	entity, err := p.FindKey(keyring, idStr)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("GetKeyByID")
 		return nil
 	}
 
+	return entity
+}
+
+// FindKey returns the key in a keyring matching the given full fingerprint, long or short
+// key ID (with or without a 0x prefix), identity name, email or user ID. Nil is returned
+// when nothing matches, and an error listing the candidates when several keys match.
+func (p *Pki) FindKey(keyring *openpgp.EntityList, id string) (*openpgp.Entity, error) {
+	return findKey(keyring, id)
+}
+
+func findKey(keyring *openpgp.EntityList, id string) (*openpgp.Entity, error) {
+	if keyring == nil {
+		return nil, nil
+	}
+	if id == "" {
+		return nil, fmt.Errorf("key name cannot be empty")
+	}
+
+	var matches []*openpgp.Entity
+	seen := map[[20]byte]bool{}
 	for _, entity := range *keyring {
-		if entity == nil {
+		if entity == nil || entity.PrimaryKey == nil || seen[entity.PrimaryKey.Fingerprint] {
 			continue
 		}
-
-		if entity.PrivateKey != nil && entity.PrivateKey.KeyIdString() == idStr {
-			return entity
+		if matchesKey(id, entity) {
+			seen[entity.PrimaryKey.Fingerprint] = true
+			matches = append(matches, entity)
 		}
-		if entity.PrimaryKey != nil && entity.PrimaryKey.KeyIdString() == idStr {
-			return entity
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return matches[0], nil
+	}
+
+	candidates := make([]string, 0, len(matches))
+	for _, entity := range matches {
+		names := make([]string, 0, len(entity.Identities))
+		for name := range entity.Identities {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+		candidates = append(candidates, fmt.Sprintf("%X %s", entity.PrimaryKey.Fingerprint, strings.Join(names, ", ")))
+	}
+	return nil, fmt.Errorf("key '%s' is ambiguous, %d keys match, select one by fingerprint: %s",
+		id, len(matches), strings.Join(candidates, "; "))
+}
+
+// matchesKey checks a fingerprint, key ID or identity against a key and its subkeys
+func matchesKey(id string, entity *openpgp.Entity) bool {
+	if checkIdentities(id, entity) {
+		return true
+	}
 
-		if checkIdentities(idStr, entity) {
-			return entity
+	hexID := normalizeKeyID(id)
+	if !isHex(hexID) {
+		return false
+	}
+	keys := []*packet.PublicKey{entity.PrimaryKey}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PublicKey != nil {
+			keys = append(keys, subkey.PublicKey)
+		}
+	}
+	for _, key := range keys {
+		switch len(hexID) {
+		case 40:
+			if fmt.Sprintf("%X", key.Fingerprint) == hexID {
+				return true
+			}
+		case 16:
+			if key.KeyIdString() == hexID {
+				return true
+			}
+		case 8:
+			if key.KeyIdShortString() == hexID {
+				return true
+			}
 		}
 	}
 
-	return nil
+	return false
+}
+
+// normalizeKeyID upper cases a key ID or fingerprint and drops any 0x prefix and spaces
+func normalizeKeyID(id string) string {
+	id = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(id), "0x"), "0X")
+	return strings.ToUpper(strings.ReplaceAll(id, " ", ""))
+}
+
+func isHex(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func isFingerprint(id string) bool {
+	return len(id) == 40 && isHex(id)
 }
 
 func checkIdentities(id string, entity *openpgp.Entity) bool {
@@ -365,66 +783,241 @@ func (p *Pki) KeyUsedForEncryptedFile(file string) (string, error) {
 		return "", fmt.Errorf("directory traversal detected in file path: %s", file)
 	}
 
-	in, err := os.Open(filepath.Clean(filePath))
+	cipherText, err := os.ReadFile(filepath.Clean(filePath))
 	if err != nil {
 		return "", fmt.Errorf("cannot open file '%s': %w", filePath, err)
 	}
-	defer func() {
-		if closeErr := in.Close(); closeErr != nil {
-			p.logger.Warn().Err(closeErr).Str("file", filePath).Msg("failed to close file")
-		}
-	}()
 
-	block, err := armor.Decode(in)
+	keyStr, err := p.KeyUsedForEncryptedMessage(string(cipherText))
 	if err != nil {
-		return "", fmt.Errorf("armor decode error for file '%s': %w", filePath, err)
+		return "", fmt.Errorf("%w in file '%s'", err, filePath)
 	}
 
-	if block.Type != "PGP MESSAGE" {
-		return "", fmt.Errorf("invalid block type '%s', expected 'PGP MESSAGE' in file '%s'", block.Type, filePath)
-	}
+	return keyStr, nil
+}
 
-	md, err := openpgp.ReadMessage(block.Body, p.SecRing, nil, nil)
+// KeyUsedForEncryptedMessage gets the key used to encrypt an armored message from its
+// session key packets, so no secret key is needed. The first recipient found in the
+// public or secret key ring is shown, otherwise the raw recipient key IDs are.
+func (p *Pki) KeyUsedForEncryptedMessage(cipherText string) (string, error) {
+	ids, err := EncryptedToKeyIDs(cipherText)
 	if err != nil {
-		return "", fmt.Errorf("unable to read PGP message from file '%s': %w", filePath, err)
-	}
-	if md == nil {
-		return "", fmt.Errorf("PGP message is nil in file '%s'", filePath)
+		return "", err
 	}
 
-	for index := 0; index < len(md.EncryptedToKeyIds); index++ {
-		id := md.EncryptedToKeyIds[index]
+	for _, id := range ids {
 		keyStr := p.keyStringForID(id)
 		if keyStr != "" {
 			return keyStr, nil
 		}
 	}
 
-	return "", fmt.Errorf("unable to find key for encrypted key IDs in file '%s'", filePath)
+	rawIDs := make([]string, len(ids))
+	for i, id := range ids {
+		rawIDs[i] = fmt.Sprintf("%X", id)
+	}
+	return fmt.Sprintf("%s: not in key rings\n", strings.Join(rawIDs, ", ")), nil
 }
 
 func (p *Pki) keyStringForID(id uint64) string {
-	if p.SecRing == nil {
-		return ""
+	for _, ring := range []*openpgp.EntityList{p.PubRing, p.SecRing} {
+		if ring == nil {
+			continue
+		}
+
+		for _, key := range ring.KeysById(id, nil) {
+			if key.Entity == nil || key.Entity.Identities == nil {
+				continue
+			}
+
+			names := make([]string, 0, len(key.Entity.Identities))
+			for identityName := range key.Entity.Identities {
+				if identityName != "" {
+					names = append(names, identityName)
+				}
+			}
+			if len(names) > 0 {
+				// return the first valid key identity
+				sort.Strings(names)
+				return fmt.Sprintf("%X: %s\n", id, names[0])
+			}
+		}
 	}
 
-	keys := p.SecRing.KeysById(id, nil)
-	if len(keys) == 0 {
-		return ""
+	return ""
+}
+
+// EncryptedToKeyIDs returns the IDs of the keys an armored PGP message was encrypted to,
+// read from the message's public key encrypted session key packets without decrypting it
+func EncryptedToKeyIDs(cipherText string) ([]uint64, error) {
+	block, err := armor.Decode(strings.NewReader(cipherText))
+	if err != nil {
+		return nil, fmt.Errorf("decode error: %w", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return nil, fmt.Errorf("invalid block type '%s', expected 'PGP MESSAGE'", block.Type)
 	}
 
-	for _, key := range keys {
-		if key.Entity == nil || key.Entity.Identities == nil {
+	var ids []uint64
+	packets := packet.NewReader(block.Body)
+	for {
+		pkt, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ids, fmt.Errorf("unable to read PGP message: %w", err)
+		}
+		if key, ok := pkt.(*packet.EncryptedKey); ok {
+			ids = append(ids, key.KeyId)
 			continue
 		}
+		// the session key packets all come before the encrypted data
+		break
+	}
 
-		for identityName := range key.Entity.Identities {
-			if identityName != "" {
-				// return the first valid key identity
-				return fmt.Sprintf("%X: %s\n", id, identityName)
+	if len(ids) == 0 {
+		return ids, fmt.Errorf("PGP message is not encrypted to a public key")
+	}
+
+	return ids, nil
+}
+
+// DecryptionKeyFingerprint returns the fingerprint of the key that decrypts an armored
+// message, read from its session key packets: the first recipient with a secret key in
+// the secret key ring, or with gpg-agent the first recipient in either key ring. It is
+// empty when no recipient is known.
+func (p *Pki) DecryptionKeyFingerprint(cipherText string) string {
+	ids, err := EncryptedToKeyIDs(cipherText)
+	if err != nil {
+		return ""
+	}
+	for _, id := range ids {
+		for _, ring := range []*openpgp.EntityList{p.SecRing, p.PubRing} {
+			if ring == nil {
+				continue
+			}
+			for _, key := range ring.KeysById(id, nil) {
+				if key.Entity != nil && (key.PrivateKey != nil || p.AgentSocket != "") {
+					return fmt.Sprintf("%X", key.Entity.PrimaryKey.Fingerprint)
+				}
 			}
 		}
 	}
-
 	return ""
 }
+
+// HasKeyID checks if a key with the given ID is in either key ring
+func (p *Pki) HasKeyID(id uint64) bool {
+	for _, ring := range []*openpgp.EntityList{p.PubRing, p.SecRing} {
+		if ring != nil && len(ring.KeysById(id, nil)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyIDs returns the primary and subkey IDs for the key matching the given
+// name, email or ID in either key ring, or the ID itself when given a 16 digit hex key ID
+func (p *Pki) KeyIDs(key string) ([]uint64, error) {
+	var ids []uint64
+
+	for _, ring := range []*openpgp.EntityList{p.PubRing, p.SecRing} {
+		entity, err := p.FindKey(ring, key)
+		if err != nil {
+			return ids, err
+		}
+		if entity == nil {
+			continue
+		}
+		if entity.PrimaryKey != nil {
+			ids = append(ids, entity.PrimaryKey.KeyId)
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PublicKey != nil {
+				ids = append(ids, subkey.PublicKey.KeyId)
+			}
+		}
+		return ids, nil
+	}
+
+	hexID := strings.TrimPrefix(strings.TrimPrefix(key, "0x"), "0X")
+	if len(hexID) == 16 {
+		id, err := strconv.ParseUint(hexID, 16, 64)
+		if err == nil {
+			return append(ids, id), nil
+		}
+	}
+
+	return ids, fmt.Errorf("unable to find key '%s' in key rings", key)
+}
+
+// KeyInfo describes a key a message was encrypted to, only KeyID is set when the key is not in either key ring
+type KeyInfo struct {
+	KeyID        string   `json:"key_id" yaml:"key_id"`
+	PrimaryKeyID string   `json:"primary_key_id,omitempty" yaml:"primary_key_id,omitempty"`
+	Fingerprint  string   `json:"fingerprint,omitempty" yaml:"fingerprint,omitempty"`
+	UserIDs      []string `json:"user_ids,omitempty" yaml:"user_ids,omitempty"`
+	Algorithm    string   `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	Created      string   `json:"created,omitempty" yaml:"created,omitempty"`
+}
+
+// KeyInfoForID looks up the key with the given ID in the public then secret key ring
+func (p *Pki) KeyInfoForID(id uint64) KeyInfo {
+	info := KeyInfo{KeyID: fmt.Sprintf("%016X", id)}
+
+	for _, ring := range []*openpgp.EntityList{p.PubRing, p.SecRing} {
+		if ring == nil {
+			continue
+		}
+		keys := ring.KeysById(id, nil)
+		if len(keys) == 0 || keys[0].Entity == nil || keys[0].PublicKey == nil {
+			continue
+		}
+		return keyInfo(keys[0].Entity, keys[0].PublicKey)
+	}
+
+	return info
+}
+
+// keyInfo describes a key or subkey of an entity
+func keyInfo(entity *openpgp.Entity, key *packet.PublicKey) KeyInfo {
+	info := KeyInfo{KeyID: fmt.Sprintf("%016X", key.KeyId)}
+	if entity.PrimaryKey != nil {
+		info.PrimaryKeyID = fmt.Sprintf("%016X", entity.PrimaryKey.KeyId)
+		info.Fingerprint = fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+	}
+	for name := range entity.Identities {
+		info.UserIDs = append(info.UserIDs, name)
+	}
+	sort.Strings(info.UserIDs)
+	info.Algorithm = algorithmName(key)
+	info.Created = key.CreationTime.UTC().Format(time.RFC3339)
+	return info
+}
+
+// algorithmName returns a readable name for a public key's algorithm and size
+func algorithmName(key *packet.PublicKey) string {
+	var name string
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		name = "RSA"
+	case packet.PubKeyAlgoElGamal:
+		name = "ElGamal"
+	case packet.PubKeyAlgoDSA:
+		name = "DSA"
+	case packet.PubKeyAlgoECDH:
+		name = "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		name = "ECDSA"
+	case packet.PubKeyAlgoEdDSA:
+		name = "EdDSA"
+	default:
+		return fmt.Sprintf("unknown(%d)", key.PubKeyAlgo)
+	}
+
+	if bits, err := key.BitLength(); err == nil && bits > 0 {
+		return fmt.Sprintf("%s-%d", name, bits)
+	}
+	return name
+}
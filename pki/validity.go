@@ -0,0 +1,119 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pki
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/packet"
+)
+
+// DefaultExpiryWarningDays is how many days before a key expires New starts warning about it
+const DefaultExpiryWarningDays = 30
+
+// ValidateKey checks that a key is not revoked or expired and can encrypt, returning the ID of
+// the key values are encrypted to, which is the newest usable encryption subkey when there is one,
+// and when it expires (the zero time if never)
+func ValidateKey(entity *openpgp.Entity, now time.Time) (uint64, time.Time, error) {
+	var expires time.Time
+
+	if entity == nil || entity.PrimaryKey == nil {
+		return 0, expires, fmt.Errorf("no key given")
+	}
+	if len(entity.Revocations) > 0 {
+		return 0, expires, fmt.Errorf("key %X is revoked", entity.PrimaryKey.KeyId)
+	}
+	if len(entity.UnverifiedRevocations) > 0 {
+		return 0, expires, fmt.Errorf("key %X is revoked by a designated revoker", entity.PrimaryKey.KeyId)
+	}
+
+	ident := primaryIdentity(entity)
+	if ident == nil || ident.SelfSignature == nil {
+		return 0, expires, fmt.Errorf("key %X has no valid identity", entity.PrimaryKey.KeyId)
+	}
+	if ident.Revocation != nil {
+		return 0, expires, fmt.Errorf("identity '%s' of key %X is revoked", ident.Name, entity.PrimaryKey.KeyId)
+	}
+	expires = keyExpiry(entity.PrimaryKey, ident.SelfSignature)
+	if !expires.IsZero() && now.After(expires) {
+		return 0, expires, fmt.Errorf("key %X expired on %s", entity.PrimaryKey.KeyId, expires.Format("2006-01-02"))
+	}
+
+	// the same choice openpgp.Encrypt makes: the newest non-revoked, non-expired encryption subkey
+	var subkey *openpgp.Subkey
+	for i := range entity.Subkeys {
+		candidate := &entity.Subkeys[i]
+		if candidate.Sig == nil || candidate.PublicKey == nil || candidate.Revocation != nil {
+			continue
+		}
+		if subkeyExpires := keyExpiry(candidate.PublicKey, candidate.Sig); !subkeyExpires.IsZero() && now.After(subkeyExpires) {
+			continue
+		}
+		canEncrypt := (candidate.Sig.FlagsValid && candidate.Sig.FlagEncryptCommunications) ||
+			(!candidate.Sig.FlagsValid && candidate.PublicKey.PubKeyAlgo == packet.PubKeyAlgoElGamal)
+		if canEncrypt && candidate.PublicKey.PubKeyAlgo.CanEncrypt() &&
+			(subkey == nil || candidate.Sig.CreationTime.After(subkey.Sig.CreationTime)) {
+			subkey = candidate
+		}
+	}
+	if subkey != nil {
+		subkeyExpires := keyExpiry(subkey.PublicKey, subkey.Sig)
+		if expires.IsZero() || (!subkeyExpires.IsZero() && subkeyExpires.Before(expires)) {
+			expires = subkeyExpires
+		}
+		return subkey.PublicKey.KeyId, expires, nil
+	}
+
+	sig := ident.SelfSignature
+	if (!sig.FlagsValid || sig.FlagEncryptCommunications) && entity.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+		return entity.PrimaryKey.KeyId, expires, nil
+	}
+
+	return 0, expires, fmt.Errorf("key %X has no usable encryption key", entity.PrimaryKey.KeyId)
+}
+
+// primaryIdentity returns the identity flagged as primary, or the first by name
+func primaryIdentity(entity *openpgp.Entity) *openpgp.Identity {
+	names := make([]string, 0, len(entity.Identities))
+	for name, ident := range entity.Identities {
+		if ident.SelfSignature != nil && ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId {
+			return ident
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return entity.Identities[names[0]]
+}
+
+// keyExpiry returns when a key expires going by its self signature, the zero time if never,
+// the lifetime counts from the creation of the key rather than of the signature
+func keyExpiry(key *packet.PublicKey, sig *packet.Signature) time.Time {
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return key.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+}
@@ -192,6 +192,12 @@ func TestFilePermissionHandling(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			filePath := tc.setupFunc()
+			if tc.name == "unreadable file" {
+				if f, err := os.Open(filePath); err == nil {
+					f.Close()
+					t.Skip("file permissions are not enforced for this user")
+				}
+			}
 
 			// Build command to test file access
 			dir, err := os.Getwd()
@@ -0,0 +1,84 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sls
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+)
+
+// PathKeys lists the keys the encrypted value at a YAML path was encrypted to
+type PathKeys struct {
+	Path  string        `json:"path" yaml:"path"`
+	Keys  []pki.KeyInfo `json:"keys" yaml:"keys"`
+	Error string        `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// KeyReport lists the keys used in a file, once for the whole file and once per encrypted value
+type KeyReport struct {
+	File  string        `json:"file" yaml:"file"`
+	Keys  []pki.KeyInfo `json:"keys" yaml:"keys"`
+	Paths []PathKeys    `json:"paths" yaml:"paths"`
+}
+
+// KeyReport reads the recipients of every encrypted value in the file, or under the
+// EncryptionPath when one is set, no secret key is needed as the values are not decrypted
+func (s *Sls) KeyReport() KeyReport {
+	report := KeyReport{File: s.FilePath, Keys: []pki.KeyInfo{}, Paths: []PathKeys{}}
+	seen := map[uint64]bool{}
+	if s.Yaml == nil {
+		return report
+	}
+
+	var vals interface{} = s.Yaml.Values
+	if s.EncryptionPath != "" {
+		vals = s.GetValueFromPath(s.EncryptionPath)
+	}
+	walkValues(vals, s.EncryptionPath, func(path string, value interface{}) {
+		strVal := fmt.Sprintf("%v", value)
+		if !isEncrypted(strVal) {
+			return
+		}
+
+		pathKeys := PathKeys{Path: path, Keys: []pki.KeyInfo{}}
+		ids, err := pki.EncryptedToKeyIDs(strVal)
+		if err != nil {
+			pathKeys.Error = err.Error()
+		}
+		for _, id := range ids {
+			info := s.Pki.KeyInfoForID(id)
+			pathKeys.Keys = append(pathKeys.Keys, info)
+			if !seen[id] {
+				seen[id] = true
+				report.Keys = append(report.Keys, info)
+			}
+		}
+		report.Paths = append(report.Paths, pathKeys)
+	})
+
+	sort.Slice(report.Keys, func(i, j int) bool {
+		return report.Keys[i].KeyID < report.Keys[j].KeyID
+	})
+
+	return report
+}
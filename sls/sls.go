@@ -24,18 +24,21 @@ package sls
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/Everbridge/generate-secure-pillar/audit"
 	"github.com/Everbridge/generate-secure-pillar/pki"
 	yaml "github.com/esilva-everbridge/yaml"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	yamlv3 "gopkg.in/yaml.v3"
 )
 
@@ -51,7 +54,17 @@ const Validate = "validate"
 // Rotate action
 const Rotate = "rotate"
 
-// Sls sls data
+// ErrIncludeDirective is returned for files with include directives, they are not processed
+var ErrIncludeDirective = errors.New("contains include directives")
+
+// ErrNotEncrypted is returned when an encrypted value is expected but the value is plain text
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+// ErrPathNotFound is returned when a YAML path is not in the file
+var ErrPathNotFound = errors.New("unable to find path")
+
+// Sls sls data. An Sls is not safe for concurrent use, give each goroutine its own and
+// share the *pki.Pki between them.
 type Sls struct {
 	Yaml           *yaml.Yaml
 	Pki            *pki.Pki
@@ -61,23 +74,70 @@ type Sls struct {
 	KeyMeta        string
 	KeyCount       int
 	IsInclude      bool
+	RotateFrom     []uint64
+	Rotated        int
+	Skipped        int
+	Changes        []Change
 	logger         zerolog.Logger
+	audit          *audit.Log
+	dryRun         bool
 }
 
-// New returns a Sls object
-func New(filePath string, p pki.Pki, encPath string) Sls {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
-	logger := zerolog.New(os.Stdout)
-	s := Sls{yaml.New(), &p, map[string]interface{}{}, filePath, encPath, "", 0, false, logger}
-	if len(filePath) > 0 {
-		err := s.ReadSlsFile()
-		if err != nil {
-			s.logger.Error().Err(err).Msgf("init error for %s", s.FilePath)
-			s.IsInclude = true // Use this to signal error state
+// Change describes a value changed by an action and its size in bytes before and after
+type Change struct {
+	Path   string
+	Action string
+	Before int
+	After  int
+}
+
+// Options configure a new Sls object
+type Options struct {
+	// FilePath is the file read, nothing is read when it is empty
+	FilePath string
+	// Pki holds the keys values are encrypted and decrypted with, it is shared rather than copied
+	Pki *pki.Pki
+	// EncryptionPath limits actions to the values under a top level element
+	EncryptionPath string
+	// Logger is used in place of the default logger, which writes JSON to STDERR
+	Logger *zerolog.Logger
+	// Audit records the values encrypted, decrypted or rotated and the files written,
+	// nothing is recorded when it is nil
+	Audit *audit.Log
+	// DryRun is set when the changes are only planned, they are not recorded in the audit log
+	DryRun bool
+}
+
+// New returns a Sls object with the file read, ErrIncludeDirective is returned for a
+// file with include directives. The keys are copied, use NewWithOptions to share them.
+func New(filePath string, p pki.Pki, encPath string) (Sls, error) {
+	return NewWithOptions(Options{FilePath: filePath, Pki: &p, EncryptionPath: encPath})
+}
+
+// NewWithOptions returns a Sls object for the given options with the file read,
+// ErrIncludeDirective is returned for a file with include directives
+func NewWithOptions(opts Options) (Sls, error) {
+	logger := defaultLogger()
+	if opts.Logger != nil {
+		logger = *opts.Logger
+	}
+	s := Sls{
+		Yaml:           yaml.New(),
+		Pki:            opts.Pki,
+		KeyMap:         map[string]interface{}{},
+		FilePath:       opts.FilePath,
+		EncryptionPath: opts.EncryptionPath,
+		logger:         logger,
+		audit:          opts.Audit,
+		dryRun:         opts.DryRun,
+	}
+	if len(s.FilePath) > 0 {
+		if err := s.ReadSlsFile(); err != nil {
+			return s, err
 		}
 	}
 
-	return s
+	return s, nil
 }
 
 // ReadBytes loads YAML from a []byte
@@ -102,14 +162,15 @@ func (s *Sls) ScanForIncludes(reader io.Reader) error {
 	for scanner.Scan() {
 		txt := scanner.Text()
 		if strings.Contains(txt, "include:") {
-			return fmt.Errorf("%s contains include directives", shortFileName(s.FilePath))
+			return fmt.Errorf("%s %w", shortFileName(s.FilePath), ErrIncludeDirective)
 		}
 	}
 	return scanner.Err()
 }
 
-// ReadSlsFile open and read a yaml file, if the file has include statements
-// we throw an error as the YAML parser will try to act on the include directives
+// ReadSlsFile open and read a yaml file, a missing file is an error and is never created.
+// If the file has include statements we throw an error as the YAML parser will try to act
+// on the include directives
 func (s *Sls) ReadSlsFile() error {
 	if len(s.FilePath) == 0 {
 		return fmt.Errorf("no file path given")
@@ -124,21 +185,6 @@ func (s *Sls) ReadSlsFile() error {
 		return fmt.Errorf("invalid file path: directory traversal detected in %s", s.FilePath)
 	}
 
-	// this could be called when creating a new file, so check the path
-	if _, statErr := os.Stat(s.FilePath); os.IsNotExist(statErr) {
-		// File doesn't exist, create directory structure and empty file
-		dir := filepath.Dir(s.FilePath)
-		err := os.MkdirAll(dir, 0700)
-		if err != nil {
-			return err
-		}
-		file, err := os.OpenFile(s.FilePath, os.O_RDONLY|os.O_CREATE, 0600)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-	}
-
 	fullPath, err := filepath.Abs(s.FilePath)
 	if err != nil {
 		return err
@@ -154,8 +200,32 @@ func (s *Sls) ReadSlsFile() error {
 }
 
 // WriteSlsFile writes a buffer to the specified file
-// If the outFilePath is not stdout an INFO string will be printed to stdout
+// If the outFilePath is not stdout an INFO string will be logged to stderr
 func WriteSlsFile(buffer bytes.Buffer, outFilePath string) (int, error) {
+	return writeSlsFile(buffer, outFilePath, defaultLogger())
+}
+
+// WriteFile writes a buffer to the specified file like WriteSlsFile, logging with the
+// logger of the Sls and recording files written in its audit log
+func (s *Sls) WriteFile(buffer bytes.Buffer, outFilePath string) (int, error) {
+	byteCount, err := writeSlsFile(buffer, outFilePath, s.logger)
+	if err != nil || outFilePath == os.Stdout.Name() {
+		return byteCount, err
+	}
+
+	// a file with decrypted values is recorded without its hash, which could be
+	// used to guess them
+	hash := audit.HashCipherText(buffer.Bytes())
+	for _, change := range s.Changes {
+		if change.Action == Decrypt {
+			hash = ""
+			break
+		}
+	}
+	return byteCount, s.record(audit.Write, outFilePath, "", hash, s.keyFingerprint())
+}
+
+func writeSlsFile(buffer bytes.Buffer, outFilePath string, logger zerolog.Logger) (int, error) {
 	// Validate path for directory traversal attacks
 	if containsDirectoryTraversal(outFilePath) {
 		return 0, fmt.Errorf("invalid file path: directory traversal detected in %s", outFilePath)
@@ -189,8 +259,7 @@ func WriteSlsFile(buffer bytes.Buffer, outFilePath string) (int, error) {
 
 	if !stdOut && err == nil {
 		shortFile := shortFileName(outFilePath)
-		logger := zerolog.New(os.Stdout)
-		logger.Info().Msgf("wrote out to file: '%s'", shortFile)
+		logger.Info().Str("file", shortFile).Msgf("wrote out to file: '%s'", shortFile)
 	}
 
 	return byteCount, err
@@ -300,10 +369,18 @@ func (s *Sls) ProcessYaml(secretNames []string, secretValues []string) error {
 				return err
 			}
 		}
+		before := ""
+		if current := s.GetValueFromPath(secretNames[index]); current != nil {
+			before = fmt.Sprintf("%v", current)
+		}
 		err = s.SetValueFromPath(secretNames[index], cipherText)
 		if err != nil {
 			return err
 		}
+		s.recordChange(secretNames[index], Encrypt, before, cipherText)
+		if err = s.record(Encrypt, s.FilePath, secretNames[index], audit.HashCipherText([]byte(cipherText)), s.keyFingerprint()); err != nil {
+			return err
+		}
 	}
 
 	return err
@@ -325,6 +402,10 @@ func (s *Sls) GetValueFromPath(path string) interface{} {
 
 // SetValueFromPath returns the value from a path string
 func (s *Sls) SetValueFromPath(path string, value string) error {
+	return s.setValue(path, value)
+}
+
+func (s *Sls) setValue(path string, value interface{}) error {
 	parts := strings.Split(path, ":")
 
 	// construct the args list
@@ -340,12 +421,60 @@ func (s *Sls) SetValueFromPath(path string, value string) error {
 	return fmt.Errorf("%s", err)
 }
 
+// WalkValues calls fn for every scalar value in the file along with its colon separated
+// YAML path, list items are addressed by their index and map keys are visited in sorted order
+func (s *Sls) WalkValues(fn func(path string, value interface{})) {
+	if s.Yaml == nil {
+		return
+	}
+	walkValues(s.Yaml.Values, "", fn)
+}
+
+func walkValues(vals interface{}, path string, fn func(path string, value interface{})) {
+	switch v := vals.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			walkValues(v[key], joinPath(path, key), fn)
+		}
+	case []interface{}:
+		for index, item := range v {
+			walkValues(item, joinPath(path, strconv.Itoa(index)), fn)
+		}
+	default:
+		fn(path, v)
+	}
+}
+
+// KeysByPath returns one "path: key" row per encrypted value, including the items of lists,
+// it is populated by PerformAction(Validate)
+func (s *Sls) KeysByPath() []string {
+	var rows []string
+	walkValues(s.KeyMap, "", func(path string, value interface{}) {
+		if value == "" {
+			// a plain text item kept in a list to hold the index of the others
+			return
+		}
+		rows = append(rows, fmt.Sprintf("%s: %s", path, strings.TrimSpace(fmt.Sprintf("%v", value))))
+	})
+	return rows
+}
+
 // PerformAction takes an action string (encrypt or decrypt)
 // and applies that action on all items
 func (s *Sls) PerformAction(action string) (bytes.Buffer, error) {
 	var buf bytes.Buffer
 
 	if validAction(action) {
+		s.Rotated = 0
+		s.Skipped = 0
+		s.Changes = nil
 		var stuff = make(map[string]interface{})
 
 		for key := range s.Yaml.Values {
@@ -353,7 +482,7 @@ func (s *Sls) PerformAction(action string) (bytes.Buffer, error) {
 				vals := s.GetValueFromPath(key)
 				if vals != nil {
 					if s.EncryptionPath == key {
-						processed, err := s.ProcessValues(vals, action)
+						processed, err := s.ProcessValuesAt(vals, action, key)
 						if err != nil {
 							return buf, err
 						}
@@ -367,7 +496,7 @@ func (s *Sls) PerformAction(action string) (bytes.Buffer, error) {
 			} else {
 				vals := s.GetValueFromPath(key)
 				if vals != nil {
-					processed, err := s.ProcessValues(vals, action)
+					processed, err := s.ProcessValuesAt(vals, action, key)
 					if err != nil {
 						return buf, err
 					}
@@ -384,13 +513,9 @@ func (s *Sls) PerformAction(action string) (bytes.Buffer, error) {
 			s.KeyMap = stuff
 			var vals []string
 			for _, v := range s.KeyMap {
-				if v != nil {
-					node := getNode(v)
-					if node != nil {
-						vals = append(vals, node.(string))
-					}
-				}
+				vals = append(vals, getNode(v)...)
 			}
+			sort.Strings(vals)
 			unique := removeDuplicates(vals)
 			buf := bytes.Buffer{}
 			buf.WriteString(fmt.Sprintf("%d keys found:\n", len(unique)))
@@ -405,8 +530,37 @@ func (s *Sls) PerformAction(action string) (bytes.Buffer, error) {
 	return s.FormatBuffer(action)
 }
 
+// PerformActionAt applies an action to the values at a YAML path, leaving the rest of the
+// file as it is, and returns the whole file. ErrPathNotFound is returned when the path is
+// not in the file.
+func (s *Sls) PerformActionAt(action string, path string) (bytes.Buffer, error) {
+	s.Rotated = 0
+	s.Skipped = 0
+	s.Changes = nil
+
+	vals := s.GetValueFromPath(path)
+	if vals == nil {
+		return bytes.Buffer{}, fmt.Errorf("%w: '%s'", ErrPathNotFound, path)
+	}
+	processed, err := s.ProcessValuesAt(vals, action, path)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+	if err = s.setValue(path, processed); err != nil {
+		return bytes.Buffer{}, err
+	}
+
+	return s.FormatBuffer(action)
+}
+
 // ProcessValues will encrypt or decrypt given values
 func (s *Sls) ProcessValues(vals interface{}, action string) (interface{}, error) {
+	return s.ProcessValuesAt(vals, action, "")
+}
+
+// ProcessValuesAt will encrypt or decrypt given values found at the given YAML path,
+// the path is used to record the changes made
+func (s *Sls) ProcessValuesAt(vals interface{}, action string, path string) (interface{}, error) {
 	var res interface{}
 
 	if vals == nil {
@@ -415,15 +569,15 @@ func (s *Sls) ProcessValues(vals interface{}, action string) (interface{}, error
 	vtype := reflect.TypeOf(vals).Kind()
 	switch vtype {
 	case reflect.Slice:
-		return s.doSlice(vals, action)
+		return s.doSlice(vals, action, path)
 	case reflect.Map:
-		return s.doMap(vals.(map[string]interface{}), action)
+		return s.doMap(vals.(map[string]interface{}), action, path)
 	default:
-		return s.doString(vals, action)
+		return s.doString(vals, action, path)
 	}
 }
 
-func (s *Sls) doSlice(vals interface{}, action string) (interface{}, error) {
+func (s *Sls) doSlice(vals interface{}, action string, path string) (interface{}, error) {
 	var things []interface{}
 
 	if vals == nil {
@@ -436,16 +590,17 @@ func (s *Sls) doSlice(vals interface{}, action string) (interface{}, error) {
 		return things, fmt.Errorf("expected []interface{}, got %T", vals)
 	}
 
-	for _, item := range slice {
+	for index, item := range slice {
 		var thing interface{}
 		if item == nil {
 			continue
 		}
+		itemPath := joinPath(path, strconv.Itoa(index))
 		vtype := reflect.TypeOf(item).Kind()
 
 		switch vtype {
 		case reflect.Slice:
-			sliceStuff, err := s.doSlice(item, action)
+			sliceStuff, err := s.doSlice(item, action, itemPath)
 			if err != nil {
 				return vals, err
 			}
@@ -456,13 +611,13 @@ func (s *Sls) doSlice(vals interface{}, action string) (interface{}, error) {
 			if !ok {
 				return vals, fmt.Errorf("expected map[string]interface{}, got %T", thing)
 			}
-			mapStuff, err := s.doMap(mapThing, action)
+			mapStuff, err := s.doMap(mapThing, action, itemPath)
 			if err != nil {
 				return vals, err
 			}
 			things = append(things, mapStuff)
 		default:
-			thing, err := s.doString(item, action)
+			thing, err := s.doString(item, action, itemPath)
 			if err != nil {
 				return vals, err
 			}
@@ -473,7 +628,7 @@ func (s *Sls) doSlice(vals interface{}, action string) (interface{}, error) {
 	return things, nil
 }
 
-func (s *Sls) doMap(vals map[string]interface{}, action string) (map[string]interface{}, error) {
+func (s *Sls) doMap(vals map[string]interface{}, action string, path string) (map[string]interface{}, error) {
 	var ret = make(map[string]interface{})
 	var err error
 
@@ -486,7 +641,7 @@ func (s *Sls) doMap(vals map[string]interface{}, action string) (map[string]inte
 		switch vtype {
 		case reflect.Slice:
 			var slice interface{}
-			slice, err = s.doSlice(val, action)
+			slice, err = s.doSlice(val, action, joinPath(path, key))
 			if slice != nil {
 				ret[key] = slice
 			}
@@ -496,7 +651,7 @@ func (s *Sls) doMap(vals map[string]interface{}, action string) (map[string]inte
 			if !ok {
 				return ret, fmt.Errorf("expected map[string]interface{}, got %T", val)
 			}
-			slice, err = s.doMap(mapVal, action)
+			slice, err = s.doMap(mapVal, action, joinPath(path, key))
 			if err != nil {
 				return ret, err
 			}
@@ -505,7 +660,7 @@ func (s *Sls) doMap(vals map[string]interface{}, action string) (map[string]inte
 			}
 		default:
 			var slice interface{}
-			slice, err = s.doString(val, action)
+			slice, err = s.doString(val, action, joinPath(path, key))
 			if len(slice.(string)) != 0 {
 				ret[key] = slice
 			}
@@ -515,12 +670,13 @@ func (s *Sls) doMap(vals map[string]interface{}, action string) (map[string]inte
 	return ret, err
 }
 
-func (s *Sls) doString(val interface{}, action string) (string, error) {
+func (s *Sls) doString(val interface{}, action string, path string) (string, error) {
 	var err error
 
 	// %v is a 'cheat' in that it will convert any type
 	// and allow it to be used as a string output with sprintf
 	strVal := fmt.Sprintf("%v", val)
+	original := strVal
 
 	switch action {
 	case Decrypt:
@@ -536,6 +692,10 @@ func (s *Sls) doString(val interface{}, action string) (string, error) {
 			}
 		}
 	case Validate:
+		// plain text values have no keys, they are left out of the key map
+		if !isEncrypted(strVal) {
+			return "", nil
+		}
 		strVal, err = s.keyInfo(strVal)
 		if err != nil {
 			return strVal, err
@@ -547,44 +707,123 @@ func (s *Sls) doString(val interface{}, action string) (string, error) {
 		}
 	}
 
+	if action != Validate && strVal != original {
+		s.recordChange(path, action, original, strVal)
+		cipherText, fingerprint := strVal, s.keyFingerprint()
+		if action == Decrypt {
+			cipherText, fingerprint = original, s.Pki.DecryptionKeyFingerprint(original)
+		}
+		err = s.record(action, s.FilePath, path, audit.HashCipherText([]byte(cipherText)), fingerprint)
+	}
+
 	return strVal, err
 }
 
-func (s *Sls) rotateVal(strVal string) (string, error) {
-	strVal, err := s.decryptVal(strVal)
+// recordChange keeps track of a value changed by an action
+func (s *Sls) recordChange(path string, action string, before string, after string) {
+	s.Changes = append(s.Changes, Change{
+		Path:   path,
+		Action: action,
+		Before: len(before),
+		After:  len(after),
+	})
+}
+
+// record adds an entry to the audit log, if there is one, with the fingerprint of the key used
+func (s *Sls) record(operation string, file string, path string, hash string, fingerprint string) error {
+	// a dry run changes nothing, so there is nothing to record
+	if s.audit == nil || s.dryRun {
+		return nil
+	}
+	if abs, err := filepath.Abs(file); err == nil && file != "" {
+		file = abs
+	}
+	err := s.audit.Record(audit.Entry{
+		Operation:      operation,
+		File:           file,
+		Path:           path,
+		KeyFingerprint: fingerprint,
+		CipherTextHash: hash,
+	})
 	if err != nil {
-		return strVal, err
+		return fmt.Errorf("audit log: %w", err)
 	}
-	return s.Pki.EncryptSecret(strVal)
+	return nil
 }
 
-func isEncrypted(str string) bool {
-	return strings.Contains(str, pki.PGPHeader)
+// keyFingerprint is the fingerprint of the key values are encrypted to, empty when there is none
+func (s *Sls) keyFingerprint() string {
+	if s.Pki == nil || s.Pki.PublicKey == nil {
+		return ""
+	}
+	return fmt.Sprintf("%X", s.Pki.PublicKey.PrimaryKey.Fingerprint)
 }
 
-func (s *Sls) keyInfo(val string) (string, error) {
-	if !isEncrypted(val) {
-		return val, fmt.Errorf("value is not encrypted")
+// joinPath appends a key to a colon separated YAML path
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
 	}
+	return path + ":" + key
+}
 
-	tmpfile, err := os.CreateTemp("", "gsp-")
+func (s *Sls) rotateVal(strVal string) (string, error) {
+	// when rotating selectively only values encrypted to one of the
+	// given keys are re-encrypted, everything else is left as is
+	if len(s.RotateFrom) > 0 {
+		if !isEncrypted(strVal) {
+			return strVal, nil
+		}
+		match, err := encryptedToAny(strVal, s.RotateFrom)
+		if err != nil {
+			return strVal, err
+		}
+		if !match {
+			s.Skipped++
+			return strVal, nil
+		}
+	}
+
+	plainText, err := s.decryptVal(strVal)
 	if err != nil {
-		return val, fmt.Errorf("keyInfo: %s", err)
+		return strVal, err
 	}
-	defer func() {
-		tmpfile.Close()
-		os.Remove(tmpfile.Name())
-	}()
-	// Set secure permissions
-	if err := tmpfile.Chmod(0600); err != nil {
-		return val, fmt.Errorf("keyInfo: %s", err)
+	cipherText, err := s.Pki.EncryptSecret(plainText)
+	if err != nil {
+		return strVal, err
 	}
+	s.Rotated++
 
-	if _, err = tmpfile.Write([]byte(val)); err != nil {
-		return val, fmt.Errorf("keyInfo: %s", err)
+	return cipherText, nil
+}
+
+// encryptedToAny checks if the encrypted value was encrypted to any of the given key IDs
+func encryptedToAny(cipherText string, keyIDs []uint64) (bool, error) {
+	ids, err := pki.EncryptedToKeyIDs(cipherText)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		for _, keyID := range keyIDs {
+			if id == keyID {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func isEncrypted(str string) bool {
+	return strings.Contains(str, pki.PGPHeader)
+}
+
+func (s *Sls) keyInfo(val string) (string, error) {
+	if !isEncrypted(val) {
+		return val, ErrNotEncrypted
 	}
 
-	keyInfo, err := s.Pki.KeyUsedForEncryptedFile(tmpfile.Name())
+	keyInfo, err := s.Pki.KeyUsedForEncryptedMessage(val)
 	if err != nil {
 		return val, fmt.Errorf("keyInfo: %s", err)
 	}
@@ -599,7 +838,7 @@ func (s *Sls) decryptVal(strVal string) (string, error) {
 		var err error
 		plainText, err = s.Pki.DecryptSecret(strVal)
 		if err != nil {
-			return strVal, fmt.Errorf("error decrypting value: %s", err)
+			return strVal, fmt.Errorf("error decrypting value: %w", err)
 		}
 	} else {
 		return strVal, nil
@@ -618,40 +857,28 @@ func containsDirectoryTraversal(path string) bool {
 	return strings.Contains(cleaned, "..") || strings.Contains(path, "../") || strings.Contains(path, "..\\")
 }
 
+func defaultLogger() zerolog.Logger {
+	return zerolog.New(os.Stderr)
+}
+
 func shortFileName(file string) string {
 	pwd, err := os.Getwd()
 	if err != nil {
-		logger := zerolog.New(os.Stdout)
-		logger.Warn().Err(err)
 		return file
 	}
 	return strings.Replace(file, pwd+"/", "", 1)
 }
 
-func getNode(v interface{}) interface{} {
-	var node interface{}
-	if v == nil {
-		return nil
-	}
-
-	vtype := reflect.TypeOf(v)
-	if vtype == nil {
-		return nil
-	}
-	kind := vtype.Kind()
-
-	switch kind {
-	case reflect.Slice:
-	case reflect.Map:
-		if mapVal, ok := v.(map[string]interface{}); ok {
-			for _, v2 := range mapVal {
-				node = getNode(v2)
-			}
+// getNode returns every leaf value under v, including the items of lists
+func getNode(v interface{}) []string {
+	var nodes []string
+	walkValues(v, "", func(_ string, value interface{}) {
+		if value == "" {
+			return
 		}
-	default:
-		node = fmt.Sprintf("%v", v)
-	}
-	return node
+		nodes = append(nodes, fmt.Sprintf("%v", value))
+	})
+	return nodes
 }
 
 func removeDuplicates(elements []string) []string {
@@ -0,0 +1,137 @@
+// Copyright © 2018 Everbridge, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package sls
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/pki"
+)
+
+// Corrupt issue, the value could not be armor decoded as a PGP message
+const Corrupt = "corrupt"
+
+// UnknownRecipient issue, the value is not encrypted to any key in the key rings
+const UnknownRecipient = "unknown-recipient"
+
+// Undecryptable issue, the value could not be decrypted
+const Undecryptable = "undecryptable"
+
+// BadSignature issue, the decrypted value is unsigned or not signed by a trusted key
+const BadSignature = "bad-signature"
+
+// WeakAlgorithm issue, the value was encrypted or signed with a weaker algorithm than the crypto settings allow
+const WeakAlgorithm = "weak-algorithm"
+
+// Unrecorded issue, the decrypted value could not be recorded in the audit log
+const Unrecorded = "unrecorded"
+
+// MixedKeys issue, the values in the file are encrypted to different keys
+const MixedKeys = "mixed-keys"
+
+// Issue describes a problem found with the encrypted values in a file
+type Issue struct {
+	Path    string
+	Kind    string
+	Message string
+}
+
+// Verify checks that every encrypted value in the file is well formed and encrypted
+// to a key in the key rings, optionally decrypting each value as well, and returns
+// the issues found along with the number of encrypted values checked. Signatures are
+// checked on decrypted values unless the signature policy ignores them, and with crypto
+// settings the cipher and hash of decrypted values are checked as well. Decrypted values
+// are recorded in the audit log.
+func (s *Sls) Verify(decrypt bool) ([]Issue, int) {
+	var issues []Issue
+	checked := 0
+	recipients := map[string][]string{}
+
+	s.WalkValues(func(path string, value interface{}) {
+		strVal := fmt.Sprintf("%v", value)
+		if !isEncrypted(strVal) {
+			return
+		}
+		checked++
+
+		ids, err := pki.EncryptedToKeyIDs(strVal)
+		if err != nil {
+			issues = append(issues, Issue{path, Corrupt, err.Error()})
+			return
+		}
+
+		known := false
+		for _, id := range ids {
+			known = known || s.Pki.HasKeyID(id)
+		}
+		if !known {
+			issues = append(issues, Issue{path, UnknownRecipient, fmt.Sprintf("encrypted to unknown key IDs %s", formatKeyIDs(ids))})
+		}
+		recipients[formatKeyIDs(ids)] = append(recipients[formatKeyIDs(ids)], path)
+
+		if decrypt {
+			_, sigErr, err := s.Pki.DecryptAndVerify(strVal)
+			if err == nil {
+				hash := audit.HashCipherText([]byte(strVal))
+				if err := s.record(Decrypt, s.FilePath, path, hash, s.Pki.DecryptionKeyFingerprint(strVal)); err != nil {
+					issues = append(issues, Issue{path, Unrecorded, err.Error()})
+				}
+			}
+			if err != nil {
+				issues = append(issues, Issue{path, Undecryptable, err.Error()})
+			} else if sigErr != nil && s.Pki.SignaturePolicy != "" && s.Pki.SignaturePolicy != pki.SignaturesIgnore {
+				issues = append(issues, Issue{path, BadSignature, sigErr.Error()})
+			}
+			if err == nil && s.Pki.Config != nil {
+				algorithms, err := s.Pki.MessageAlgorithms(strVal)
+				if err == nil {
+					err = s.Pki.CheckAlgorithms(algorithms)
+				}
+				if err != nil {
+					issues = append(issues, Issue{path, WeakAlgorithm, err.Error()})
+				}
+			}
+		}
+	})
+
+	if len(recipients) > 1 {
+		keySets := make([]string, 0, len(recipients))
+		for keySet, paths := range recipients {
+			keySets = append(keySets, fmt.Sprintf("%s (%d values)", keySet, len(paths)))
+		}
+		sort.Strings(keySets)
+		issues = append(issues, Issue{"", MixedKeys, fmt.Sprintf("values are encrypted to different keys: %s", strings.Join(keySets, ", "))})
+	}
+
+	return issues, checked
+}
+
+func formatKeyIDs(ids []uint64) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = fmt.Sprintf("%X", id)
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ",")
+}
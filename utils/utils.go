@@ -23,23 +23,22 @@ package utils
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/Everbridge/generate-secure-pillar/audit"
+	"github.com/Everbridge/generate-secure-pillar/glob"
 	"github.com/Everbridge/generate-secure-pillar/pki"
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
-var logger = zerolog.New(os.Stdout)
-
-func init() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
-}
-
 // ContainsDirectoryTraversal checks for directory traversal attempts in path
 func ContainsDirectoryTraversal(path string) bool {
 	if path == "" {
@@ -52,40 +51,140 @@ func ContainsDirectoryTraversal(path string) bool {
 		strings.HasPrefix(path, "..") && (len(path) == 2 || path[2] == '/' || path[2] == '\\')
 }
 
-// SafeWrite checks that there is no error prior to trying to write a file
-func SafeWrite(buffer bytes.Buffer, outputFilePath string, err error) {
+// SafeWrite checks that there is no error prior to trying to write a file, the error
+// given or the one from writing the file is returned
+func SafeWrite(buffer bytes.Buffer, outputFilePath string, err error) error {
 	if err != nil {
-		logger.Fatal().Err(err)
-	} else {
-		_, err = sls.WriteSlsFile(buffer, outputFilePath)
-		if err != nil {
-			logger.Fatal().Err(err)
-		}
+		return err
 	}
+	_, err = sls.WriteSlsFile(buffer, outputFilePath)
+	return err
 }
 
-// PathAction applies an action to a YAML path
-func PathAction(s *sls.Sls, path string, action string) {
+// PrintPlan writes a summary of the changes an action would make to the output file
+// along with the byte deltas, it is used in place of writing the file for a dry run
+func PrintPlan(w io.Writer, s *sls.Sls, outputFilePath string, buffer bytes.Buffer) error {
+	var plan bytes.Buffer
+
+	current := 0
+	if fi, err := os.Stat(outputFilePath); err == nil && fi.Mode().IsRegular() {
+		current = int(fi.Size())
+	}
+	target := outputFilePath
+	if outputFilePath == os.Stdout.Name() {
+		target = "STDOUT"
+	}
+
+	fmt.Fprintf(&plan, "%s: %d changes, %d -> %d bytes (%+d)", target, len(s.Changes), current, buffer.Len(), buffer.Len()-current)
+	if s.Skipped > 0 {
+		fmt.Fprintf(&plan, ", %d skipped", s.Skipped)
+	}
+	fmt.Fprintln(&plan)
+	changes := append([]sls.Change(nil), s.Changes...)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	for _, change := range changes {
+		fmt.Fprintf(&plan, "  %-8s %s (%+d bytes)\n", change.Action, change.Path, change.After-change.Before)
+	}
+
+	// written in one go so plans for files processed concurrently don't interleave
+	_, err := w.Write(plan.Bytes())
+	return err
+}
+
+// PathAction applies an action to a YAML path and returns the values it produced, the file
+// is not changed. sls.ErrPathNotFound is returned when the path is not in the file
+func PathAction(s *sls.Sls, path string, action string) (interface{}, error) {
 	vals := s.GetValueFromPath(path)
-	if vals != nil {
-		processedVals, err := s.ProcessValues(vals, action)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("path action failed")
-		}
-		fmt.Printf("%s: %s\n", path, processedVals)
-	} else {
-		logger.Warn().Msgf("unable to find path: '%s'", path)
+	if vals == nil {
+		return nil, fmt.Errorf("%w: '%s'", sls.ErrPathNotFound, path)
+	}
+	processedVals, err := s.ProcessValuesAt(vals, action, path)
+	if err != nil {
+		return nil, fmt.Errorf("path action failed: %w", err)
+	}
+	return processedVals, nil
+}
+
+// DirOptions holds the settings used when applying an action to a directory of files
+type DirOptions struct {
+	FileExt         string
+	Action          string
+	OutputFilePath  string
+	TopLevelElement string
+	// RotateFrom limits a rotate action to values encrypted to one of these key IDs
+	RotateFrom []uint64
+	// RotateFromKeys limits a rotate action like RotateFrom, the key names, emails or IDs
+	// are looked up in the keys of each file
+	RotateFromKeys []string
+	// DryRun reports what an action would change without writing any files
+	DryRun bool
+	// Jobs is the number of files processed at once, 0 for all of them
+	Jobs int
+	// Include and Exclude are globs relative to the directory, see glob.Filter
+	Include []string
+	Exclude []string
+	// Logger is used in place of the default logger, which writes JSON to STDERR
+	Logger *zerolog.Logger
+	// AuditFor returns the audit log for the operations done with the keys of a file,
+	// nil to record nothing
+	AuditFor func(keys *pki.Pki) *audit.Log
+}
+
+func (opts DirOptions) logger() *zerolog.Logger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	logger := zerolog.New(os.Stderr)
+	return &logger
+}
+
+// rotatingFrom reports whether a rotation is limited to the values of some keys
+func (opts DirOptions) rotatingFrom() bool {
+	return len(opts.RotateFrom) > 0 || len(opts.RotateFromKeys) > 0
+}
+
+func (opts DirOptions) audit(keys *pki.Pki) *audit.Log {
+	if opts.AuditFor == nil {
+		return nil
 	}
+	return opts.AuditFor(keys)
 }
 
 // ProcessDir applies an action concurrently to a directory of files
 func ProcessDir(searchDir string, fileExt string, action string, outputFilePath string, topLevelElement string, pk pki.Pki) error {
+	opts := DirOptions{
+		FileExt:         fileExt,
+		Action:          action,
+		OutputFilePath:  outputFilePath,
+		TopLevelElement: topLevelElement,
+	}
+	return ProcessDirWithOptions(searchDir, opts, pk)
+}
+
+// ProcessDirWithOptions applies an action concurrently to a directory of files using the given options
+func ProcessDirWithOptions(searchDir string, opts DirOptions, pk pki.Pki) error {
+	return ProcessDirWithKeys(searchDir, opts, func(string) (*pki.Pki, error) {
+		return &pk, nil
+	})
+}
+
+// ProcessDirWithKeys applies an action concurrently to a directory of files, using the
+// keys keysFor picks for each file. keysFor is called from several goroutines at once, the
+// keys it returns may be shared between them.
+func ProcessDirWithKeys(searchDir string, opts DirOptions, keysFor func(file string) (*pki.Pki, error)) error {
 	if len(searchDir) == 0 {
 		return fmt.Errorf("search directory not specified")
 	}
+	opts.Logger = opts.logger()
+	logger := opts.Logger
 
 	// get a list of sls files along with the count
-	files, count := FindFilesByExt(searchDir, fileExt)
+	files, _, err := FindFilesByExt(searchDir, opts.FileExt)
+	if err != nil {
+		return err
+	}
+	files = glob.Filter(searchDir, files, opts.Include, opts.Exclude)
+	count := len(files)
 
 	// copy files to a channel then close the
 	// channel so that workers stop when done
@@ -96,14 +195,26 @@ func ProcessDir(searchDir string, fileExt string, action string, outputFilePath
 	close(filesChan)
 
 	errChan := make(chan error, count)
-	resChan := make(chan int, count)
+	resChan := make(chan result, count)
 	remaining := count
 
 	// run workers
-	for i := 0; i < count; i++ {
+	workers := count
+	if opts.Jobs > 0 && opts.Jobs < count {
+		workers = opts.Jobs
+	}
+	for i := 0; i < workers; i++ {
 		go func() {
 			for file := range filesChan {
-				resChan <- applyActionAndWrite(file, action, &pk, topLevelElement, errChan)
+				start := time.Now()
+				pk, err := keysFor(file)
+				if err != nil {
+					handleErr(err, errChan)
+					resChan <- result{file: file}
+					continue
+				}
+				byteCount := applyActionAndWrite(file, opts, pk, errChan)
+				resChan <- result{file: file, byteCount: byteCount, duration: time.Since(start)}
 			}
 		}()
 	}
@@ -111,10 +222,11 @@ func ProcessDir(searchDir string, fileExt string, action string, outputFilePath
 	// collect results
 	for i := 0; i < count; i++ {
 		select {
-		case byteCount := <-resChan:
-			if action != sls.Validate && outputFilePath != os.Stdout.Name() {
-				logger.Info().Msgf("%d bytes written", byteCount)
-				logger.Info().Msgf("Finished processing %d of %d files\n", count-remaining+1, count)
+		case res := <-resChan:
+			if opts.Action != sls.Validate && opts.OutputFilePath != os.Stdout.Name() {
+				logger.Info().Str("file", res.file).Str("action", opts.Action).Dur("duration", res.duration).
+					Msgf("%d bytes written", res.byteCount)
+				logger.Info().Msgf("Finished processing %d of %d files", count-remaining+1, count)
 			}
 			remaining--
 		case err := <-errChan:
@@ -127,18 +239,46 @@ func ProcessDir(searchDir string, fileExt string, action string, outputFilePath
 	return nil
 }
 
-func applyActionAndWrite(file string, action string, pk *pki.Pki, topLevelElement string, errChan chan error) int {
+// result is what processing one file of a directory produced
+type result struct {
+	file      string
+	byteCount int
+	duration  time.Duration
+}
+
+func applyActionAndWrite(file string, opts DirOptions, pk *pki.Pki, errChan chan error) int {
 	byteCount := 0
-	s := sls.New(file, *pk, topLevelElement)
-	if s.IsInclude {
+	action := opts.Action
+	logger := opts.logger()
+	s, err := sls.NewWithOptions(sls.Options{
+		FilePath:       file,
+		Pki:            pk,
+		EncryptionPath: opts.TopLevelElement,
+		Logger:         logger,
+		Audit:          opts.audit(pk),
+		DryRun:         opts.DryRun,
+	})
+	if errors.Is(err, sls.ErrIncludeDirective) {
+		logger.Warn().Err(err).Str("file", file).Msg("skipping file")
 		return 0
 	}
+	if err != nil {
+		handleErr(err, errChan)
+		return 0
+	}
+	s.RotateFrom = opts.RotateFrom
+	for _, key := range opts.RotateFromKeys {
+		ids, err := pk.KeyIDs(key)
+		if err != nil {
+			handleErr(err, errChan)
+			return 0
+		}
+		s.RotateFrom = append(s.RotateFrom, ids...)
+	}
 
 	buf, err := s.PerformAction(action)
-	if buf.Len() > 0 && err != nil && action != sls.Validate {
-		logger.Warn().Err(err)
-	} else if err != nil && action == sls.Validate {
-		logger.Warn().Err(err)
+	if err != nil && (buf.Len() > 0 || action == sls.Validate) {
+		logger.Warn().Err(err).Str("file", file).Str("action", action).Msg("action failed")
 	} else if action == sls.Validate {
 		fmt.Printf("%s:\nkey count: %d\n%s\n", s.FilePath, s.KeyCount, buf.String())
 		return byteCount
@@ -148,8 +288,21 @@ func applyActionAndWrite(file string, action string, pk *pki.Pki, topLevelElemen
 		return byteCount
 	}
 
+	if opts.DryRun && action != sls.Validate {
+		err = PrintPlan(os.Stdout, &s, file, buf)
+		handleErr(err, errChan)
+		return byteCount
+	}
+	if action == sls.Rotate && opts.rotatingFrom() {
+		fmt.Printf("%s: %d rotated, %d skipped\n", s.FilePath, s.Rotated, s.Skipped)
+		if s.Rotated == 0 {
+			// nothing was encrypted to the old key, leave the file alone
+			return byteCount
+		}
+	}
+
 	if action != sls.Validate {
-		byteCount, err = sls.WriteSlsFile(buf, file)
+		byteCount, err = s.WriteFile(buf, file)
 	} else {
 		byteCount, err = os.Stdout.Write(buf.Bytes())
 	}
@@ -174,37 +327,38 @@ func handleErr(err error, errChan chan error) {
 }
 
 // FindFilesByExt recurses through the given searchDir returning a list of files with a given extension and it's length
-func FindFilesByExt(searchDir string, ext string) ([]string, int) {
+func FindFilesByExt(searchDir string, ext string) ([]string, int, error) {
 	fileList := []string{}
 	searchDir, err := filepath.Abs(searchDir)
 	if err != nil {
-		logger.Error().Err(err)
-		return fileList, 0
+		return fileList, 0, err
 	}
 	err = checkForDir(searchDir)
 	if err != nil {
-		logger.Error().Err(err)
-		return fileList, 0
+		return fileList, 0, err
 	}
 
 	err = filepath.Walk(searchDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if !f.IsDir() && filepath.Ext(f.Name()) == ext {
 			fileList = append(fileList, path)
 		}
 		return nil
 	})
 	if err != nil {
-		logger.Fatal().Err(err).Msg("error walking file path")
+		return []string{}, 0, fmt.Errorf("error walking file path: %w", err)
 	}
 
-	return fileList, len(fileList)
+	return fileList, len(fileList), nil
 }
 
 // checkForDir does exactly what it says on the tin
 func checkForDir(filePath string) error {
 	fi, err := os.Stat(filePath)
 	if err != nil {
-		return fmt.Errorf("cannot stat %s: %s", filePath, err)
+		return fmt.Errorf("cannot stat %s: %w", filePath, err)
 	}
 	switch mode := fi.Mode(); {
 	case mode.IsRegular():